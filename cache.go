@@ -0,0 +1,152 @@
+package pup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Address returns the content address of buf.  Addresses are
+// rendered as "sha256:<hex>", the same form pupd uses for its
+// well-known hashes.
+func Address(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Cache is a content-addressable chunk store.  Each chunk is stored
+// under its address along with the addresses of any other chunks it
+// references; those references are the edges the garbage collector
+// walks when deciding what is still reachable.
+type Cache struct {
+	// MaxBytes and MaxAge bound the space used by unreachable
+	// chunks.  If both are zero, a GC pass sweeps every
+	// unreachable chunk.  See GC.
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	mu     sync.Mutex
+	chunks map[string]*chunk
+	pins   map[string]bool
+	roots  []func() []string
+	// pass counts GC passes; see GC
+	pass uint64
+}
+
+type chunk struct {
+	content []byte
+	refs    []string
+	stored  time.Time
+	used    time.Time
+	// pass is the GC pass the chunk was last stored during
+	pass uint64
+}
+
+func (c *Cache) init() {
+	if c.chunks == nil {
+		c.chunks = make(map[string]*chunk)
+	}
+	if c.pins == nil {
+		c.pins = make(map[string]bool)
+	}
+}
+
+// Put stores content in the cache and returns its address.  refs
+// lists the addresses of other chunks that content refers to.
+// Storing the same content twice is harmless.
+func (c *Cache) Put(content []byte, refs ...string) (addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	addr = Address(content)
+	now := time.Now()
+	ck, ok := c.chunks[addr]
+	if !ok {
+		buf := make([]byte, len(content))
+		copy(buf, content)
+		ck = &chunk{content: buf, stored: now}
+		c.chunks[addr] = ck
+	}
+	ck.refs = mergeRefs(ck.refs, refs)
+	ck.used = now
+	ck.pass = c.pass
+	return
+}
+
+// Get returns the content stored at addr.  It returns an Error with
+// ENOENT if the chunk is not in the cache.
+func (c *Cache) Get(addr string) (content []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	ck, ok := c.chunks[addr]
+	if !ok {
+		return nil, Error{syscall.ENOENT, addr}
+	}
+	ck.used = time.Now()
+	return ck.content, nil
+}
+
+// Has returns true if addr is in the cache.
+func (c *Cache) Has(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	_, ok := c.chunks[addr]
+	return ok
+}
+
+// Refs returns the addresses that the chunk at addr refers to.
+func (c *Cache) Refs(addr string) (refs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	ck, ok := c.chunks[addr]
+	if !ok {
+		return
+	}
+	return append(refs, ck.refs...)
+}
+
+// Addrs returns the sorted addresses of every chunk in the cache.
+func (c *Cache) Addrs() (addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	for addr := range c.chunks {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return
+}
+
+// Size returns the total number of content bytes in the cache.
+func (c *Cache) Size() (size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	for _, ck := range c.chunks {
+		size += int64(len(ck.content))
+	}
+	return
+}
+
+// mergeRefs appends the refs in b that are not already in a.
+func mergeRefs(a, b []string) []string {
+	for _, ref := range b {
+		found := false
+		for _, have := range a {
+			if have == ref {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, ref)
+		}
+	}
+	return a
+}
@@ -0,0 +1,43 @@
+package pup
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestAddress(t *testing.T) {
+	got := Address([]byte("hello"))
+	want := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	Tassert(t, got == want, "wanted %v got %v", want, got)
+}
+
+func TestCache(t *testing.T) {
+	c := &Cache{}
+
+	a := c.Put([]byte("a"))
+	Tassert(t, a == Address([]byte("a")), "addr %v", a)
+	b := c.Put([]byte("b"), a)
+	Tassert(t, c.Has(a) && c.Has(b), "missing chunks")
+
+	got, err := c.Get(b)
+	Tassert(t, err == nil, "Get: %v", err)
+	Tassert(t, string(got) == "b", "got '%v'", string(got))
+
+	refs := c.Refs(b)
+	Tassert(t, len(refs) == 1 && refs[0] == a, "refs %v", refs)
+
+	// storing the same content again merges refs
+	c.Put([]byte("b"), a, "sha256:other")
+	refs = c.Refs(b)
+	Tassert(t, len(refs) == 2, "refs %v", refs)
+
+	Tassert(t, c.Size() == 2, "size %v", c.Size())
+	Tassert(t, len(c.Addrs()) == 2, "addrs %v", c.Addrs())
+
+	_, err = c.Get("sha256:nope")
+	var perr Error
+	Tassert(t, errors.As(err, &perr) && perr.Errno == syscall.ENOENT, "err %v", err)
+}
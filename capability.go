@@ -0,0 +1,369 @@
+package pup
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// MaxSkew is how far the time in a signed request may be from the
+// server's clock.
+const MaxSkew = 5 * time.Minute
+
+// Capability grants Subject the right to perform Ops on the targets
+// matching Scopes until Expires.  It is signed by Issuer.
+//
+// The operations are "call", "register", "publish" and "subscribe".
+// A call or register target is a hash, and a publish or subscribe
+// target is a topic.  A scope is either "*", which matches anything,
+// a topic pattern (see MatchTopic), or a hash pattern in path.Match
+// syntax such as "sha256:ab*".  A subscription is allowed only if
+// every topic its pattern can match is in a scope; see within.  Ops
+// and scopes can't contain spaces or commas.
+type Capability struct {
+	Issuer  string
+	Subject string
+	Ops     []string
+	Scopes  []string
+	Expires time.Time
+	Sig     []byte
+}
+
+// Grant issues a capability to subject, signed by id.  To delegate,
+// the subject of one capability grants a narrower one to someone else:
+// see Token.
+func (id *Identity) Grant(subject string, ops, scopes []string, expires time.Time) *Capability {
+	c := &Capability{Issuer: id.Addr, Subject: subject, Ops: ops, Scopes: scopes, Expires: time.Unix(expires.Unix(), 0)}
+	c.Sig = id.Sign(c.signed())
+	return c
+}
+
+func (c *Capability) signed() []byte {
+	return []byte(Spf("cap %s %s %s %s %d", c.Issuer, c.Subject,
+		strings.Join(c.Ops, ","), strings.Join(c.Scopes, ","), c.Expires.Unix()))
+}
+
+// Encode returns c as one line, without the newline.
+func (c *Capability) Encode() string {
+	return Spf("%s %x", c.signed(), c.Sig)
+}
+
+// ParseCapability parses a line produced by Encode.
+func ParseCapability(line string) (c *Capability, err error) {
+	defer Return(&err)
+	parts := strings.Split(line, " ")
+	ErrnoIf(len(parts) != 7 || parts[0] != "cap", syscall.EBADMSG, "malformed capability: %q", line)
+	c = &Capability{Issuer: parts[1], Subject: parts[2],
+		Ops: strings.Split(parts[3], ","), Scopes: strings.Split(parts[4], ",")}
+	secs, err := strconv.ParseInt(parts[5], 10, 64)
+	Ck(err)
+	c.Expires = time.Unix(secs, 0)
+	c.Sig, err = hex.DecodeString(parts[6])
+	Ck(err)
+	return
+}
+
+// EncodeChain returns a delegation chain as lines, one per capability.
+func EncodeChain(chain []*Capability) []byte {
+	var b strings.Builder
+	for _, c := range chain {
+		b.WriteString(c.Encode() + "\n")
+	}
+	return []byte(b.String())
+}
+
+// ParseChain parses the output of EncodeChain.
+func ParseChain(buf []byte) (chain []*Capability, err error) {
+	defer Return(&err)
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		c, err := ParseCapability(line)
+		Ck(err)
+		chain = append(chain, c)
+	}
+	return
+}
+
+// allows reports whether c, taken on its own, allows op on target.
+func (c *Capability) allows(op, target string) bool {
+	found := false
+	for _, o := range c.Ops {
+		found = found || o == op
+	}
+	if !found {
+		return false
+	}
+	for _, scope := range c.Scopes {
+		switch {
+		case scope == "*":
+			return true
+		case op == "subscribe":
+			if strings.HasPrefix(scope, "/") && within(scope, target) {
+				return true
+			}
+		case strings.HasPrefix(target, "/"):
+			if strings.HasPrefix(scope, "/") && MatchTopic(scope, target) {
+				return true
+			}
+		default:
+			if ok, _ := path.Match(scope, target); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// within reports whether every topic that pattern matches also
+// matches scope; both are topic patterns, see MatchTopic.  When in
+// doubt it says no.  A prefix scope takes the patterns whose leading
+// literal segments are under it.  A glob scope takes only glob
+// patterns with as many segments, each of which is the scope's, a
+// literal the scope's matches, or anything if the scope's is "*".
+func within(scope, pattern string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		return false
+	}
+	glob := func(s string) bool { return strings.ContainsAny(s, "*?[") }
+	literal := func(s string) bool { return !strings.ContainsAny(s, `*?[\`) }
+	segs := strings.Split(pattern, "/")
+	if !glob(scope) {
+		i := 0
+		for i < len(segs) && literal(segs[i]) {
+			i++
+		}
+		prefix := strings.Join(segs[:i], "/")
+		if prefix == "" {
+			prefix = "/"
+		}
+		return MatchTopic(scope, prefix)
+	}
+	// a pattern that isn't a glob matches a whole subtree, and a
+	// glob scope only matches topics of one depth
+	scopeSegs := strings.Split(scope, "/")
+	if !glob(pattern) || len(segs) != len(scopeSegs) {
+		return false
+	}
+	for i, seg := range segs {
+		ok, _ := path.Match(scopeSegs[i], seg)
+		if seg != scopeSegs[i] && scopeSegs[i] != "*" && !(literal(seg) && ok) {
+			return false
+		}
+	}
+	return true
+}
+
+// Token is what a caller presents in a stream header to prove it may
+// use the stream's hash: a delegation chain, and the holder's
+// signature of the hash, the time and a random nonce.  Each capability in the chain
+// is issued by the subject of the one before, and the holder is the
+// subject of the last.  A token allows what every capability in its
+// chain allows, so a delegated capability can only narrow what its
+// issuer holds.
+type Token struct {
+	Chain []*Capability
+	Time  time.Time
+	Nonce []byte
+	Sig   []byte
+}
+
+// NewToken returns a token presenting chain, held by id, for a stream
+// to hash.
+func NewToken(chain []*Capability, id *Identity, hash string, now time.Time) *Token {
+	t := &Token{Chain: chain, Time: time.Unix(now.Unix(), 0), Nonce: make([]byte, 16)}
+	_, err := rand.Read(t.Nonce)
+	Ck(err)
+	t.Sig = id.Sign(t.proof(hash))
+	return t
+}
+
+func (t *Token) proof(hash string) []byte {
+	return []byte(Spf("%s %d %x", hash, t.Time.Unix(), t.Nonce))
+}
+
+// Encode returns the token as it appears in a stream header: the
+// chain followed by a "proof <time> <nonce> <sig>" line,
+// base64url-encoded.
+func (t *Token) Encode() string {
+	text := Spf("%sproof %d %x %x", EncodeChain(t.Chain), t.Time.Unix(), t.Nonce, t.Sig)
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
+
+// ParseToken decodes the output of Encode.
+func ParseToken(s string) (t *Token, err error) {
+	defer Return(&err)
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	Ck(err)
+	text := string(buf)
+	i := strings.LastIndex(text, "\n")
+	ErrnoIf(i < 0, syscall.EBADMSG, "token has no capabilities")
+	t = &Token{}
+	t.Chain, err = ParseChain([]byte(text[:i]))
+	Ck(err)
+	parts := strings.Split(text[i+1:], " ")
+	ErrnoIf(len(parts) != 4 || parts[0] != "proof", syscall.EBADMSG, "malformed token proof: %q", text[i+1:])
+	secs, err := strconv.ParseInt(parts[1], 10, 64)
+	Ck(err)
+	t.Time = time.Unix(secs, 0)
+	t.Nonce, err = hex.DecodeString(parts[2])
+	Ck(err)
+	t.Sig, err = hex.DecodeString(parts[3])
+	Ck(err)
+	return
+}
+
+// Verify checks that the token's chain starts at one of authorities,
+// that every link is signed by the subject of the one before and has
+// not expired, and that the holder signed the token for hash within
+// MaxSkew of now.  Failures are Errors with EACCES.  Verify doesn't
+// check that the nonce is new; servers do that when they authenticate
+// a stream.
+func (t *Token) Verify(authorities []string, hash string, now time.Time) (err error) {
+	defer Return(&err)
+	ErrnoIf(len(t.Chain) == 0, syscall.EACCES, "empty token")
+	root := false
+	for _, a := range authorities {
+		root = root || t.Chain[0].Issuer == a
+	}
+	ErrnoIf(!root, syscall.EACCES, "token issued by %s, not an authority", t.Chain[0].Issuer)
+	for i, c := range t.Chain {
+		if i > 0 {
+			prev := t.Chain[i-1].Subject
+			ErrnoIf(c.Issuer != prev, syscall.EACCES, "capability %d issued by %s, not %s", i, c.Issuer, prev)
+		}
+		ErrnoIf(!now.Before(c.Expires), syscall.EACCES, "capability %d expired at %v", i, c.Expires)
+		err = Verify(c.Issuer, c.signed(), c.Sig)
+		Ck(err)
+	}
+	skew := now.Sub(t.Time)
+	if skew < 0 {
+		skew = -skew
+	}
+	ErrnoIf(skew > MaxSkew, syscall.EACCES, "token signed at %v", t.Time)
+	err = Verify(t.Holder(), t.proof(hash), t.Sig)
+	Ck(err)
+	return
+}
+
+// Holder returns the participant address of the token's holder, the
+// subject of the last capability in its chain.
+func (t *Token) Holder() string {
+	if len(t.Chain) == 0 {
+		return ""
+	}
+	return t.Chain[len(t.Chain)-1].Subject
+}
+
+// Authorize returns an Error with EACCES unless every capability in
+// the chain allows op on target.  It doesn't Verify the token.
+func (t *Token) Authorize(op, target string) error {
+	for _, c := range t.Chain {
+		if !c.allows(op, target) {
+			return Error{syscall.EACCES, Spf("token doesn't allow %s on %s", op, target)}
+		}
+	}
+	return nil
+}
+
+// RequireTokens makes the server refuse streams whose header doesn't
+// carry a valid Token rooted at one of authorities, which are
+// participant addresses.  The header becomes "<hash> <token>", and
+// the token must allow calling the hash.  PUBLISH, SUBSCRIBE and
+// REGISTER streams instead need the token to allow publishing or
+// subscribing to the requested topic, or registering the requested
+// hash; the lambdas behind them check with Authorize.  Each token is
+// good for one stream: a token whose nonce the server has already seen
+// is refused.
+func (s *Server) RequireTokens(authorities ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorities = authorities
+}
+
+// TokensRequired reports whether the server requires tokens; see
+// RequireTokens.
+func (s *Server) TokensRequired() bool {
+	return s.getAuthorities() != nil
+}
+
+func (s *Server) getAuthorities() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorities
+}
+
+// authenticate checks the token in a stream header for hash.  It
+// returns the stream to hand to the lambda, which carries the token.
+func (s *Server) authenticate(hash, token string, stream io.ReadWriteCloser) (_ io.ReadWriteCloser, err error) {
+	defer Return(&err)
+	authorities := s.getAuthorities()
+	if authorities == nil {
+		return stream, nil
+	}
+	ErrnoIf(token == "", syscall.EACCES, "no token for %s", hash)
+	t, err := ParseToken(token)
+	Ck(err)
+	now := time.Now()
+	err = t.Verify(authorities, hash, now)
+	Ck(err)
+	err = s.fresh(t, now)
+	Ck(err)
+	switch hash {
+	case PUBLISH, SUBSCRIBE, REGISTER:
+	default:
+		err = t.Authorize("call", hash)
+		Ck(err)
+	}
+	return &tokenStream{wrapper: wrapper{stream}, token: t}, nil
+}
+
+// fresh returns an Error with EACCES if the holder of t has used its
+// nonce before, and otherwise remembers the nonce.  Tokens are only
+// good for MaxSkew from the time they were signed, so nonces are
+// forgotten after that.
+func (s *Server) fresh(t *Token, now time.Time) (err error) {
+	defer Return(&err)
+	ErrnoIf(len(t.Nonce) == 0, syscall.EACCES, "token without a nonce")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nonces == nil {
+		s.nonces = make(map[string]time.Time)
+	}
+	for nonce, signed := range s.nonces {
+		if now.Sub(signed) > MaxSkew {
+			delete(s.nonces, nonce)
+		}
+	}
+	key := Spf("%s %x", t.Holder(), t.Nonce)
+	_, replayed := s.nonces[key]
+	ErrnoIf(replayed, syscall.EACCES, "replayed token from %s", t.Holder())
+	s.nonces[key] = t.Time
+	return
+}
+
+// Authorize checks that the token presented with stream allows op on
+// target.  It returns nil if the server doesn't require tokens.
+func (s *Server) Authorize(stream io.ReadWriteCloser, op, target string) error {
+	if s.getAuthorities() == nil {
+		return nil
+	}
+	ts, ok := stream.(*tokenStream)
+	if !ok {
+		return Error{syscall.EACCES, Spf("no token to %s %s", op, target)}
+	}
+	return ts.token.Authorize(op, target)
+}
+
+// tokenStream is a stream together with the verified token from its
+// header.
+type tokenStream struct {
+	wrapper
+	token *Token
+}
@@ -0,0 +1,175 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestCapability(t *testing.T) {
+	root, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	alice, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	bob, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	now := time.Now()
+	hour := now.Add(time.Hour)
+
+	c := root.Grant(alice.Addr, []string{"call", "publish"}, []string{"sha256:ab*", "/news"}, hour)
+	parsed, err := ParseCapability(c.Encode())
+	Tassert(t, err == nil && parsed.Encode() == c.Encode(), "ParseCapability: %v %v", err, parsed)
+	for target, ok := range map[string]bool{"sha256:abcd": true, "sha256:cd": false, "/news/a": true, "/sport": false} {
+		op := "call"
+		if target[0] == '/' {
+			op = "publish"
+		}
+		Tassert(t, c.allows(op, target) == ok, "%s %s", op, target)
+	}
+	Tassert(t, !c.allows("register", "sha256:abcd"), "register allowed")
+
+	// a subscription's pattern must stay within a scope
+	scopes := []struct {
+		scope, pattern string
+		ok             bool
+	}{
+		{"/news", "/news", true},
+		{"/news", "/news/a", true},
+		{"/news", "/news/*", true},
+		{"/news", "/news/a/*/b", true},
+		{"/news", "/*", false},
+		{"/news", "/n*", false},
+		{"/news", "/", false},
+		{"/news", "/newsroom", false},
+		{"/", "/*", true},
+		{"/news/*", "/news/*", true},
+		{"/news/*", "/news/a*", true},
+		{"/news/a*", "/news/a?", false},
+		{"/news/a*", "/news/ab", false},
+		{"/news/*", "/news/a", false},
+		{"/news/*", "/news/*/*", false},
+		{"/news/*", "/*/a", false},
+		{"/*/a", "/news/a", false},
+		{"/*/a", "/news/[a]", false},
+		{"/n*/*", "/news/*", true},
+		{"/news", "news/*", false},
+	}
+	for _, sc := range scopes {
+		c := root.Grant(alice.Addr, []string{"subscribe"}, []string{sc.scope}, hour)
+		Tassert(t, c.allows("subscribe", sc.pattern) == sc.ok, "scope %s pattern %s: want %v", sc.scope, sc.pattern, sc.ok)
+	}
+
+	// alice delegates part of what she holds to bob
+	chain := []*Capability{c, alice.Grant(bob.Addr, []string{"call", "register"}, []string{"*"}, hour)}
+	chain2, err := ParseChain(EncodeChain(chain))
+	Tassert(t, err == nil && len(chain2) == 2, "ParseChain: %v %v", err, chain2)
+	tok, err := ParseToken(NewToken(chain2, bob, "sha256:abcd", now).Encode())
+	Tassert(t, err == nil, "ParseToken: %v", err)
+	err = tok.Verify([]string{root.Addr}, "sha256:abcd", now)
+	Tassert(t, err == nil, "Verify: %v", err)
+	Tassert(t, tok.Authorize("call", "sha256:abcd") == nil, "call")
+	Tassert(t, errors.Is(tok.Authorize("register", "sha256:abcd"), syscall.EACCES), "delegation widened the grant")
+	Tassert(t, errors.Is(tok.Authorize("publish", "/news"), syscall.EACCES), "delegation widened the grant")
+
+	refused := map[string]error{
+		"other authority": tok.Verify([]string{alice.Addr}, "sha256:abcd", now),
+		"other hash":      tok.Verify([]string{root.Addr}, "sha256:ab00", now),
+		"expired":         tok.Verify([]string{root.Addr}, "sha256:abcd", hour.Add(time.Second)),
+		"stale proof":     NewToken(chain, bob, "sha256:abcd", now.Add(-2*MaxSkew)).Verify([]string{root.Addr}, "sha256:abcd", now),
+		"wrong holder":    NewToken(chain, alice, "sha256:abcd", now).Verify([]string{root.Addr}, "sha256:abcd", now),
+		"broken chain":    NewToken([]*Capability{chain[1]}, bob, "sha256:abcd", now).Verify([]string{root.Addr}, "sha256:abcd", now),
+	}
+	forged := *chain[1]
+	forged.Ops = []string{"call", "publish"}
+	refused["forged"] = NewToken([]*Capability{c, &forged}, bob, "sha256:abcd", now).Verify([]string{root.Addr}, "sha256:abcd", now)
+	renonced := *tok
+	renonced.Nonce = make([]byte, len(tok.Nonce))
+	refused["other nonce"] = renonced.Verify([]string{root.Addr}, "sha256:abcd", now)
+	for name, err := range refused {
+		Tassert(t, errors.Is(err, syscall.EACCES), "%s: %v", name, err)
+	}
+	for _, s := range []string{"!", "Y2Fw", NewToken(chain, bob, "x", now).Encode()[:40]} {
+		_, err = ParseToken(s)
+		Tassert(t, err != nil, "ParseToken(%q) succeeded", s)
+	}
+
+	// a server takes each nonce once while the token is good
+	s := &Server{}
+	err = s.fresh(tok, now)
+	Tassert(t, err == nil, "fresh: %v", err)
+	err = s.fresh(tok, now)
+	Tassert(t, errors.Is(err, syscall.EACCES), "replay: %v", err)
+	err = s.fresh(NewToken(chain, bob, "sha256:abcd", now), now)
+	Tassert(t, err == nil, "new nonce: %v", err)
+	err = s.fresh(tok, now.Add(2*MaxSkew))
+	Tassert(t, err == nil, "nonce not forgotten: %v", err)
+}
+
+func TestClientTokens(t *testing.T) {
+	port := 10855
+	root, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	s := &Server{}
+	s.RegisterPubSub()
+	s.RegisterVectors()
+	s.Register("sha256:ab", func(hash []byte, stream io.ReadWriteCloser) error {
+		defer stream.Close()
+		_, err := stream.Write([]byte("ok"))
+		return err
+	})
+	s.RequireTokens(root.Addr)
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	addr := Spf("127.0.0.1:%d", port)
+
+	call := func(c *Client) string {
+		out := &bytes.Buffer{}
+		c.Call("sha256:ab", bytes.NewReader(nil), out)
+		return out.String()
+	}
+	Tassert(t, call(&Client{Addr: addr}) == "", "call without a token")
+
+	id, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	expires := time.Now().Add(time.Hour)
+	c := &Client{Addr: addr, Identity: id, Capabilities: []*Capability{
+		root.Grant(id.Addr, []string{"call", "publish"}, []string{"sha256:a*", "/chat"}, expires)}}
+	Tassert(t, call(c) == "ok", "call with a token")
+
+	// a token can't be replayed
+	header := "sha256:ab " + NewToken(c.Capabilities, id, "sha256:ab", time.Now()).Encode() + "\n"
+	for i, want := range []string{"ok", ""} {
+		conn, err := net.Dial("tcp", addr)
+		Tassert(t, err == nil, "Dial: %v", err)
+		conn.Write([]byte(header))
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		Tassert(t, string(got) == want, "stream %d: '%s'", i, got)
+	}
+
+	_, err = c.Publish("/chat/x", []byte("hi"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	Tassert(t, s.Head("/chat/x") != nil, "not published")
+	_, err = c.Publish("/other", []byte("hi"))
+	Tassert(t, err != nil && s.Head("/other") == nil, "published outside the scope")
+
+	// test vectors are publishes too
+	c = &Client{Addr: addr, Identity: id, Capabilities: []*Capability{
+		root.Grant(id.Addr, []string{"call", "publish"}, []string{VECTOR, "/chat"}, expires)}}
+	_, err = c.AddVector("sha256:ab", []byte("in"), []byte("out"))
+	Tassert(t, err != nil, "AddVector outside the scope")
+	Tassert(t, s.Head(VectorTopic("sha256:ab")) == nil, "vector published outside the scope")
+	c = &Client{Addr: addr, Identity: id, Capabilities: []*Capability{
+		root.Grant(id.Addr, []string{"call", "publish"}, []string{VECTOR, VectorTopic("sha256:ab")}, expires)}}
+	_, err = c.AddVector("sha256:ab", []byte("in"), []byte("out"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+}
@@ -0,0 +1,263 @@
+package pup
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Client talks to a remote pup server or pupd dispatcher.
+type Client struct {
+	// Addr is the "host:port" of the server.
+	Addr string
+	// Name identifies the client in registrations.
+	Name string
+	// Identity, if set, signs the client's registrations and
+	// published messages.  Its address replaces Name.  pupd only
+	// accepts signed registrations for a hash with test vectors,
+	// and tests each identity against the vectors once.
+	Identity *Identity
+	// Capabilities, if set, is a delegation chain granted to
+	// Identity.  The client presents it as a Token on every stream,
+	// for servers that RequireTokens.
+	Capabilities []*Capability
+	// CoSigs holds, by hash, the co-signatures that let Identity
+	// register hashes another participant owns; see CoSign.
+	CoSigs map[string][]byte
+}
+
+// Open dials the server and sends hash as the leading line of a new
+// stream, followed by a Token if the client has Capabilities.  The
+// caller writes the rest of the stream and reads the reply from the
+// returned connection.  If the server sends an error reply instead,
+// reading fails with the Error; see WriteError.
+func (c *Client) Open(hash string) (conn net.Conn, err error) {
+	defer Return(&err)
+	header := hash
+	if len(c.Capabilities) > 0 {
+		ErrnoIf(c.Identity == nil, syscall.EINVAL, "capabilities without an identity")
+		header += " " + NewToken(c.Capabilities, c.Identity, hash, time.Now()).Encode()
+	}
+	raw, err := net.Dial("tcp", c.Addr)
+	Ck(err)
+	_, err = raw.Write([]byte(header + "\n"))
+	if err != nil {
+		raw.Close()
+		Ck(err)
+	}
+	return &replyConn{Conn: raw}, nil
+}
+
+// REGISTER is the hash of the pupd registrar.  A peer registers a
+// lambda by sending a RegisterRequest on a REGISTER stream; pupd then
+// routes the next stream for the hash to the peer over the same
+// connection.
+const REGISTER = "sha256:c17dcddbc7b307ab652109d2c1a01fdd53890dffcbce3215da41d8104e551b0b"
+
+// RegisterRequest is the line a peer sends on a REGISTER stream:
+// "a <hash> [<name> [<time> <sig> [<cosig>]]]".  In a signed request,
+// Name is the participant address of the peer, Time is when it
+// signed, in Unix nanoseconds, and Sig is its signature of the line
+// up to the time.  The time lets a server refuse old requests, so
+// that a captured one can't be replayed for long; its precision keeps
+// a peer's requests in quick succession from looking like replays.
+// CoSig, if present, is the hash owner's consent to the peer
+// registering it; see CoSign.
+type RegisterRequest struct {
+	Hash  string
+	Name  string
+	Time  time.Time
+	Sig   []byte
+	CoSig []byte
+}
+
+// NewRegisterRequest returns a request for hash signed by id.
+func NewRegisterRequest(hash string, id *Identity, now time.Time) *RegisterRequest {
+	r := &RegisterRequest{Hash: hash, Name: id.Addr, Time: time.Unix(0, now.UnixNano())}
+	r.Sig = id.Sign(r.signed())
+	return r
+}
+
+func (r *RegisterRequest) signed() []byte {
+	return []byte(Spf("a %s %s %d", r.Hash, r.Name, r.Time.UnixNano()))
+}
+
+// Encode returns the request line, without the newline.
+func (r *RegisterRequest) Encode() string {
+	if len(r.CoSig) > 0 {
+		return Spf("%s %x %x", r.signed(), r.Sig, r.CoSig)
+	}
+	if len(r.Sig) > 0 {
+		return Spf("%s %x", r.signed(), r.Sig)
+	}
+	if r.Name != "" {
+		return "a " + r.Hash + " " + r.Name
+	}
+	return "a " + r.Hash
+}
+
+// ParseRegisterRequest parses a request line.  It doesn't check the
+// signature; see Verify.
+func ParseRegisterRequest(line string) (r *RegisterRequest, err error) {
+	defer Return(&err)
+	parts := strings.Split(line, " ")
+	n := len(parts)
+	ErrnoIf(parts[0] != "a" || n < 2 || n == 4 || n > 6, syscall.EINVAL,
+		"want 'a <hash> [<name> [<time> <sig> [<cosig>]]]', got %q", line)
+	r = &RegisterRequest{Hash: parts[1]}
+	if n > 2 {
+		r.Name = parts[2]
+	}
+	if n >= 5 {
+		nsecs, err := strconv.ParseInt(parts[3], 10, 64)
+		Ck(err)
+		r.Time = time.Unix(0, nsecs)
+		r.Sig, err = hex.DecodeString(parts[4])
+		Ck(err)
+	}
+	if n == 6 {
+		r.CoSig, err = hex.DecodeString(parts[5])
+		Ck(err)
+	}
+	return
+}
+
+// Verify checks that the request is signed by the participant it
+// names.  An unsigned request fails with EACCES.
+func (r *RegisterRequest) Verify() error {
+	if len(r.Sig) == 0 {
+		return Error{syscall.EACCES, "unsigned registration for " + r.Hash}
+	}
+	return Verify(r.Name, r.signed(), r.Sig)
+}
+
+// CoSign returns owner's consent to the participant peer registering
+// hash, for the CoSig of peer's requests.  Unlike Sig, it doesn't
+// expire: the consent lasts until the owner changes.
+func CoSign(owner *Identity, hash, peer string) []byte {
+	return owner.Sign(coSigned(hash, peer))
+}
+
+func coSigned(hash, peer string) []byte {
+	return []byte(Spf("cosign %s %s", hash, peer))
+}
+
+// VerifyCoSig checks that owner co-signed the request.  A request
+// without a co-signature fails with EACCES.
+func (r *RegisterRequest) VerifyCoSig(owner string) error {
+	if len(r.CoSig) == 0 {
+		return Error{syscall.EACCES, Spf("registration for %s not co-signed by %s", r.Hash, owner)}
+	}
+	return Verify(owner, coSigned(r.Hash, r.Name), r.CoSig)
+}
+
+// Register asks a pupd dispatcher to route the next stream for hash
+// to the returned connection.  Reading from the connection blocks
+// until a caller arrives; the peer then reads the caller's input,
+// which ends when the caller is done sending, writes its reply, and
+// closes the connection.  Register again to serve another call.
+func (c *Client) Register(hash string) (conn net.Conn, err error) {
+	defer Return(&err)
+	req := &RegisterRequest{Hash: hash, Name: c.Name}
+	if c.Identity != nil {
+		req = NewRegisterRequest(hash, c.Identity, time.Now())
+		req.CoSig = c.CoSigs[hash]
+	}
+	conn, err = c.Open(REGISTER)
+	Ck(err)
+	_, err = conn.Write([]byte(req.Encode() + "\n"))
+	if err != nil {
+		conn.Close()
+		Ck(err)
+	}
+	return
+}
+
+// Publish publishes body on topic and returns the address of the new
+// message.  The message is signed if the client has an Identity.
+func (c *Client) Publish(topic string, body []byte) (addr string, err error) {
+	defer Return(&err)
+	conn, err := c.Open(PUBLISH)
+	Ck(err)
+	defer conn.Close()
+	req := Spf("%s %d", topic, len(body))
+	if c.Identity != nil {
+		sig := c.Identity.Sign(SignedBytes(topic, c.Identity.Addr, body))
+		req += Spf(" %s %x", c.Identity.Addr, sig)
+	}
+	_, err = conn.Write([]byte(req + "\n"))
+	Ck(err)
+	_, err = conn.Write(body)
+	Ck(err)
+	line, err := Readline(conn, 1024)
+	Ck(err)
+	addr = strings.TrimSpace(string(line))
+	return
+}
+
+// Subscribe subscribes to the topics matching pattern on the server.
+// Closing the subscription closes the connection.
+func (c *Client) Subscribe(pattern string) (sub *Subscription, err error) {
+	return c.subscribe("", pattern, Since{})
+}
+
+// SubscribeFrom is like Subscribe, but first replays the history
+// selected by since.  See Server.SubscribeFrom.
+func (c *Client) SubscribeFrom(pattern string, since Since) (sub *Subscription, err error) {
+	return c.subscribe("", pattern, since)
+}
+
+// SubscribeDurable opens a durable subscription under name.  Calling
+// Ack on the subscription sends the acknowledgement to the server.
+// See Server.SubscribeDurable.
+func (c *Client) SubscribeDurable(name, pattern string, since Since) (sub *Subscription, err error) {
+	return c.subscribe(name, pattern, since)
+}
+
+func (c *Client) subscribe(name, pattern string, since Since) (sub *Subscription, err error) {
+	defer Return(&err)
+	conn, err := c.Open(SUBSCRIBE)
+	Ck(err)
+	_, err = conn.Write([]byte(subscribeLine(name, pattern, since) + "\n"))
+	if err != nil {
+		conn.Close()
+		Ck(err)
+	}
+	sub = readSubscription(pattern, conn)
+	if name != "" {
+		var mu sync.Mutex
+		sub.ack = func(msg *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, err := conn.Write([]byte(Spf("ack %s\n", msg.Addr())))
+			return err
+		}
+	}
+	return
+}
+
+// readSubscription returns a subscription fed by the encoded messages
+// arriving on stream.
+func readSubscription(pattern string, stream io.ReadCloser) (sub *Subscription) {
+	sub = newSubscription(pattern, func(*Subscription) {
+		stream.Close()
+	})
+	go func() {
+		defer sub.end()
+		for {
+			msg, err := ReadMessage(stream)
+			if err != nil {
+				return
+			}
+			sub.deliver(msg)
+		}
+	}()
+	return
+}
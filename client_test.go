@@ -0,0 +1,33 @@
+package pup
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestClientPubSub(t *testing.T) {
+	port := 10844
+	s := &Server{}
+	s.RegisterPubSub()
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(1 * time.Second)
+
+	c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+	sub, err := c.Subscribe("/news")
+	Tassert(t, err == nil, "Subscribe: %v", err)
+	defer sub.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	addr, err := c.Publish("/news/today", []byte("hello\n"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	Tassert(t, addr == s.Head("/news/today").Addr(), "addr %v", addr)
+
+	msg := recv(t, sub)
+	Tassert(t, msg.Addr() == addr, "got %v", msg)
+	Tassert(t, string(msg.Body) == "hello\n", "body '%v'", string(msg.Body))
+}
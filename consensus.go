@@ -0,0 +1,214 @@
+package pup
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Implementation is one of several lambdas that claim to compute the
+// same function hash.
+type Implementation struct {
+	// Name identifies the implementation in an Outcome, e.g. the
+	// address of the peer that registered it.
+	Name   string
+	Lambda Lambda
+}
+
+// TieBreak decides a consensus call when the most common outputs
+// drew the same number of votes.
+type TieBreak int
+
+const (
+	// TieFail fails the call with EPROTO.
+	TieFail TieBreak = iota
+	// TieFirst picks the output of the earliest implementation in
+	// the list.
+	TieFirst
+	// TieLowest picks the output with the lowest content address,
+	// so that every node breaks the tie the same way.
+	TieLowest
+)
+
+var tieBreakNames = []string{"fail", "first", "lowest"}
+
+func (t TieBreak) String() string {
+	if t < 0 || int(t) >= len(tieBreakNames) {
+		return Spf("TieBreak(%d)", int(t))
+	}
+	return tieBreakNames[t]
+}
+
+// ParseTieBreak returns the TieBreak named s: "fail", "first" or
+// "lowest".
+func ParseTieBreak(s string) (t TieBreak, err error) {
+	for i, name := range tieBreakNames {
+		if s == name {
+			return TieBreak(i), nil
+		}
+	}
+	return 0, Error{syscall.EINVAL, Spf("unknown tie break %q", s)}
+}
+
+// Policy configures consensus for one function hash.
+type Policy struct {
+	// Quorum is the number of implementations each call runs on.
+	// Zero means all of them.
+	Quorum   int
+	TieBreak TieBreak
+}
+
+// Vote is one implementation's answer in a consensus call: the
+// content address of its output, or the error it returned.
+type Vote struct {
+	Impl string
+	Addr string
+	Err  error
+}
+
+// Outcome records a consensus call.  Result is the address of the
+// output returned to the caller, or empty if the call failed.
+type Outcome struct {
+	Hash   string
+	Input  string
+	Result string
+	Votes  []Vote
+}
+
+// Dissenters returns the votes that disagree with the result,
+// including the implementations that failed.
+func (o *Outcome) Dissenters() (votes []Vote) {
+	for _, v := range o.Votes {
+		if v.Err != nil || v.Addr != o.Result {
+			votes = append(votes, v)
+		}
+	}
+	return
+}
+
+// Encode returns o as "key value" lines: hash, input and result,
+// followed by one "vote <addr> <impl>" line per implementation.  A
+// failed implementation votes "error", and a failed call's result is
+// "none".
+func (o *Outcome) Encode() []byte {
+	var b strings.Builder
+	result := o.Result
+	if result == "" {
+		result = "none"
+	}
+	b.WriteString(Spf("hash %s\ninput %s\nresult %s\n", o.Hash, o.Input, result))
+	for _, v := range o.Votes {
+		addr := v.Addr
+		if v.Err != nil {
+			addr = "error"
+		}
+		b.WriteString(Spf("vote %s %s\n", addr, v.Impl))
+	}
+	return []byte(b.String())
+}
+
+// Decide runs input through every one of impls at once and returns
+// the output that most of them agree on, comparing outputs by content
+// address.  tie settles a draw.  The outcome records every vote,
+// whether or not the call succeeds; failed implementations don't
+// count towards any output.  An implementation that panics fails with
+// the error the server would reply with; see Panics.  If they all
+// fail, Decide returns the first implementation's error.
+func Decide(hash string, impls []Implementation, input []byte, tie TieBreak) (output []byte, outcome *Outcome, err error) {
+	outcome = &Outcome{Hash: hash, Input: Address(input), Votes: make([]Vote, len(impls))}
+	outputs := make([][]byte, len(impls))
+	var wg sync.WaitGroup
+	for i, impl := range impls {
+		wg.Add(1)
+		go func(i int, impl Implementation) {
+			defer wg.Done()
+			stream := &bufStream{Reader: bytes.NewReader(input)}
+			err := func() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = panicError(r)
+					}
+				}()
+				return impl.Lambda([]byte(hash), stream)
+			}()
+			outcome.Votes[i] = Vote{Impl: impl.Name, Addr: Address(stream.out.Bytes()), Err: err}
+			outputs[i] = stream.out.Bytes()
+		}(i, impl)
+	}
+	wg.Wait()
+
+	// count votes, remembering which implementation first gave each
+	// output
+	count := make(map[string]int)
+	first := make(map[string]int)
+	for i, v := range outcome.Votes {
+		if v.Err != nil {
+			continue
+		}
+		if _, ok := first[v.Addr]; !ok {
+			first[v.Addr] = i
+		}
+		count[v.Addr]++
+	}
+	if len(count) == 0 {
+		if len(impls) == 0 {
+			return nil, outcome, Error{syscall.ENOSYS, hash}
+		}
+		return nil, outcome, outcome.Votes[0].Err
+	}
+	var leaders []string
+	most := 0
+	for addr, n := range count {
+		switch {
+		case n > most:
+			leaders = []string{addr}
+			most = n
+		case n == most:
+			leaders = append(leaders, addr)
+		}
+	}
+	if len(leaders) > 1 {
+		switch tie {
+		case TieFirst:
+			sort.Slice(leaders, func(i, j int) bool { return first[leaders[i]] < first[leaders[j]] })
+		case TieLowest:
+			sort.Strings(leaders)
+		default:
+			return nil, outcome, Error{syscall.EPROTO, Spf("no consensus on %s: %d outputs drew %d votes each", hash, len(leaders), most)}
+		}
+	}
+	outcome.Result = leaders[0]
+	return outputs[first[outcome.Result]], outcome, nil
+}
+
+// Consensus returns a lambda that reads the whole stream, runs it
+// through the first policy.Quorum of impls with Decide, and writes the
+// agreed output back.  report, if not nil, receives the outcome of
+// every call.  A call fails with EAGAIN if there are fewer than
+// Quorum implementations.
+func Consensus(impls []Implementation, policy Policy, report func(*Outcome)) Lambda {
+	return func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		defer Return(&err)
+		quorum := policy.Quorum
+		if quorum == 0 {
+			quorum = len(impls)
+		}
+		ErrnoIf(len(impls) < quorum, syscall.EAGAIN, "%s: quorum is %d, have %d implementations",
+			hash, quorum, len(impls))
+		input, err := io.ReadAll(stream)
+		Ck(err)
+		output, outcome, err := Decide(string(hash), impls[:quorum], input, policy.TieBreak)
+		if report != nil {
+			report(outcome)
+		}
+		Ck(err)
+		_, err = stream.Write(output)
+		Ck(err)
+		return
+	}
+}
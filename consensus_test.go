@@ -0,0 +1,117 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// constLambda ignores its input and replies with out.
+func constLambda(out string) Lambda {
+	return func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := io.ReadAll(stream)
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write([]byte(out))
+		return err
+	}
+}
+
+func failLambda(hash []byte, stream io.ReadWriteCloser) error {
+	return Error{syscall.EIO, "broken"}
+}
+
+func impls(outs ...string) (res []Implementation) {
+	for i, out := range outs {
+		impl := Implementation{Name: Spf("impl%d", i), Lambda: constLambda(out)}
+		if out == "" {
+			impl.Lambda = failLambda
+		}
+		res = append(res, impl)
+	}
+	return
+}
+
+func TestDecide(t *testing.T) {
+	out, outcome, err := Decide("sha256:00", impls("a", "b", "a", ""), []byte("in"), TieFail)
+	Tassert(t, err == nil, "Decide: %v", err)
+	Tassert(t, string(out) == "a", "got '%s'", out)
+	Tassert(t, outcome.Result == Address([]byte("a")) && outcome.Input == Address([]byte("in")), "outcome %v", outcome)
+	dissent := outcome.Dissenters()
+	Tassert(t, len(dissent) == 2 && dissent[0].Impl == "impl1" && dissent[1].Impl == "impl3", "dissenters %v", dissent)
+	Tassert(t, errors.Is(dissent[1].Err, syscall.EIO), "failed vote %v", dissent[1])
+	want := Spf("hash sha256:00\ninput %s\nresult %s\nvote %s impl0\nvote %s impl1\nvote %s impl2\nvote error impl3\n",
+		Address([]byte("in")), Address([]byte("a")), Address([]byte("a")), Address([]byte("b")), Address([]byte("a")))
+	Tassert(t, string(outcome.Encode()) == want, "encoded\n%s", outcome.Encode())
+
+	// ties
+	_, outcome, err = Decide("sha256:00", impls("x", "y"), nil, TieFail)
+	Tassert(t, errors.Is(err, syscall.EPROTO) && outcome.Result == "", "tie: %v", err)
+	Tassert(t, strings.Contains(string(outcome.Encode()), "result none\n"), "encoded\n%s", outcome.Encode())
+	lowest := "x"
+	if Address([]byte("y")) < Address([]byte("x")) {
+		lowest = "y"
+	}
+	for _, first := range []string{"x", "y"} {
+		other := map[string]string{"x": "y", "y": "x"}[first]
+		out, _, err = Decide("sha256:00", impls(first, other), nil, TieFirst)
+		Tassert(t, err == nil && string(out) == first, "first: %v '%s'", err, out)
+		out, _, err = Decide("sha256:00", impls(first, other), nil, TieLowest)
+		Tassert(t, err == nil && string(out) == lowest, "lowest: %v '%s'", err, out)
+	}
+
+	// everyone fails
+	_, _, err = Decide("sha256:00", impls("", ""), nil, TieFirst)
+	Tassert(t, errors.Is(err, syscall.EIO), "all failed: %v", err)
+
+	// a panic is a failed vote
+	panicky := append(impls("a", "a"), Implementation{Name: "panicky", Lambda: func(hash []byte, stream io.ReadWriteCloser) error {
+		panic("oops")
+	}})
+	out, outcome, err = Decide("sha256:00", panicky, nil, TieFail)
+	Tassert(t, err == nil && string(out) == "a", "Decide: %v '%s'", err, out)
+	vote := outcome.Votes[2]
+	Tassert(t, errors.Is(vote.Err, syscall.EIO) && strings.Contains(vote.Err.Error(), "oops"), "panic vote %v", vote)
+}
+
+func TestConsensus(t *testing.T) {
+	var outcomes []*Outcome
+	report := func(o *Outcome) { outcomes = append(outcomes, o) }
+	echo := func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := io.Copy(stream, stream)
+		return err
+	}
+	all := []Implementation{{"one", echo}, {"two", echo}, {"three", constLambda("wrong")}}
+
+	// the quorum leaves out the third implementation
+	lambda := Consensus(all, Policy{Quorum: 2}, report)
+	stream := &bufStream{Reader: strings.NewReader("hello")}
+	err := lambda([]byte("sha256:00"), stream)
+	Tassert(t, err == nil, "lambda: %v", err)
+	Tassert(t, stream.out.String() == "hello", "got '%s'", stream.out.String())
+	Tassert(t, len(outcomes) == 1 && len(outcomes[0].Votes) == 2 && len(outcomes[0].Dissenters()) == 0, "outcomes %v", outcomes)
+
+	lambda = Consensus(all, Policy{}, report)
+	stream = &bufStream{Reader: strings.NewReader("hello")}
+	err = lambda([]byte("sha256:00"), stream)
+	Tassert(t, err == nil && stream.out.String() == "hello", "lambda: %v '%s'", err, stream.out.String())
+	dissent := outcomes[1].Dissenters()
+	Tassert(t, len(dissent) == 1 && dissent[0].Impl == "three", "dissenters %v", dissent)
+
+	lambda = Consensus(all, Policy{Quorum: 4}, report)
+	err = lambda([]byte("sha256:00"), &bufStream{Reader: &bytes.Buffer{}})
+	Tassert(t, errors.Is(err, syscall.EAGAIN), "short quorum: %v", err)
+
+	for _, name := range []string{"fail", "first", "lowest"} {
+		tie, err := ParseTieBreak(name)
+		Tassert(t, err == nil && tie.String() == name, "ParseTieBreak(%q): %v %v", name, tie, err)
+	}
+	_, err = ParseTieBreak("coin")
+	Tassert(t, errors.Is(err, syscall.EINVAL), "ParseTieBreak: %v", err)
+}
@@ -0,0 +1,138 @@
+package pup
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// timeouts are the idle timeout and maximum duration for one hash.
+type timeouts struct {
+	idle, max time.Duration
+}
+
+// SetTimeouts overrides IdleTimeout and MaxDuration for the streams of
+// hash.  Zero means no limit, so a hash whose streams are meant to
+// wait, such as SUBSCRIBE, can be exempted.
+func (s *Server) SetTimeouts(hash string, idle, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timeoutmap == nil {
+		s.timeoutmap = make(map[string]timeouts)
+	}
+	s.timeoutmap[hash] = timeouts{idle, max}
+}
+
+func (s *Server) timeouts(hash string) (idle, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.timeoutmap[hash]
+	if !ok {
+		return s.IdleTimeout, s.MaxDuration
+	}
+	return t.idle, t.max
+}
+
+// context returns the context that every stream's context derives
+// from.  Shutdown cancels it.
+func (s *Server) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.shutdown = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// Shutdown stops Serve accepting connections and ends every open
+// stream, cancelling the contexts of their lambdas, then waits for
+// the lambdas to return.  A server that has been shut down can't
+// serve again.
+func (s *Server) Shutdown() {
+	s.context()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for s.streams > 0 {
+		s.idle.Wait()
+	}
+}
+
+// enter counts a stream in, and leave out, for Shutdown to wait on.
+func (s *Server) enter() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle == nil {
+		s.idle = sync.NewCond(&s.mu)
+	}
+	s.streams++
+}
+
+func (s *Server) leave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams--
+	s.idle.Broadcast()
+}
+
+// listen records l for Shutdown to close.  It returns false if the
+// server is already shut down.
+func (s *Server) listen(l net.Listener) bool {
+	ctx := s.context()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+	}
+	s.listeners[l] = true
+	return true
+}
+
+// watch cuts m off when the stream runs past its idle timeout or
+// maximum duration.  It returns a function that stops watching.
+func (s *Server) watch(m *serverStream, idle, max time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var timers []*time.Timer
+	if max > 0 {
+		timers = append(timers, time.AfterFunc(max, func() {
+			m.cut(Error{syscall.ETIMEDOUT, Spf("stream ran past %v", max)})
+		}))
+	}
+	if idle > 0 {
+		var check func()
+		check = func() {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			since := m.idle()
+			if since >= idle {
+				m.cut(Error{syscall.ETIMEDOUT, Spf("stream idle for %v", since.Round(time.Millisecond))})
+				return
+			}
+			time.AfterFunc(idle-since, check)
+		}
+		time.AfterFunc(idle, check)
+	}
+	return func() {
+		close(done)
+		for _, t := range timers {
+			t.Stop()
+		}
+		// a timer that already fired mustn't reply after the stream
+		m.mu.Lock()
+		m.replied = true
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,106 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestTimeouts(t *testing.T) {
+	s := &Server{HeaderTimeout: 100 * time.Millisecond, IdleTimeout: 100 * time.Millisecond, MaxDuration: 300 * time.Millisecond}
+	// wait returns when the stream's context is done
+	wait := func(hash []byte, stream io.ReadWriteCloser) error {
+		<-ContextOf(stream).Done()
+		return nil
+	}
+	s.Register("sha256:aa", wait)
+	s.Register("sha256:bb", wait)
+	s.SetTimeouts("sha256:bb", 0, 0)
+	s.Register("sha256:cc", func(hash []byte, stream io.ReadWriteCloser) error {
+		ctx := ContextOf(stream)
+		for ctx.Err() == nil {
+			stream.Write([]byte("."))
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil
+	})
+	s.Register("sha256:dd", func(hash []byte, stream io.ReadWriteCloser) error {
+		time.Sleep(200 * time.Millisecond)
+		_, err := stream.Write([]byte("slow"))
+		return err
+	})
+	s.SetTimeouts("sha256:dd", 0, time.Second)
+
+	// call sends header, if any, and returns the reply and how long
+	// the server took with the stream
+	call := func(header string) (reply string, readErr, err error, took time.Duration) {
+		client, server := net.Pipe()
+		done := make(chan error)
+		start := time.Now()
+		go func() {
+			err := s.handleStream(server)
+			server.Close()
+			done <- err
+		}()
+		if header != "" {
+			client.Write([]byte(header + "\n"))
+		}
+		buf, readErr := io.ReadAll(&replyConn{Conn: client})
+		err = <-done
+		return string(buf), readErr, err, time.Since(start)
+	}
+
+	_, readErr, err, took := call("")
+	Tassert(t, errors.Is(err, syscall.ETIMEDOUT) && errors.Is(readErr, syscall.ETIMEDOUT), "no header: %v %v", err, readErr)
+	Tassert(t, took < time.Second, "took %v", took)
+	_, readErr, err, took = call("sha256:aa")
+	Tassert(t, errors.Is(err, syscall.ETIMEDOUT) && errors.Is(readErr, syscall.ETIMEDOUT), "idle: %v %v", err, readErr)
+	Tassert(t, took < 250*time.Millisecond, "idle took %v", took)
+
+	// a busy stream is still cut off at MaxDuration, after its reply
+	// has started
+	reply, readErr, err, took := call("sha256:cc")
+	Tassert(t, errors.Is(err, syscall.ETIMEDOUT) && readErr == nil && len(reply) > 5, "max: %v %v '%s'", err, readErr, reply)
+	Tassert(t, took >= 300*time.Millisecond && took < time.Second, "max took %v", took)
+
+	// SetTimeouts overrides the server's
+	reply, readErr, err, _ = call("sha256:dd")
+	Tassert(t, err == nil && readErr == nil && reply == "slow", "override: %v %v '%s'", err, readErr, reply)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		s.Shutdown()
+	}()
+	_, readErr, err, took = call("sha256:bb")
+	Tassert(t, errors.Is(err, syscall.ESHUTDOWN) && errors.Is(readErr, syscall.ESHUTDOWN), "exempt: %v %v", err, readErr)
+	Tassert(t, took >= 500*time.Millisecond, "exempt took %v", took)
+}
+
+func TestShutdown(t *testing.T) {
+	port := 10859
+	s := &Server{}
+	s.Register("sha256:aa", ExecLambda(Command{Path: "/bin/sleep", Args: []string{"10"}}))
+	served := make(chan error)
+	go func() {
+		served <- s.Serve("127.0.0.1", port)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	called := make(chan error)
+	go func() {
+		c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+		called <- c.Call("sha256:aa", bytes.NewReader(nil), io.Discard)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	s.Shutdown()
+	Tassert(t, time.Since(start) < 2*time.Second, "Shutdown took %v", time.Since(start))
+	Tassert(t, <-served == nil, "Serve didn't return")
+	err := <-called
+	Tassert(t, errors.Is(err, syscall.ESHUTDOWN), "Call: %v", err)
+}
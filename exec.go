@@ -0,0 +1,180 @@
+package pup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Command describes an executable that handles streams.
+type Command struct {
+	// Path is the program to run; it is looked up in $PATH if it
+	// contains no slash.
+	Path string
+	Args []string
+	// Dir is the working directory; empty means pupd's.
+	Dir string
+	// Env is the environment of the process.  pupd's own
+	// environment is not inherited.  PUP_HASH is always set to the
+	// lambda's hash.
+	Env []string
+	// Timeout caps the run time of each invocation.  Zero means 10
+	// seconds.
+	Timeout time.Duration
+}
+
+// execDrain is how long ExecLambda waits for more of a process's
+// stdout and stderr once it has exited.
+const execDrain = 100 * time.Millisecond
+
+// ExecLambda returns a lambda that starts cmd once per stream.  The
+// rest of the stream is piped to the process's stdin and its stdout
+// is written back to the stream.  The lambda returns when the process
+// exits, whether or not the caller has finished sending, and whether
+// or not children it left behind still hold its stdout; nothing more
+// is read from the stream after that, and stdout is copied only until
+// it has nothing to read for execDrain.
+//
+// A process that exits with a nonzero status returns EIO, with the
+// status and the last line the process wrote to stderr in the
+// message.  A process killed at cmd.Timeout returns ETIMEDOUT, and one
+// killed by any other signal returns EINTR.  The process is also
+// killed when the stream's context is done; see ContextOf.
+func ExecLambda(cmd Command) Lambda {
+	if cmd.Timeout == 0 {
+		cmd.Timeout = 10 * time.Second
+	}
+	return func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		defer Return(&err)
+		ctx, cancel := context.WithTimeout(ContextOf(stream), cmd.Timeout)
+		defer cancel()
+		c := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
+		c.Dir = cmd.Dir
+		c.Env = append(append([]string{}, cmd.Env...), "PUP_HASH="+string(hash))
+		// manage the pipes ourselves: exec would otherwise wait
+		// for the caller to close its side of the stream, and for
+		// any children the process left holding its stdout
+		stdin, err := c.StdinPipe()
+		Ck(err)
+		stdout, stdoutW, err := os.Pipe()
+		Ck(err)
+		defer stdout.Close()
+		stderrPipe, stderrW, err := os.Pipe()
+		Ck(err)
+		defer stderrPipe.Close()
+		c.Stdout, c.Stderr = stdoutW, stderrW
+		err = c.Start()
+		stdoutW.Close()
+		stderrW.Close()
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return Error{syscall.ENOENT, err.Error()}
+		}
+		if err != nil {
+			return Error{syscall.ENOEXEC, err.Error()}
+		}
+		exited := make(chan struct{})
+		go func() {
+			defer stdin.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stream.Read(buf)
+				select {
+				case <-exited:
+					return
+				default:
+				}
+				if n > 0 {
+					_, werr := stdin.Write(buf[:n])
+					if werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		var stderr bytes.Buffer
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			drain(stream, stdout, exited)
+		}()
+		go func() {
+			defer wg.Done()
+			drain(&stderr, stderrPipe, exited)
+		}()
+		// the process's stdout and stderr are files, so Wait
+		// returns when the process exits, even if children still
+		// hold the pipes
+		err = c.Wait()
+		close(exited)
+		stdout.SetReadDeadline(time.Now().Add(execDrain))
+		stderrPipe.SetReadDeadline(time.Now().Add(execDrain))
+		wg.Wait()
+		// stop feeding the process.  A read that is waiting on the
+		// caller ends now if the stream has read deadlines, and
+		// otherwise when the stream is closed.
+		if d, ok := stream.(interface{ SetReadDeadline(time.Time) error }); ok {
+			d.SetReadDeadline(time.Now())
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return Error{syscall.ETIMEDOUT, Spf("%s timed out", cmd.Path)}
+		}
+		return execError(cmd.Path, err, stderr.String())
+	}
+}
+
+// drain copies r to w until r ends or w fails.  Once exited is closed,
+// it also stops when r has had nothing to read for execDrain.
+func drain(w io.Writer, r *os.File, exited chan struct{}) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-exited:
+			r.SetReadDeadline(time.Now().Add(execDrain))
+		default:
+		}
+	}
+}
+
+// execError turns the error from running path into a pup.Error.
+func execError(path string, err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return Error{syscall.EIO, err.Error()}
+	}
+	msg := Spf("%s: %s", path, exit.Error())
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if last := lines[len(lines)-1]; last != "" {
+		msg = Spf("%s: %s", msg, last)
+	}
+	if exit.ExitCode() < 0 {
+		return Error{syscall.EINTR, msg}
+	}
+	return Error{syscall.EIO, msg}
+}
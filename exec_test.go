@@ -0,0 +1,90 @@
+package pup
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func sh(script string) Command {
+	return Command{Path: "/bin/sh", Args: []string{"-c", script}}
+}
+
+func TestExecLambda(t *testing.T) {
+	s := &Server{}
+	s.Register("upper", ExecLambda(sh("tr a-z A-Z")))
+	stream := &bufStream{Reader: strings.NewReader("upper\nhello\n")}
+	err := s.handleStream(stream)
+	Tassert(t, err == nil, "handleStream: %v", err)
+	Tassert(t, stream.out.String() == "HELLO\n", "got '%s'", stream.out.String())
+
+	// the hash is in the environment
+	lambda := ExecLambda(sh(`echo "$PUP_HASH" "$@"`))
+	stream = &bufStream{Reader: strings.NewReader("")}
+	err = lambda([]byte("myhash"), stream)
+	Tassert(t, err == nil, "lambda: %v", err)
+	Tassert(t, stream.out.String() == "myhash\n", "got '%s'", stream.out.String())
+
+	// pupd's environment isn't inherited
+	cmd := sh(`echo "[$FOO]"`)
+	stream = &bufStream{Reader: strings.NewReader("")}
+	err = ExecLambda(cmd)(nil, stream)
+	Tassert(t, err == nil && stream.out.String() == "[]\n", "got '%s' %v", stream.out.String(), err)
+	cmd.Env = []string{"FOO=bar"}
+	stream = &bufStream{Reader: strings.NewReader("")}
+	err = ExecLambda(cmd)(nil, stream)
+	Tassert(t, err == nil && stream.out.String() == "[bar]\n", "got '%s' %v", stream.out.String(), err)
+}
+
+func TestExecErrors(t *testing.T) {
+	run := func(cmd Command) error {
+		return ExecLambda(cmd)(nil, &bufStream{Reader: strings.NewReader("")})
+	}
+
+	err := run(sh("echo oops >&2; exit 1"))
+	Tassert(t, errors.Is(err, syscall.EIO), "err %v", err)
+	Tassert(t, strings.Contains(err.Error(), "exit status 1") && strings.HasSuffix(err.Error(), "oops"), "err %v", err)
+
+	cmd := sh("sleep 10")
+	cmd.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	err = run(cmd)
+	Tassert(t, errors.Is(err, syscall.ETIMEDOUT), "err %v", err)
+	Tassert(t, time.Since(start) < 5*time.Second, "took %v", time.Since(start))
+
+	err = run(sh("kill -9 $$"))
+	Tassert(t, errors.Is(err, syscall.EINTR), "err %v", err)
+
+	err = run(Command{Path: "/nonexistent/handler"})
+	Tassert(t, errors.Is(err, syscall.ENOENT), "err %v", err)
+}
+
+func TestExecStdin(t *testing.T) {
+	// the process exits without reading its input
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	err := ExecLambda(sh("true"))(nil, server)
+	Tassert(t, err == nil, "lambda: %v", err)
+
+	// nothing reads the stream after the lambda has returned
+	client.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = client.Write([]byte("late"))
+	Tassert(t, errors.Is(err, os.ErrDeadlineExceeded), "late write: %v", err)
+}
+
+func TestExecChildren(t *testing.T) {
+	// a child left holding stdout doesn't keep the lambda waiting
+	stream := &bufStream{Reader: strings.NewReader("")}
+	start := time.Now()
+	err := ExecLambda(sh("sleep 3 & echo hi"))(nil, stream)
+	Tassert(t, err == nil, "lambda: %v", err)
+	Tassert(t, time.Since(start) < time.Second, "lambda took %v", time.Since(start))
+	Tassert(t, stream.out.String() == "hi\n", "got '%s'", stream.out.String())
+}
@@ -0,0 +1,411 @@
+package pup
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// GridFS presents a server's topics and chunk cache as an io/fs
+// filesystem.  Topics are directories, messages are files, and every
+// message address names a snapshot of its topic's history:
+//
+//	a/b/                           topic /a/b, and parent of /a/b/...
+//	a/b/00000001-sha256:<hex>      body of message 1 on /a/b
+//	a/b/.versions/                 one directory per message on /a/b
+//	a/b/.versions/sha256:<hex>/    /a/b as of that message
+//	.chunks/sha256:<hex>           raw content of a chunk in the cache
+//	.lambdas/<hash>                special file bound to a lambda
+//
+// GridFS is read-only through the fs.FS interface, apart from the
+// special files: reading one runs its lambda and returns the output.
+// OpenFile and Append publish new messages, and OpenFile also opens
+// special files for writing the lambda's input.
+//
+// GridFS has no tokens to check, so it doesn't enforce RequireTokens,
+// nor the server's limits and timeouts.  Don't serve it to callers the
+// server wouldn't trust with everything.
+type GridFS struct {
+	server *Server
+}
+
+// FS returns a filesystem view of the server's topics and chunk
+// cache.
+func (s *Server) FS() *GridFS {
+	return &GridFS{server: s}
+}
+
+// MessageName returns the file name of msg in its topic directory.
+// Names sort in sequence order and stay unique when a topic's
+// timeline has forked.
+func MessageName(msg *Message) string {
+	return Spf("%08d-%s", msg.Seq, msg.Addr())
+}
+
+// Open implements fs.FS.
+func (g *GridFS) Open(name string) (file fs.File, err error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n, err := g.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if n.info.IsDir() {
+		return &dirFile{info: n.info, entries: n.entries}, nil
+	}
+	if n.lambda != nil {
+		return newLambdaFile(n.info, n.lambda), nil
+	}
+	return &memFile{info: n.info, Reader: bytes.NewReader(n.content)}, nil
+}
+
+// Stat implements fs.StatFS.  Unlike opening and reading a lambda's
+// special file, Stat does not run the lambda.
+func (g *GridFS) Stat(name string) (fi fs.FileInfo, err error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	n, err := g.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return n.info, nil
+}
+
+// node is a resolved file or directory.
+type node struct {
+	info    fileInfo
+	content []byte
+	entries []fileInfo
+	lambda  *Registration
+}
+
+func dirInfo(name string, modTime time.Time) fileInfo {
+	return fileInfo{name: name, mode: fs.ModeDir | 0555, modTime: modTime.UTC()}
+}
+
+func msgInfo(msg *Message) fileInfo {
+	return fileInfo{name: MessageName(msg), size: int64(len(msg.Body)), mode: 0444, modTime: msg.Time.UTC()}
+}
+
+// topicTime returns the time of the newest message on topic.
+func (g *GridFS) topicTime(topic string) time.Time {
+	head := g.server.Head(topic)
+	if head == nil {
+		return time.Time{}
+	}
+	return head.Time
+}
+
+func (g *GridFS) lookup(name string) (n *node, err error) {
+	defer Return(&err)
+	if name == "." {
+		return g.dir(".", "/")
+	}
+	elems := strings.Split(name, "/")
+	if elems[0] == ".chunks" {
+		return g.chunks(elems[1:])
+	}
+	if elems[0] == ".lambdas" {
+		return g.lambdas(elems[1:])
+	}
+	for i, elem := range elems {
+		if elem == ".versions" {
+			topic := "/" + strings.Join(elems[:i], "/")
+			return g.versions(topic, elems[i+1:])
+		}
+	}
+	topic := "/" + name
+	if g.isDir(topic) {
+		return g.dir(path.Base(name), topic)
+	}
+	dir := path.Dir(name)
+	ErrnoIf(dir == ".", syscall.ENOENT, name)
+	head := g.server.Head("/" + dir)
+	ErrnoIf(head == nil, syscall.ENOENT, name)
+	log, err := g.server.Log(head.Addr())
+	Ck(err)
+	return msgNode(log, path.Base(name))
+}
+
+// msgNode finds the message file called base in log.
+func msgNode(log []*Message, base string) (n *node, err error) {
+	for _, msg := range log {
+		if MessageName(msg) == base {
+			return &node{info: msgInfo(msg), content: msg.Body}, nil
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+// isDir returns true if topic is a topic or a prefix of one.
+func (g *GridFS) isDir(topic string) bool {
+	for _, t := range g.server.Topics() {
+		if t == topic || strings.HasPrefix(t, topic+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// dir returns the directory for topic, or the root if topic is "/".
+func (g *GridFS) dir(name, topic string) (n *node, err error) {
+	defer Return(&err)
+	n = &node{info: dirInfo(name, g.topicTime(topic))}
+	prefix := strings.TrimSuffix(topic, "/") + "/"
+	seen := make(map[string]bool)
+	for _, t := range g.server.Topics() {
+		if !strings.HasPrefix(t, prefix) {
+			continue
+		}
+		child := strings.Split(strings.TrimPrefix(t, prefix), "/")[0]
+		if !seen[child] {
+			seen[child] = true
+			n.entries = append(n.entries, dirInfo(child, g.topicTime(prefix+child)))
+		}
+	}
+	if topic == "/" {
+		n.entries = append(n.entries, dirInfo(".chunks", time.Time{}))
+		n.entries = append(n.entries, dirInfo(".lambdas", time.Time{}))
+	}
+	head := g.server.Head(topic)
+	if head != nil {
+		n.entries = append(n.entries, dirInfo(".versions", head.Time))
+		log, err := g.server.Log(head.Addr())
+		Ck(err)
+		for _, msg := range log {
+			n.entries = append(n.entries, msgInfo(msg))
+		}
+	}
+	return
+}
+
+// versions resolves rest within topic's .versions directory.
+func (g *GridFS) versions(topic string, rest []string) (n *node, err error) {
+	defer Return(&err)
+	head := g.server.Head(topic)
+	ErrnoIf(head == nil, syscall.ENOENT, topic)
+	log, err := g.server.Log(head.Addr())
+	Ck(err)
+	if len(rest) == 0 {
+		n = &node{info: dirInfo(".versions", head.Time)}
+		for _, msg := range log {
+			n.entries = append(n.entries, dirInfo(msg.Addr(), msg.Time))
+		}
+		return
+	}
+	var version *Message
+	for _, msg := range log {
+		if msg.Addr() == rest[0] {
+			version = msg
+		}
+	}
+	ErrnoIf(version == nil, syscall.ENOENT, rest[0])
+	snapshot, err := g.server.Log(version.Addr())
+	Ck(err)
+	switch len(rest) {
+	case 1:
+		n = &node{info: dirInfo(rest[0], version.Time)}
+		for _, msg := range snapshot {
+			n.entries = append(n.entries, msgInfo(msg))
+		}
+		return
+	case 2:
+		return msgNode(snapshot, rest[1])
+	}
+	return nil, syscall.ENOENT
+}
+
+// chunks resolves rest within the .chunks directory.
+func (g *GridFS) chunks(rest []string) (n *node, err error) {
+	defer Return(&err)
+	cache := g.server.Cache()
+	switch len(rest) {
+	case 0:
+		n = &node{info: dirInfo(".chunks", time.Time{})}
+		for _, addr := range cache.Addrs() {
+			buf, err := cache.Get(addr)
+			if err != nil {
+				// swept since Addrs
+				continue
+			}
+			n.entries = append(n.entries, fileInfo{name: addr, size: int64(len(buf)), mode: 0444})
+		}
+		return
+	case 1:
+		buf, err := cache.Get(rest[0])
+		Ck(err)
+		return &node{info: fileInfo{name: rest[0], size: int64(len(buf)), mode: 0444}, content: buf}, nil
+	}
+	return nil, syscall.ENOENT
+}
+
+// lambdas resolves rest within the .lambdas directory.
+func (g *GridFS) lambdas(rest []string) (n *node, err error) {
+	switch len(rest) {
+	case 0:
+		n = &node{info: dirInfo(".lambdas", time.Time{})}
+		for _, reg := range g.server.Registrations() {
+			n.entries = append(n.entries, fileInfo{name: reg.Hash, mode: 0666})
+		}
+		return
+	case 1:
+		lambda := g.server.Dereference(rest[0])
+		if lambda != nil {
+			info := fileInfo{name: rest[0], mode: 0666}
+			return &node{info: info, lambda: &Registration{Hash: rest[0], Lambda: lambda}}, nil
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+// WriterFile is a file opened for writing by OpenFile.
+type WriterFile interface {
+	fs.File
+	io.Writer
+}
+
+// OpenFile opens name for writing.  flag must include os.O_WRONLY
+// or os.O_RDWR.
+//
+// If name is a special file in .lambdas, the bytes written to it are
+// streamed to the lambda as its input.  With os.O_RDWR, the first
+// read ends the input and returns the lambda's output.  Close waits
+// for the lambda to finish and returns its error.
+//
+// Otherwise name must be a new file in a topic directory: the bytes
+// written to it are published as one message on that topic when the
+// file is closed.  The base of name is only a placeholder; the
+// message appears under its MessageName.
+func (g *GridFS) OpenFile(name string, flag int) (file WriterFile, err error) {
+	if !fs.ValidPath(name) || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if strings.HasPrefix(name, ".lambdas/") {
+		n, err := g.lookup(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return newLambdaFile(n.info, n.lambda), nil
+	}
+	topic := "/" + path.Dir(name)
+	err = ValidTopic(topic)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &publishFile{g: g, topic: topic, name: path.Base(name)}, nil
+}
+
+// Append publishes data as a new message on the topic for dir and
+// returns the path of the new message file.
+func (g *GridFS) Append(dir string, data []byte) (name string, err error) {
+	defer Return(&err)
+	msg, err := g.server.Publish("/"+dir, data)
+	Ck(err)
+	return path.Join(dir, MessageName(msg)), nil
+}
+
+// publishFile buffers writes and publishes them on Close.
+type publishFile struct {
+	g      *GridFS
+	topic  string
+	name   string
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (f *publishFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: f.name, size: int64(f.buf.Len()), mode: 0200}, nil
+}
+
+func (f *publishFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *publishFile) Write(buf []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.buf.Write(buf)
+}
+
+func (f *publishFile) Close() (err error) {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	_, err = f.g.server.Publish(f.topic, f.buf.Bytes())
+	return
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string               { return fi.name }
+func (fi fileInfo) Size() int64                { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}           { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// memFile is an open regular file.
+type memFile struct {
+	info fileInfo
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// dirFile is an open directory.
+type dirFile struct {
+	info    fileInfo
+	entries []fileInfo
+	sorted  bool
+	pos     int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: syscall.EISDIR}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if !d.sorted {
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].name < d.entries[j].name
+		})
+		d.sorted = true
+	}
+	rest := d.entries[d.pos:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	for _, fi := range rest {
+		entries = append(entries, fi)
+	}
+	d.pos += len(rest)
+	return
+}
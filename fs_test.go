@@ -0,0 +1,86 @@
+package pup
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestGridFS(t *testing.T) {
+	s := &Server{}
+	m1, err := s.Publish("/a/b", []byte("one"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	m2, err := s.Publish("/a/b", []byte("two"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	m3, err := s.Publish("/a/b/c", []byte("three"))
+	Tassert(t, err == nil, "Publish: %v", err)
+
+	g := s.FS()
+	f1 := path.Join("a/b", MessageName(m1))
+	f2 := path.Join("a/b", MessageName(m2))
+	f3 := path.Join("a/b/c", MessageName(m3))
+	v1 := path.Join("a/b/.versions", m1.Addr(), MessageName(m1))
+	chunk := path.Join(".chunks", m2.Addr())
+	err = fstest.TestFS(g, f1, f2, f3, v1, chunk)
+	Tassert(t, err == nil, "TestFS: %v", err)
+
+	buf, err := fs.ReadFile(g, f2)
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == "two", "got '%s'", buf)
+
+	buf, err = fs.ReadFile(g, chunk)
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == string(m2.Encode()), "got '%s'", buf)
+
+	// the version at m1 doesn't contain m2
+	entries, err := fs.ReadDir(g, path.Join("a/b/.versions", m1.Addr()))
+	Tassert(t, err == nil, "ReadDir: %v", err)
+	Tassert(t, len(entries) == 1 && entries[0].Name() == MessageName(m1), "entries %v", entries)
+
+	var files []string
+	err = fs.WalkDir(g, "a", func(p string, d fs.DirEntry, err error) error {
+		if d.Name() == ".versions" {
+			return fs.SkipDir
+		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return err
+	})
+	Tassert(t, err == nil, "WalkDir: %v", err)
+	Tassert(t, len(files) == 3 && files[0] == f1 && files[2] == f3, "files %v", files)
+
+	_, err = g.Open("a/nope")
+	Tassert(t, errors.Is(err, fs.ErrNotExist), "err %v", err)
+	_, err = g.Open(".chunks/sha256:nope")
+	Tassert(t, errors.Is(err, fs.ErrNotExist), "err %v", err)
+}
+
+func TestGridFSWrite(t *testing.T) {
+	s := &Server{}
+	g := s.FS()
+
+	f, err := g.OpenFile("x/y/new", os.O_WRONLY|os.O_CREATE)
+	Tassert(t, err == nil, "OpenFile: %v", err)
+	_, err = f.Write([]byte("hello"))
+	Tassert(t, err == nil, "Write: %v", err)
+	err = f.Close()
+	Tassert(t, err == nil, "Close: %v", err)
+	Tassert(t, string(s.Head("/x/y").Body) == "hello", "head %v", s.Head("/x/y"))
+
+	name, err := g.Append("x/y", []byte("again"))
+	Tassert(t, err == nil, "Append: %v", err)
+	buf, err := fs.ReadFile(g, name)
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == "again", "got '%s'", buf)
+
+	_, err = g.OpenFile("x/y/new", os.O_RDONLY)
+	Tassert(t, err != nil, "expected error")
+	_, err = g.OpenFile("top", os.O_WRONLY)
+	Tassert(t, err != nil, "expected error")
+}
@@ -0,0 +1,185 @@
+package pup
+
+import (
+	"sort"
+	"time"
+)
+
+// Pin marks addr as a GC root.  Anything reachable from a pinned
+// address survives every GC pass.  addr does not need to be in the
+// cache yet.
+func (c *Cache) Pin(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	c.pins[addr] = true
+}
+
+// Unpin removes the explicit pin on addr.  addr may still be kept
+// alive by another root.
+func (c *Cache) Unpin(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	delete(c.pins, addr)
+}
+
+// Pins returns the sorted list of explicitly pinned addresses.
+func (c *Cache) Pins() (pins []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	for addr := range c.pins {
+		pins = append(pins, addr)
+	}
+	sort.Strings(pins)
+	return
+}
+
+// AddRoots registers a function that returns additional GC roots,
+// e.g. the current heads of a state graph or of the topic logs.  The
+// function is called once at the start of every GC pass, without the
+// cache lock held.
+func (c *Cache) AddRoots(f func() []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roots = append(c.roots, f)
+}
+
+// GCReport describes the result of a GC pass.
+type GCReport struct {
+	DryRun bool
+	// Roots are the pins and root addresses the mark phase started
+	// from.
+	Roots []string
+	// Live is the number of chunks reachable from Roots.
+	Live int
+	// Swept lists the chunks that were (or, in a dry run, would have
+	// been) deleted, in the order they were chosen.
+	Swept []Swept
+	// Freed is the number of content bytes in Swept.
+	Freed int64
+	// Kept is the number of unreachable chunks left in the cache by
+	// the MaxAge and MaxBytes policy.
+	Kept int
+}
+
+// Swept describes one chunk removed by GC.
+type Swept struct {
+	Addr   string
+	Size   int
+	Reason string
+}
+
+// GC runs a mark-and-sweep pass over the cache.  The mark phase
+// walks chunk references starting from every pin, from every address
+// returned by the AddRoots functions, and from every chunk stored
+// since the pass began, which the AddRoots functions may not have
+// known about yet.  Reachable chunks are never deleted.
+//
+// If MaxAge and MaxBytes are both zero, the sweep deletes every
+// unreachable chunk.  Otherwise unreachable chunks are kept as plain
+// cache entries and are only evicted once they are older than MaxAge,
+// or, least recently used first, while the cache is larger than
+// MaxBytes.
+//
+// If dryRun is true, GC reports what it would delete without
+// deleting anything.
+func (c *Cache) GC(dryRun bool) (report GCReport) {
+	report.DryRun = dryRun
+
+	c.mu.Lock()
+	rootfuncs := append([]func() []string{}, c.roots...)
+	c.pass++
+	pass := c.pass
+	c.mu.Unlock()
+	var extra []string
+	for _, f := range rootfuncs {
+		extra = append(extra, f()...)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	// mark
+	roots := make(map[string]bool)
+	for addr := range c.pins {
+		roots[addr] = true
+	}
+	for _, addr := range extra {
+		roots[addr] = true
+	}
+	for addr, ck := range c.chunks {
+		if ck.pass == pass {
+			roots[addr] = true
+		}
+	}
+	for addr := range roots {
+		report.Roots = append(report.Roots, addr)
+	}
+	sort.Strings(report.Roots)
+	live := make(map[string]bool)
+	stack := append([]string{}, report.Roots...)
+	for len(stack) > 0 {
+		addr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if live[addr] {
+			continue
+		}
+		ck, ok := c.chunks[addr]
+		if !ok {
+			continue
+		}
+		live[addr] = true
+		stack = append(stack, ck.refs...)
+	}
+	report.Live = len(live)
+
+	// collect unreachable chunks, least recently used first
+	var dead []string
+	var size int64
+	for addr, ck := range c.chunks {
+		size += int64(len(ck.content))
+		if !live[addr] {
+			dead = append(dead, addr)
+		}
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		a, b := c.chunks[dead[i]], c.chunks[dead[j]]
+		if !a.used.Equal(b.used) {
+			return a.used.Before(b.used)
+		}
+		return dead[i] < dead[j]
+	})
+
+	// sweep
+	sweep := func(addr, reason string) {
+		n := len(c.chunks[addr].content)
+		report.Swept = append(report.Swept, Swept{addr, n, reason})
+		report.Freed += int64(n)
+		size -= int64(n)
+	}
+	policy := c.MaxAge > 0 || c.MaxBytes > 0
+	now := time.Now()
+	for _, addr := range dead {
+		ck := c.chunks[addr]
+		switch {
+		case !policy:
+			sweep(addr, "unreachable")
+		case c.MaxAge > 0 && now.Sub(ck.stored) > c.MaxAge:
+			sweep(addr, "age")
+		case c.MaxBytes > 0 && size > c.MaxBytes:
+			sweep(addr, "size")
+		default:
+			report.Kept++
+		}
+	}
+
+	if !dryRun {
+		for _, s := range report.Swept {
+			delete(c.chunks, s.Addr)
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package pup
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestGC(t *testing.T) {
+	c := &Cache{}
+
+	// leaf <- mid <- head, plus an orphan
+	leaf := c.Put([]byte("leaf"))
+	mid := c.Put([]byte("mid"), leaf)
+	head := c.Put([]byte("head"), mid)
+	orphan := c.Put([]byte("orphan"))
+
+	c.Pin(head)
+	Tassert(t, len(c.Pins()) == 1, "pins %v", c.Pins())
+
+	// dry run deletes nothing
+	report := c.GC(true)
+	Tassert(t, report.DryRun, "not a dry run")
+	Tassert(t, report.Live == 3, "live %v", report.Live)
+	Tassert(t, len(report.Swept) == 1 && report.Swept[0].Addr == orphan, "swept %v", report.Swept)
+	Tassert(t, c.Has(orphan), "dry run deleted orphan")
+
+	report = c.GC(false)
+	Tassert(t, report.Freed == int64(len("orphan")), "freed %v", report.Freed)
+	Tassert(t, !c.Has(orphan), "orphan not swept")
+	Tassert(t, c.Has(leaf) && c.Has(mid) && c.Has(head), "live chunk swept")
+
+	// roots from AddRoots keep chunks alive too
+	c.Unpin(head)
+	c.AddRoots(func() []string { return []string{mid} })
+	c.GC(false)
+	Tassert(t, !c.Has(head), "head not swept")
+	Tassert(t, c.Has(mid) && c.Has(leaf), "root chunk swept")
+
+	// a chunk stored while the roots are being collected, such as
+	// a message published after its topic's head was read,
+	// survives along with what it refers to
+	var late string
+	c.AddRoots(func() []string {
+		late = c.Put([]byte("late"), orphan)
+		return nil
+	})
+	orphan = c.Put([]byte("orphan"))
+	c.GC(false)
+	Tassert(t, c.Has(late) && c.Has(orphan), "chunk stored during GC swept")
+}
+
+func TestGCEviction(t *testing.T) {
+	c := &Cache{MaxBytes: 10}
+
+	pinned := c.Put([]byte("0123456789"))
+	c.Pin(pinned)
+	old := c.Put([]byte("old"))
+	c.Put([]byte("young"))
+	c.chunks[old].used = time.Now().Add(-time.Hour)
+
+	// size: the least recently used unpinned chunk goes first, and
+	// the pinned chunk stays even though the cache is still over
+	// budget
+	report := c.GC(false)
+	Tassert(t, len(report.Swept) == 2, "swept %v", report.Swept)
+	Tassert(t, report.Swept[0].Addr == old && report.Swept[0].Reason == "size", "swept %v", report.Swept)
+	Tassert(t, c.Has(pinned), "pinned chunk evicted")
+
+	// age
+	c = &Cache{MaxAge: time.Minute}
+	old = c.Put([]byte("old"))
+	young := c.Put([]byte("young"))
+	c.chunks[old].stored = time.Now().Add(-time.Hour)
+	report = c.GC(false)
+	Tassert(t, len(report.Swept) == 1 && report.Swept[0].Reason == "age", "swept %v", report.Swept)
+	Tassert(t, report.Kept == 1, "kept %v", report.Kept)
+	Tassert(t, !c.Has(old) && c.Has(young), "wrong chunk evicted")
+}
@@ -1,5 +1,11 @@
 module github.com/stevegt/pup
 
-go 1.16
+go 1.18
 
-require github.com/stevegt/goadapt v0.0.13
+require (
+	github.com/stevegt/goadapt v0.0.13
+	github.com/tetratelabs/wazero v1.0.1
+	golang.org/x/term v0.18.0
+)
+
+require golang.org/x/sys v0.18.0 // indirect
@@ -0,0 +1,119 @@
+package pup
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Handler serves the streams for a hash, like a Lambda, but is told
+// more about each stream: see Request.  Register a Handler with
+// Server.Handle.  A Lambda is a Handler, so lambdas registered with
+// Server.Register are served the same way they always have been.
+type Handler interface {
+	ServeStream(ctx context.Context, req *Request) error
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(ctx context.Context, req *Request) error
+
+func (f HandlerFunc) ServeStream(ctx context.Context, req *Request) error {
+	return f(ctx, req)
+}
+
+// ServeStream calls the lambda with the request's hash and stream.
+// The lambda finds the context with ContextOf.
+func (l Lambda) ServeStream(ctx context.Context, req *Request) error {
+	return l([]byte(req.Hash), req.Stream)
+}
+
+// Request describes one stream to its Handler.
+type Request struct {
+	// Hash is the hash the stream was opened for.
+	Hash string
+	// Header is the stream's header line split into fields, starting
+	// with the hash.
+	Header []string
+	// Token is the verified capability token from the header, and
+	// Identity the participant address of its holder.  They are nil
+	// and empty if the server doesn't require tokens; see
+	// RequireTokens.
+	Token    *Token
+	Identity string
+	// RemoteAddr is the other end of the stream, if known, and
+	// Transport the name of its network, such as "tcp".
+	RemoteAddr net.Addr
+	Transport  string
+	// Start is when the server began reading the stream.
+	Start time.Time
+	// Log logs to the server's Logger, prefixed with the hash and
+	// the remote address.
+	Log *log.Logger
+	// Stream is the rest of the stream after the header.
+	Stream io.ReadWriteCloser
+}
+
+// newRequest describes stream, which was opened with header at start.
+func (s *Server) newRequest(header string, stream io.ReadWriteCloser, start time.Time) *Request {
+	fields := strings.Fields(header)
+	req := &Request{Header: fields, Start: start, Stream: stream}
+	if len(fields) > 0 {
+		req.Hash = fields[0]
+	}
+	if ts, ok := stream.(*tokenStream); ok {
+		req.Token = ts.token
+		req.Identity = ts.token.Holder()
+	}
+	if ra, ok := stream.(interface{ RemoteAddr() net.Addr }); ok {
+		req.RemoteAddr = ra.RemoteAddr()
+	}
+	from := "-"
+	if req.RemoteAddr != nil {
+		req.Transport = req.RemoteAddr.Network()
+		from = req.RemoteAddr.String()
+	}
+	base := s.Logger
+	if base == nil {
+		base = log.Default()
+	}
+	req.Log = log.New(base.Writer(), base.Prefix()+req.Hash+" "+from+" ", base.Flags())
+	return req
+}
+
+// Handle registers h to serve the streams for hash.
+func (s *Server) Handle(hash string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registry == nil {
+		s.registry = &registry{}
+	}
+	s.registry.put(hash, h)
+}
+
+// Handler returns the Handler registered for hash, or nil.
+func (s *Server) Handler(hash string) Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registry == nil {
+		s.registry = &registry{}
+	}
+	return s.registry.get(hash)
+}
+
+// lambdaOf returns h as a Lambda, for callers that dispatch to a hash
+// themselves rather than through a stream header.
+func (s *Server) lambdaOf(h Handler) Lambda {
+	if h == nil {
+		return nil
+	}
+	if l, ok := h.(Lambda); ok {
+		return l
+	}
+	return func(hash []byte, stream io.ReadWriteCloser) error {
+		req := s.newRequest(string(hash), stream, time.Now())
+		return h.ServeStream(ContextOf(stream), req)
+	}
+}
@@ -0,0 +1,90 @@
+package pup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestHandler(t *testing.T) {
+	logbuf := &bytes.Buffer{}
+	s := &Server{Logger: log.New(logbuf, "", 0)}
+	var got *Request
+	s.Handle("sha256:aa", HandlerFunc(func(ctx context.Context, req *Request) error {
+		got = req
+		Tassert(t, ctx.Err() == nil, "context done: %v", ctx.Err())
+		req.Log.Print("hello")
+		_, err := req.Stream.Write([]byte("ok"))
+		return err
+	}))
+	s.Register("sha256:bb", func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := stream.Write(hash)
+		return err
+	})
+
+	call := func(header string) (reply string, err error) {
+		client, server := net.Pipe()
+		done := make(chan error)
+		go func() {
+			err := s.handleStream(server)
+			server.Close()
+			done <- err
+		}()
+		client.Write([]byte(header + "\n"))
+		buf, _ := io.ReadAll(client)
+		return string(buf), <-done
+	}
+
+	before := time.Now()
+	reply, err := call("sha256:aa")
+	Tassert(t, err == nil && reply == "ok", "handler: %v '%s'", err, reply)
+	Tassert(t, got.Hash == "sha256:aa" && len(got.Header) == 1, "request: %#v", got)
+	Tassert(t, got.Transport == "pipe" && got.RemoteAddr != nil, "transport: %q", got.Transport)
+	Tassert(t, got.Identity == "" && got.Token == nil, "identity: %q", got.Identity)
+	Tassert(t, !got.Start.Before(before), "start: %v", got.Start)
+	Tassert(t, strings.HasPrefix(logbuf.String(), "sha256:aa pipe hello"), "log: %q", logbuf.String())
+
+	// a Lambda is still served as it was
+	reply, err = call("sha256:bb")
+	Tassert(t, err == nil && reply == "sha256:bb", "lambda: %v '%s'", err, reply)
+
+	// Dereference adapts a Handler to a Lambda
+	lambda := s.Dereference("sha256:aa")
+	Tassert(t, lambda != nil, "no lambda")
+	stream := &MockReadWriteCloser{}
+	err = lambda([]byte("sha256:aa"), stream)
+	Tassert(t, err == nil && string(stream.writebuf) == "ok", "adapted: %v '%s'", err, stream.writebuf)
+	Tassert(t, s.Dereference("sha256:cc") == nil, "unregistered hash")
+}
+
+func TestHandlerIdentity(t *testing.T) {
+	port := 10860
+	root, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	s := &Server{}
+	identity := make(chan string, 1)
+	s.Handle("sha256:ab", HandlerFunc(func(ctx context.Context, req *Request) error {
+		identity <- req.Identity + " " + req.Transport
+		return nil
+	}))
+	s.RequireTokens(root.Addr)
+	go s.Serve("127.0.0.1", port)
+	defer s.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	id, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	c := &Client{Addr: Spf("127.0.0.1:%d", port), Identity: id, Capabilities: []*Capability{
+		root.Grant(id.Addr, []string{"call"}, []string{"*"}, time.Now().Add(time.Hour))}}
+	err = c.Call("sha256:ab", bytes.NewReader(nil), io.Discard)
+	Tassert(t, err == nil, "Call: %v", err)
+	got := <-identity
+	Tassert(t, got == id.Addr+" tcp", "identity: %q", got)
+}
@@ -0,0 +1,84 @@
+package pup
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Identity is a participant's Ed25519 key pair.  Participants are
+// known by their address, which is derived from the public key, so
+// anyone can check a signature against the address alone.
+type Identity struct {
+	// Addr is the participant address, see ParticipantAddr.
+	Addr string
+	key  ed25519.PrivateKey
+}
+
+// NewIdentity generates a new random identity.
+func NewIdentity() (id *Identity, err error) {
+	defer Return(&err)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	Ck(err)
+	return identity(key), nil
+}
+
+func identity(key ed25519.PrivateKey) *Identity {
+	return &Identity{Addr: ParticipantAddr(key.Public().(ed25519.PublicKey)), key: key}
+}
+
+// LoadIdentity reads an identity saved by Save.
+func LoadIdentity(path string) (id *Identity, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(path)
+	Ck(err)
+	seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, Error{syscall.EINVAL, path + ": not an identity file"}
+	}
+	return identity(ed25519.NewKeyFromSeed(seed)), nil
+}
+
+// Save writes the identity's private key seed, in hex, to a file at
+// path that only the owner can read.
+func (id *Identity) Save(path string) error {
+	return os.WriteFile(path, []byte(hex.EncodeToString(id.key.Seed())+"\n"), 0600)
+}
+
+// Sign signs data.
+func (id *Identity) Sign(data []byte) (sig []byte) {
+	return ed25519.Sign(id.key, data)
+}
+
+// ParticipantAddr returns the address of the participant with public
+// key pub: "ed25519:" followed by the key in hex.
+func ParticipantAddr(pub ed25519.PublicKey) string {
+	return "ed25519:" + hex.EncodeToString(pub)
+}
+
+// ParticipantKey returns the public key of the participant at addr.
+func ParticipantKey(addr string) (pub ed25519.PublicKey, err error) {
+	hexkey := strings.TrimPrefix(addr, "ed25519:")
+	buf, err := hex.DecodeString(hexkey)
+	if hexkey == addr || err != nil || len(buf) != ed25519.PublicKeySize {
+		return nil, Error{syscall.EINVAL, Spf("not a participant address: %q", addr)}
+	}
+	return ed25519.PublicKey(buf), nil
+}
+
+// Verify checks that sig is the signature of data by the participant
+// at addr.  A bad signature is an Error with EACCES.
+func Verify(addr string, data, sig []byte) (err error) {
+	defer Return(&err)
+	pub, err := ParticipantKey(addr)
+	Ck(err)
+	if !ed25519.Verify(pub, data, sig) {
+		return Error{syscall.EACCES, "bad signature from " + addr}
+	}
+	return
+}
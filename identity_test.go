@@ -0,0 +1,114 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestIdentity(t *testing.T) {
+	id, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	Tassert(t, strings.HasPrefix(id.Addr, "ed25519:") && len(id.Addr) == 8+64, "addr %s", id.Addr)
+
+	path := filepath.Join(t.TempDir(), "id")
+	err = id.Save(path)
+	Tassert(t, err == nil, "Save: %v", err)
+	loaded, err := LoadIdentity(path)
+	Tassert(t, err == nil && loaded.Addr == id.Addr, "LoadIdentity: %v %v", err, loaded)
+
+	sig := loaded.Sign([]byte("hello"))
+	err = Verify(id.Addr, []byte("hello"), sig)
+	Tassert(t, err == nil, "Verify: %v", err)
+	err = Verify(id.Addr, []byte("hullo"), sig)
+	Tassert(t, errors.Is(err, syscall.EACCES), "Verify tampered: %v", err)
+	other, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	err = Verify(other.Addr, []byte("hello"), sig)
+	Tassert(t, errors.Is(err, syscall.EACCES), "Verify wrong key: %v", err)
+	for _, addr := range []string{"sha256:00", "ed25519:zz", "ed25519:00"} {
+		_, err = ParticipantKey(addr)
+		Tassert(t, errors.Is(err, syscall.EINVAL), "ParticipantKey(%q): %v", addr, err)
+	}
+}
+
+func TestSignedMessage(t *testing.T) {
+	id, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	s := &Server{}
+	_, err = s.Publish("/chat", []byte("first"))
+	Tassert(t, err == nil, "Publish: %v", err)
+
+	// the server fills in the chain after the author signs
+	sig := id.Sign(SignedBytes("/chat", id.Addr, []byte("hi")))
+	msg, err := s.PublishSigned("/chat", []byte("hi"), id.Addr, sig)
+	Tassert(t, err == nil, "PublishSigned: %v", err)
+	Tassert(t, msg.Seq == 2 && len(msg.Prev) == 1 && msg.Author == id.Addr, "msg %v", msg)
+	parsed, err := ParseMessage(msg.Encode())
+	Tassert(t, err == nil, "ParseMessage: %v", err)
+	Tassert(t, parsed.Addr() == msg.Addr() && parsed.Verify() == nil, "parsed %v", parsed)
+
+	_, err = s.PublishSigned("/chat", []byte("forged"), id.Addr, sig)
+	Tassert(t, errors.Is(err, syscall.EACCES), "forged: %v", err)
+	_, err = s.PublishSigned("/other", []byte("hi"), id.Addr, sig)
+	Tassert(t, errors.Is(err, syscall.EACCES), "moved to another topic: %v", err)
+	Tassert(t, s.Head("/chat").Addr() == msg.Addr(), "refused messages were published")
+
+	unsigned := &Message{Topic: "/chat", Body: []byte("anon")}
+	Tassert(t, errors.Is(unsigned.Verify(), syscall.EACCES), "unsigned message verified")
+	unsigned.Sign(id)
+	Tassert(t, unsigned.Verify() == nil, "signed message: %v", unsigned.Verify())
+}
+
+func TestRegisterRequest(t *testing.T) {
+	id, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	now := time.Now()
+	req := NewRegisterRequest("sha256:0f", id, now)
+	parsed, err := ParseRegisterRequest(req.Encode())
+	Tassert(t, err == nil, "ParseRegisterRequest: %v", err)
+	Tassert(t, parsed.Hash == "sha256:0f" && parsed.Name == id.Addr && parsed.Time.Equal(now), "parsed %v", parsed)
+	Tassert(t, parsed.Verify() == nil, "Verify: %v", parsed.Verify())
+
+	parsed.Hash = "sha256:10"
+	Tassert(t, errors.Is(parsed.Verify(), syscall.EACCES), "retargeted request verified")
+
+	// requests in the same second don't look like replays
+	again := NewRegisterRequest("sha256:0f", id, now.Add(time.Millisecond))
+	Tassert(t, !bytes.Equal(again.Sig, req.Sig), "same signature a millisecond later")
+
+	for _, line := range []string{"a sha256:0f", "a sha256:0f peer"} {
+		req, err := ParseRegisterRequest(line)
+		Tassert(t, err == nil && req.Encode() == line, "%q: %v %v", line, err, req)
+		Tassert(t, errors.Is(req.Verify(), syscall.EACCES), "unsigned request verified")
+	}
+	for _, line := range []string{"a", "b sha256:0f", "a sha256:0f peer 12"} {
+		_, err := ParseRegisterRequest(line)
+		Tassert(t, errors.Is(err, syscall.EINVAL), "%q: %v", line, err)
+	}
+}
+
+func TestClientSigned(t *testing.T) {
+	port := 10853
+	s := &Server{}
+	s.RegisterPubSub()
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	id, err := NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	c := &Client{Addr: Spf("127.0.0.1:%d", port), Identity: id}
+	addr, err := c.Publish("/chat", []byte("signed"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	head := s.Head("/chat")
+	Tassert(t, head.Addr() == addr && head.Author == id.Addr && head.Verify() == nil, "head %v", head)
+}
@@ -0,0 +1,152 @@
+package pup
+
+import (
+	"math"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Limit bounds the streams of one lambda hash, peer or source
+// address.  Zero fields don't limit.
+type Limit struct {
+	// Rate is how many streams may start per second, on average,
+	// and Burst how many may start at once after a quiet spell.
+	// Burst defaults to Rate, rounded up.
+	Rate  float64
+	Burst int
+	// Concurrency is how many streams may be open at once.
+	Concurrency int
+	// Bytes is how much a stream may carry in each direction.
+	Bytes int64
+}
+
+// LimitKind says what a Limit applies to.
+type LimitKind int
+
+const (
+	// LimitHash limits the streams for a lambda hash.
+	LimitHash LimitKind = iota
+	// LimitPeer limits the streams of a participant, known by the
+	// holder of the stream's capability token; see RequireTokens.
+	LimitPeer
+	// LimitIP limits the streams from a source IP address.
+	LimitIP
+)
+
+var limitKinds = []string{"hash", "peer", "ip"}
+
+func (k LimitKind) String() string {
+	return limitKinds[k]
+}
+
+// limiter is the state of one hash, peer or address: a token bucket
+// and the number of open streams.
+type limiter struct {
+	tokens float64
+	last   time.Time
+	open   int
+}
+
+type limits struct {
+	mu    sync.Mutex
+	rules map[LimitKind]map[string]Limit
+	state map[string]*limiter
+}
+
+// SetLimit limits the streams of the lambda hash, participant or IP
+// address key.  The key "*" sets the limit for every key of that kind
+// without one of its own; each key still counts its streams apart.  A
+// stream is refused if any of the limits on its hash, peer or address
+// would be broken: with EAGAIN for the rate, EBUSY for concurrency, or
+// EDQUOT for bytes.  A zero Limit removes the limit.
+func (s *Server) SetLimit(kind LimitKind, key string, limit Limit) {
+	l := s.limits()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rules[kind] == nil {
+		l.rules[kind] = make(map[string]Limit)
+	}
+	if limit == (Limit{}) {
+		delete(l.rules[kind], key)
+		return
+	}
+	l.rules[kind][key] = limit
+}
+
+func (s *Server) limits() *limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limitmap == nil {
+		s.limitmap = &limits{rules: make(map[LimitKind]map[string]Limit), state: make(map[string]*limiter)}
+	}
+	return s.limitmap
+}
+
+// admit starts a stream for hash from the peer and remote address,
+// either of which may be unknown.  It returns a function that ends the
+// stream, and the bytes the stream may carry each way, or 0 for no
+// limit.
+func (s *Server) admit(hash, peer string, remote net.Addr) (release func(), quota int64, err error) {
+	keys := map[LimitKind]string{LimitHash: hash, LimitPeer: peer}
+	if tcp, ok := remote.(*net.TCPAddr); ok {
+		keys[LimitIP] = tcp.IP.String()
+	}
+	l := s.limits()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var admitted []*limiter
+	for kind, key := range keys {
+		if key == "" {
+			continue
+		}
+		limit, ok := l.rules[kind][key]
+		if !ok {
+			limit, ok = l.rules[kind]["*"]
+		}
+		if !ok {
+			continue
+		}
+		name := kind.String() + " " + key
+		st := l.state[name]
+		if st == nil {
+			st = &limiter{last: now, tokens: math.Inf(1)}
+			l.state[name] = st
+		}
+		if limit.Concurrency > 0 && st.open >= limit.Concurrency {
+			return nil, 0, Error{syscall.EBUSY, Spf("%s has %d streams open", name, st.open)}
+		}
+		if limit.Rate > 0 {
+			burst := float64(limit.Burst)
+			if burst == 0 {
+				burst = math.Ceil(limit.Rate)
+			}
+			st.tokens = math.Min(burst, st.tokens+now.Sub(st.last).Seconds()*limit.Rate)
+			st.last = now
+			if st.tokens < 1 {
+				return nil, 0, Error{syscall.EAGAIN, Spf("%s is over %g streams per second", name, limit.Rate)}
+			}
+		}
+		if limit.Bytes > 0 && (quota == 0 || limit.Bytes < quota) {
+			quota = limit.Bytes
+		}
+		admitted = append(admitted, st)
+	}
+	// only take from the buckets once every limit has passed
+	for _, st := range admitted {
+		st.tokens--
+		st.open++
+	}
+	release = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, st := range admitted {
+			st.open--
+		}
+	}
+	return
+}
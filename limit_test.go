@@ -0,0 +1,116 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestLimit(t *testing.T) {
+	s := &Server{}
+	echo := func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := io.Copy(stream, stream)
+		return err
+	}
+	s.Register("sha256:aa", echo)
+	s.Register("sha256:cc", echo)
+	s.Register("sha256:dd", func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := stream.Write([]byte("0123456789"))
+		return err
+	})
+	block := make(chan bool)
+	s.Register("sha256:bb", func(hash []byte, stream io.ReadWriteCloser) error {
+		<-block
+		return nil
+	})
+	call := func(hash, input string) (string, error) {
+		stream := &bufStream{Reader: strings.NewReader(hash + "\n" + input)}
+		err := s.handleStream(stream)
+		return stream.out.String(), err
+	}
+	refused := func(out string, err error, errno syscall.Errno) bool {
+		return errors.Is(err, errno) && len(out) > 0 && out[0] == 0 &&
+			errors.Is(ParseError([]byte(out[1:len(out)-1])), errno)
+	}
+
+	// rate
+	s.SetLimit(LimitHash, "sha256:aa", Limit{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		out, err := call("sha256:aa", "hi")
+		Tassert(t, err == nil && out == "hi", "call %d: %v '%s'", i, err, out)
+	}
+	out, err := call("sha256:aa", "hi")
+	Tassert(t, refused(out, err, syscall.EAGAIN), "over rate: %v '%s'", err, out)
+	_, err = call("sha256:cc", "hi")
+	Tassert(t, err == nil, "other hash: %v", err)
+
+	// concurrency, with a default for every hash
+	s.SetLimit(LimitHash, "*", Limit{Concurrency: 1})
+	done := make(chan error)
+	go func() {
+		_, err := call("sha256:bb", "")
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	out, err = call("sha256:bb", "")
+	Tassert(t, refused(out, err, syscall.EBUSY), "over concurrency: %v '%s'", err, out)
+	_, err = call("sha256:cc", "hi")
+	Tassert(t, err == nil, "hashes are counted apart: %v", err)
+	block <- true
+	Tassert(t, <-done == nil, "blocked call failed")
+	go func() { block <- true }()
+	_, err = call("sha256:bb", "")
+	Tassert(t, err == nil, "after release: %v", err)
+	s.SetLimit(LimitHash, "*", Limit{})
+
+	// bytes
+	s.SetLimit(LimitHash, "sha256:cc", Limit{Bytes: 4})
+	s.SetLimit(LimitHash, "sha256:dd", Limit{Bytes: 4})
+	out, err = call("sha256:cc", "abc")
+	Tassert(t, err == nil && out == "abc", "under quota: %v '%s'", err, out)
+	out, err = call("sha256:cc", "hello world")
+	Tassert(t, refused(out, err, syscall.EDQUOT), "input over quota: %v '%s'", err, out)
+	out, err = call("sha256:dd", "")
+	Tassert(t, errors.Is(err, syscall.EDQUOT) && out == "0123", "output over quota: %v '%s'", err, out)
+
+	// peers
+	s.SetLimit(LimitPeer, "ed25519:01", Limit{Concurrency: 1})
+	release, _, err := s.admit("sha256:ff", "ed25519:01", nil)
+	Tassert(t, err == nil, "admit: %v", err)
+	_, _, err = s.admit("sha256:ee", "ed25519:01", nil)
+	Tassert(t, errors.Is(err, syscall.EBUSY), "peer over concurrency: %v", err)
+	_, _, err = s.admit("sha256:ff", "ed25519:02", nil)
+	Tassert(t, err == nil, "other peer: %v", err)
+	release()
+	_, _, err = s.admit("sha256:ee", "ed25519:01", nil)
+	Tassert(t, err == nil, "after release: %v", err)
+}
+
+func TestClientLimits(t *testing.T) {
+	port := 10858
+	s := &Server{}
+	s.Register("sha256:aa", func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := stream.Write([]byte("ok"))
+		return err
+	})
+	s.SetLimit(LimitIP, "127.0.0.1", Limit{Rate: 0.1})
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+	out := &bytes.Buffer{}
+	err := c.Call("sha256:aa", bytes.NewReader(nil), out)
+	Tassert(t, err == nil && out.String() == "ok", "Call: %v '%s'", err, out)
+	out.Reset()
+	err = c.Call("sha256:aa", bytes.NewReader(nil), out)
+	Tassert(t, errors.Is(err, syscall.EAGAIN) && out.Len() == 0, "over rate: %v '%s'", err, out)
+}
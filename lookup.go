@@ -0,0 +1,117 @@
+package pup
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Well-known hashes of the lambdas registered by RegisterLookup.
+// They are the sha256 of "pup list" and "pup get".
+const (
+	LIST = "sha256:518d1aea1f78942d8c0302d7920d51fed1d26b1c068ab57b15fa83055885427c"
+	GET  = "sha256:c15a25ff04f1e801f3e9cfa4f1ab241958174140c50f9380fedfe65593b3518a"
+)
+
+// MaxChunk is the largest chunk Client.Get accepts from a server.
+const MaxChunk = 64 << 20
+
+// RegisterLookup registers the lambdas that let a remote client look
+// around the server.
+//
+// A LIST stream carries nothing; the reply is the hash of every
+// registration, sorted, one per line.
+//
+// A GET stream carries one line holding a chunk address.  The reply is
+// a line holding the length of the chunk, followed by its content.  If
+// the chunk isn't in the cache the stream is closed without a reply.
+func (s *Server) RegisterLookup() {
+	s.Register(LIST, s.listLambda)
+	s.Register(GET, s.getLambda)
+}
+
+func (s *Server) listLambda(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	var hashes []string
+	for _, reg := range s.Registrations() {
+		hashes = append(hashes, reg.Hash+"\n")
+	}
+	sort.Strings(hashes)
+	_, err = io.WriteString(stream, strings.Join(hashes, ""))
+	Ck(err)
+	return
+}
+
+func (s *Server) getLambda(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	line, err := Readline(stream, 1024)
+	Ck(err)
+	content, err := s.Cache().Get(strings.TrimSpace(string(line)))
+	Ck(err)
+	_, err = stream.Write([]byte(Spf("%d\n", len(content))))
+	Ck(err)
+	_, err = stream.Write(content)
+	Ck(err)
+	return
+}
+
+// Registrations returns the hashes registered on the server, sorted.
+func (c *Client) Registrations() (hashes []string, err error) {
+	defer Return(&err)
+	conn, err := c.Open(LIST)
+	Ck(err)
+	defer conn.Close()
+	buf, err := io.ReadAll(conn)
+	Ck(err)
+	hashes = strings.Fields(string(buf))
+	return
+}
+
+// Get fetches the chunk at addr from the server's cache.  It returns
+// an Error with ENOENT if the server doesn't have the chunk.
+func (c *Client) Get(addr string) (content []byte, err error) {
+	defer Return(&err)
+	conn, err := c.Open(GET)
+	Ck(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(addr + "\n"))
+	Ck(err)
+	line, err := Readline(conn, 1024)
+	if err == io.EOF && len(line) == 0 {
+		return nil, Error{syscall.ENOENT, addr}
+	}
+	Ck(err)
+	size, err := strconv.Atoi(string(line))
+	if err != nil || size < 0 {
+		return nil, Error{syscall.EBADMSG, Spf("bad length %q", line)}
+	}
+	ErrnoIf(size > MaxChunk, syscall.EMSGSIZE, "chunk of %d bytes is over %d", size, MaxChunk)
+	content = make([]byte, size)
+	_, err = io.ReadFull(conn, content)
+	Ck(err)
+	return
+}
+
+// Call runs the lambda at hash on the server.  It sends input, tells
+// the lambda the input is complete, and copies the reply to output
+// until the server closes the stream.
+func (c *Client) Call(hash string, input io.Reader, output io.Writer) (err error) {
+	defer Return(&err)
+	conn, err := c.Open(hash)
+	Ck(err)
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, input)
+		// keep reading the reply
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(output, conn)
+	Ck(err)
+	return
+}
@@ -0,0 +1,63 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestLookup(t *testing.T) {
+	port := 10848
+	s := &Server{}
+	s.RegisterLookup()
+	s.Register("sha256:00", func(hash []byte, stream io.ReadWriteCloser) error {
+		buf, err := io.ReadAll(stream)
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(bytes.ToUpper(buf))
+		return err
+	})
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(1 * time.Second)
+	c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+
+	hashes, err := c.Registrations()
+	Tassert(t, err == nil, "Registrations: %v", err)
+	Tassert(t, strings.Join(hashes, " ") == "sha256:00 "+LIST+" "+GET, "got %v", hashes)
+
+	addr := s.Cache().Put([]byte("two\nlines\n"))
+	content, err := c.Get(addr)
+	Tassert(t, err == nil, "Get: %v", err)
+	Tassert(t, string(content) == "two\nlines\n", "got '%s'", content)
+	addr = s.Cache().Put(nil)
+	content, err = c.Get(addr)
+	Tassert(t, err == nil && len(content) == 0, "empty chunk: %v '%s'", err, content)
+	_, err = c.Get(Address([]byte("missing")))
+	Tassert(t, errors.Is(err, syscall.ENOENT), "missing chunk: %v", err)
+
+	out := &bytes.Buffer{}
+	err = c.Call("sha256:00", strings.NewReader("shout"), out)
+	Tassert(t, err == nil, "Call: %v", err)
+	Tassert(t, out.String() == "SHOUT", "got '%s'", out)
+
+	// the client doesn't allocate whatever length a server sends
+	for size, errno := range map[int]syscall.Errno{-1: syscall.EBADMSG, MaxChunk + 1: syscall.EMSGSIZE} {
+		reply := Spf("%d\n", size)
+		s.Register(GET, func(hash []byte, stream io.ReadWriteCloser) error {
+			_, err := stream.Write([]byte(reply))
+			return err
+		})
+		_, err = c.Get(addr)
+		Tassert(t, errors.Is(err, errno), "length %d: %v", size, err)
+	}
+}
@@ -0,0 +1,141 @@
+package pup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Manifest ties a lambda hash to the code that implements it.  Hash
+// must be the content address of the file at Entrypoint, so the
+// hash names exactly one function.
+type Manifest struct {
+	Hash string
+	// Language is "wasm" for a WASI module, "exec" for a native
+	// executable, or the name of a script interpreter such as
+	// "python3" or "sh".
+	Language string
+	// Entrypoint is the path of the module, executable or script.
+	Entrypoint string
+}
+
+// NewManifest hashes the code at entrypoint and returns a manifest
+// for it.
+func NewManifest(language, entrypoint string) (m *Manifest, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(entrypoint)
+	Ck(err)
+	m = &Manifest{Hash: Address(buf), Language: language, Entrypoint: entrypoint}
+	return
+}
+
+// Encode returns the storage form of m: one "key value" line each
+// for hash, language and entrypoint.
+func (m *Manifest) Encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "hash %s\n", m.Hash)
+	fmt.Fprintf(&buf, "language %s\n", m.Language)
+	fmt.Fprintf(&buf, "entrypoint %s\n", m.Entrypoint)
+	return buf.Bytes()
+}
+
+// ParseManifest decodes a manifest.  Blank lines and lines starting
+// with "#" are ignored.
+func ParseManifest(buf []byte) (m *Manifest, err error) {
+	defer Return(&err)
+	m = &Manifest{}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		ErrnoIf(len(parts) != 2, syscall.EBADMSG, "malformed manifest line: %q", line)
+		key, val := parts[0], strings.TrimSpace(parts[1])
+		switch key {
+		case "hash":
+			m.Hash = val
+		case "language":
+			m.Language = val
+		case "entrypoint":
+			m.Entrypoint = val
+		default:
+			ErrnoIf(true, syscall.EBADMSG, "unknown manifest field: %q", key)
+		}
+	}
+	ErrnoIf(m.Hash == "" || m.Language == "" || m.Entrypoint == "", syscall.EBADMSG,
+		"manifest needs hash, language and entrypoint")
+	return
+}
+
+// LoadManifest reads the manifest file at path.  A relative
+// Entrypoint is taken to be relative to the manifest's directory.
+func LoadManifest(path string) (m *Manifest, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(path)
+	Ck(err)
+	m, err = ParseManifest(buf)
+	Ck(err)
+	if !filepath.IsAbs(m.Entrypoint) {
+		m.Entrypoint = filepath.Join(filepath.Dir(path), m.Entrypoint)
+	}
+	return
+}
+
+// verify reads the code at m.Entrypoint and checks it against
+// m.Hash.
+func (m *Manifest) verify() (code []byte, err error) {
+	defer Return(&err)
+	code, err = os.ReadFile(m.Entrypoint)
+	Ck(err)
+	got := Address(code)
+	if got != m.Hash {
+		return nil, Error{syscall.EBADMSG, Spf("%s hashes to %s, manifest says %s", m.Entrypoint, got, m.Hash)}
+	}
+	return
+}
+
+// Lambda verifies the code against m.Hash and returns a lambda that
+// runs it.  A wasm module is compiled from the verified bytes and
+// run within limits.  Executables and scripts run as cmd, with Path
+// and the leading Args filled in from the manifest; since the file
+// could change after registration, it is verified again before every
+// run, and a mismatch fails the call.
+func (m *Manifest) Lambda(cmd Command, limits WasmLimits) (lambda Lambda, err error) {
+	defer Return(&err)
+	code, err := m.verify()
+	Ck(err)
+	switch m.Language {
+	case "wasm":
+		return WasmLambda(code, limits)
+	case "exec":
+		cmd.Path = m.Entrypoint
+	default:
+		cmd.Path = m.Language
+		cmd.Args = append([]string{m.Entrypoint}, cmd.Args...)
+	}
+	run := ExecLambda(cmd)
+	lambda = func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		defer Return(&err)
+		_, err = m.verify()
+		Ck(err)
+		return run(hash, stream)
+	}
+	return
+}
+
+// RegisterManifest verifies the code described by m and registers
+// it under m.Hash.  See Manifest.Lambda.
+func (s *Server) RegisterManifest(m *Manifest, cmd Command, limits WasmLimits) (err error) {
+	defer Return(&err)
+	lambda, err := m.Lambda(cmd, limits)
+	Ck(err)
+	s.Register(m.Hash, lambda)
+	return
+}
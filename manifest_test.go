@@ -0,0 +1,78 @@
+package pup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "upper.sh")
+	err := os.WriteFile(script, []byte("tr a-z A-Z\n"), 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+
+	m, err := NewManifest("sh", script)
+	Tassert(t, err == nil, "NewManifest: %v", err)
+	Tassert(t, m.Hash == Address([]byte("tr a-z A-Z\n")), "hash %s", m.Hash)
+
+	// relative entrypoints are relative to the manifest
+	rel := *m
+	rel.Entrypoint = "upper.sh"
+	path := filepath.Join(dir, "upper.manifest")
+	err = os.WriteFile(path, append([]byte("# upcase\n"), rel.Encode()...), 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+	got, err := LoadManifest(path)
+	Tassert(t, err == nil, "LoadManifest: %v", err)
+	Tassert(t, *got == *m, "got %v", got)
+
+	s := &Server{}
+	err = s.RegisterManifest(got, Command{}, WasmLimits{})
+	Tassert(t, err == nil, "RegisterManifest: %v", err)
+	stream := &bufStream{Reader: strings.NewReader(m.Hash + "\nhello")}
+	err = s.handleStream(stream)
+	Tassert(t, err == nil, "handleStream: %v", err)
+	Tassert(t, stream.out.String() == "HELLO", "got '%s'", stream.out.String())
+
+	// the script changed after registration
+	err = os.WriteFile(script, []byte("rm -rf /\n"), 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+	stream = &bufStream{Reader: strings.NewReader(m.Hash + "\nhello")}
+	err = s.handleStream(stream)
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "err %v", err)
+	Tassert(t, stream.out.Len() == 0, "got '%s'", stream.out.String())
+
+	// and is refused at registration
+	err = s.RegisterManifest(m, Command{}, WasmLimits{})
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "err %v", err)
+
+	_, err = ParseManifest([]byte("hash x\nlanguage sh\n"))
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "err %v", err)
+	_, err = ParseManifest([]byte("hash x\nlanguage sh\nentrypoint y\nextra z\n"))
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "err %v", err)
+}
+
+func TestManifestWasm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.wasm")
+	err := os.WriteFile(path, echoWasm, 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+	m, err := NewManifest("wasm", path)
+	Tassert(t, err == nil, "NewManifest: %v", err)
+
+	s := &Server{}
+	err = s.RegisterManifest(m, Command{}, WasmLimits{})
+	Tassert(t, err == nil, "RegisterManifest: %v", err)
+	stream := &bufStream{Reader: strings.NewReader(m.Hash + "\nhi")}
+	err = s.handleStream(stream)
+	Tassert(t, err == nil, "handleStream: %v", err)
+	Tassert(t, stream.out.String() == "hi", "got '%s'", stream.out.String())
+
+	m.Hash = Address([]byte("something else"))
+	err = s.RegisterManifest(m, Command{}, WasmLimits{})
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "err %v", err)
+}
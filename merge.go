@@ -0,0 +1,250 @@
+package pup
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Import stores an encoded message received from another node in
+// the chunk cache and returns it.  Import does not change any topic
+// head; call Merge once the other node's history is in the cache.
+func (s *Server) Import(buf []byte) (msg *Message, err error) {
+	defer Return(&err)
+	msg, err = ParseMessage(buf)
+	Ck(err)
+	err = ValidTopic(msg.Topic)
+	Ck(err)
+	s.Cache().Put(msg.Encode(), msg.Prev...)
+	return
+}
+
+// Fork describes how two heads of the same topic relate.
+type Fork struct {
+	// Base is the address of the newest common ancestor of the two
+	// heads, or empty if they share no history.
+	Base string
+	// Ours and Theirs hold the messages reachable from one head but
+	// not the other, oldest first.
+	Ours   []*Message
+	Theirs []*Message
+}
+
+// Diverged returns true if neither head contains the other, i.e. the
+// topic's timeline has forked and needs a merge.
+func (f *Fork) Diverged() bool {
+	return len(f.Ours) > 0 && len(f.Theirs) > 0
+}
+
+// DetectFork compares the topic histories reachable from the messages
+// at ours and theirs.  Both histories must be in the chunk cache.
+func (s *Server) DetectFork(ours, theirs string) (fork *Fork, err error) {
+	defer Return(&err)
+	a, err := s.Log(ours)
+	Ck(err)
+	b, err := s.Log(theirs)
+	Ck(err)
+	inA := make(map[string]bool)
+	for _, msg := range a {
+		inA[msg.Addr()] = true
+	}
+	inB := make(map[string]bool)
+	for _, msg := range b {
+		inB[msg.Addr()] = true
+	}
+	fork = &Fork{}
+	var base *Message
+	for _, msg := range a {
+		addr := msg.Addr()
+		if !inB[addr] {
+			fork.Ours = append(fork.Ours, msg)
+			continue
+		}
+		// Log is sorted oldest first, so the last common message
+		// we see is the newest one
+		if base == nil || msg.Seq > base.Seq || (msg.Seq == base.Seq && addr < fork.Base) {
+			base = msg
+			fork.Base = addr
+		}
+	}
+	for _, msg := range b {
+		if !inA[msg.Addr()] {
+			fork.Theirs = append(fork.Theirs, msg)
+		}
+	}
+	return
+}
+
+// MergeStrategy decides the order of the messages on the two sides
+// of a fork.  It is given the messages from both sides, sorted by
+// address, and returns them in merged order.  A strategy must be
+// deterministic so that every node merging the same fork produces
+// the same merge message.
+type MergeStrategy func(msgs []*Message) ([]*Message, error)
+
+// ByTime orders messages by timestamp, then by address.
+func ByTime(msgs []*Message) ([]*Message, error) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if !msgs[i].Time.Equal(msgs[j].Time) {
+			return msgs[i].Time.Before(msgs[j].Time)
+		}
+		return msgs[i].Addr() < msgs[j].Addr()
+	})
+	return msgs, nil
+}
+
+// ByAuthor groups messages by author, then orders each author's
+// messages by timestamp.
+func ByAuthor(msgs []*Message) ([]*Message, error) {
+	msgs, _ = ByTime(msgs)
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Author < msgs[j].Author
+	})
+	return msgs, nil
+}
+
+// LambdaMerge returns a strategy that lets a lambda decide the order.
+// The lambda is given the encoded messages on its stream and replies
+// with their addresses in merged order, one per line.
+func LambdaMerge(lambda Lambda) MergeStrategy {
+	return func(msgs []*Message) (merged []*Message, err error) {
+		defer Return(&err)
+		byAddr := make(map[string]*Message)
+		var in bytes.Buffer
+		for _, msg := range msgs {
+			byAddr[msg.Addr()] = msg
+			in.Write(msg.Encode())
+		}
+		stream := &bufStream{Reader: &in}
+		err = lambda(nil, stream)
+		Ck(err)
+		for _, line := range strings.Split(stream.out.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			msg, ok := byAddr[line]
+			ErrnoIf(!ok, syscall.EBADMSG, "merge lambda returned unknown address %s", line)
+			merged = append(merged, msg)
+			delete(byAddr, line)
+		}
+		ErrnoIf(len(byAddr) > 0, syscall.EBADMSG, "merge lambda dropped %d messages", len(byAddr))
+		return
+	}
+}
+
+// bufStream is an in-memory io.ReadWriteCloser that reads from Reader
+// and collects writes in out.
+type bufStream struct {
+	io.Reader
+	out bytes.Buffer
+}
+
+func (b *bufStream) Write(buf []byte) (int, error) {
+	return b.out.Write(buf)
+}
+
+func (b *bufStream) Close() error {
+	return nil
+}
+
+// Merge brings the history reachable from the message at theirs into
+// the topic it belongs to.  If the local head already contains
+// theirs, Merge does nothing; if theirs contains the local head, the
+// topic fast-forwards to it.  Otherwise the timelines have forked,
+// and Merge appends a merge message whose Prev holds both heads and
+// whose body lists the addresses of the forked messages, one per
+// line, in the order chosen by strategy.  A nil strategy means ByTime.
+//
+// Subscribers receive the messages from theirs, followed by the merge
+// message if there is one.  Merge returns the new head.  If any of
+// the history it would bring in is on another topic, Merge changes
+// nothing and returns an Error with EBADMSG.
+func (s *Server) Merge(theirs string, strategy MergeStrategy) (head *Message, err error) {
+	defer Return(&err)
+	if strategy == nil {
+		strategy = ByTime
+	}
+	buf, err := s.Cache().Get(theirs)
+	Ck(err)
+	them, err := ParseMessage(buf)
+	Ck(err)
+
+	t := s.topics()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	us := t.heads[them.Topic]
+	if us == nil {
+		log, err := s.Log(theirs)
+		Ck(err)
+		err = onTopic(them.Topic, log)
+		Ck(err)
+		for _, msg := range log {
+			s.append(t, msg)
+		}
+		return them, nil
+	}
+
+	fork, err := s.DetectFork(us.Addr(), theirs)
+	Ck(err)
+	if len(fork.Theirs) == 0 {
+		// we already have everything they have
+		return us, nil
+	}
+	err = onTopic(them.Topic, fork.Theirs)
+	Ck(err)
+	if len(fork.Ours) == 0 {
+		for _, msg := range fork.Theirs {
+			s.append(t, msg)
+		}
+		return them, nil
+	}
+
+	msgs := append(append([]*Message{}, fork.Ours...), fork.Theirs...)
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Addr() < msgs[j].Addr()
+	})
+	msgs, err = strategy(msgs)
+	Ck(err)
+	var body bytes.Buffer
+	for _, msg := range msgs {
+		body.WriteString(msg.Addr() + "\n")
+	}
+
+	// everything in the merge message is derived from the two
+	// heads, so any node merging the same fork gets the same
+	// address
+	head = &Message{Topic: them.Topic, Body: body.Bytes()}
+	head.Prev = []string{us.Addr(), theirs}
+	sort.Strings(head.Prev)
+	head.Seq = us.Seq
+	if them.Seq > head.Seq {
+		head.Seq = them.Seq
+	}
+	head.Seq++
+	head.Time = us.Time
+	if them.Time.After(head.Time) {
+		head.Time = them.Time
+	}
+
+	for _, msg := range fork.Theirs {
+		s.append(t, msg)
+	}
+	s.append(t, head)
+	return
+}
+
+// onTopic returns an Error with EBADMSG unless every message in msgs
+// is on topic.  Appending one that isn't would move its topic's head.
+func onTopic(topic string, msgs []*Message) error {
+	for _, msg := range msgs {
+		if msg.Topic != topic {
+			return Error{syscall.EBADMSG, Spf("message %s is on %s, not %s", msg.Addr(), msg.Topic, topic)}
+		}
+	}
+	return nil
+}
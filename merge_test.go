@@ -0,0 +1,120 @@
+package pup
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// exchange imports every message on topic from src into dst.
+func exchange(t *testing.T, src, dst *Server, topic string) (head string) {
+	t.Helper()
+	head = src.Head(topic).Addr()
+	log, err := src.Log(head)
+	Tassert(t, err == nil, "Log: %v", err)
+	for _, msg := range log {
+		_, err = dst.Import(msg.Encode())
+		Tassert(t, err == nil, "Import: %v", err)
+	}
+	return
+}
+
+func TestMerge(t *testing.T) {
+	a := &Server{}
+	b := &Server{}
+
+	m1, err := a.Publish("/doc", []byte("one"))
+	Tassert(t, err == nil, "Publish: %v", err)
+
+	// b has nothing yet, so it fast-forwards
+	head, err := b.Merge(exchange(t, a, b, "/doc"), nil)
+	Tassert(t, err == nil, "Merge: %v", err)
+	Tassert(t, head.Addr() == m1.Addr(), "head %v", head)
+
+	// both nodes append independently
+	a2, err := a.Publish("/doc", []byte("from a"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	b2, err := b.Publish("/doc", []byte("from b"))
+	Tassert(t, err == nil, "Publish: %v", err)
+
+	aHead := exchange(t, a, b, "/doc")
+	bHead := exchange(t, b, a, "/doc")
+
+	fork, err := a.DetectFork(a2.Addr(), bHead)
+	Tassert(t, err == nil, "DetectFork: %v", err)
+	Tassert(t, fork.Diverged(), "no fork detected")
+	Tassert(t, fork.Base == m1.Addr(), "base %v", fork.Base)
+	Tassert(t, len(fork.Ours) == 1 && fork.Ours[0].Addr() == a2.Addr(), "ours %v", fork.Ours)
+	Tassert(t, len(fork.Theirs) == 1 && fork.Theirs[0].Addr() == b2.Addr(), "theirs %v", fork.Theirs)
+
+	sub, err := a.Subscribe("/doc")
+	Tassert(t, err == nil, "Subscribe: %v", err)
+	defer sub.Close()
+
+	// both sides merge and get the same merge message
+	ma, err := a.Merge(bHead, nil)
+	Tassert(t, err == nil, "Merge: %v", err)
+	mb, err := b.Merge(aHead, nil)
+	Tassert(t, err == nil, "Merge: %v", err)
+	Tassert(t, ma.Addr() == mb.Addr(), "merge mismatch:\n%s\n%s", ma.Encode(), mb.Encode())
+	Tassert(t, len(ma.Prev) == 2 && ma.Seq == 3, "merge %v", ma)
+	want := a2.Addr() + "\n" + b2.Addr() + "\n"
+	Tassert(t, string(ma.Body) == want, "body %s", ma.Body)
+
+	// subscribers see their message, then the merge
+	Tassert(t, recv(t, sub).Addr() == b2.Addr(), "expected b2")
+	Tassert(t, recv(t, sub).Addr() == ma.Addr(), "expected merge")
+
+	// merging again is a no-op
+	head, err = a.Merge(bHead, nil)
+	Tassert(t, err == nil, "Merge: %v", err)
+	Tassert(t, head.Addr() == ma.Addr(), "head %v", head)
+
+	// history that strays onto another topic is refused
+	other, err := b.Publish("/other", []byte("other"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	stray := &Message{Topic: "/new", Seq: 2, Time: other.Time, Prev: []string{other.Addr()}, Body: []byte("stray")}
+	c := &Server{}
+	for _, msg := range []*Message{other, stray} {
+		_, err = c.Import(msg.Encode())
+		Tassert(t, err == nil, "Import: %v", err)
+	}
+	_, err = c.Merge(stray.Addr(), nil)
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "stray Merge: %v", err)
+	Tassert(t, c.Head("/other") == nil && c.Head("/new") == nil, "stray Merge moved a head")
+}
+
+func TestLambdaMerge(t *testing.T) {
+	// reverse the messages
+	reverse := func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		defer Return(&err)
+		var addrs []string
+		for {
+			msg, err := ReadMessage(stream)
+			if err != nil {
+				break
+			}
+			addrs = append([]string{msg.Addr()}, addrs...)
+		}
+		for _, addr := range addrs {
+			_, err = stream.Write([]byte(addr + "\n"))
+			Ck(err)
+		}
+		return
+	}
+	s := &Server{}
+	m1, _ := s.Publish("/x", []byte("1"))
+	m2, _ := s.Publish("/y", []byte("2"))
+	msgs, err := LambdaMerge(reverse)([]*Message{m1, m2})
+	Tassert(t, err == nil, "LambdaMerge: %v", err)
+	Tassert(t, msgs[0] == m2 && msgs[1] == m1, "order %v", msgs)
+
+	drop := func(hash []byte, stream io.ReadWriteCloser) error {
+		return nil
+	}
+	_, err = LambdaMerge(drop)([]*Message{m1, m2})
+	Tassert(t, err != nil, "expected error")
+}
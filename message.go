@@ -0,0 +1,143 @@
+package pup
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// MaxBody is the largest message body a server accepts or a client
+// decodes.
+const MaxBody = 16 << 20
+
+// Message is a log message published on a topic.  The messages on a
+// topic form a hash chain: each message carries the addresses of the
+// messages that came before it, so the address of the newest message
+// is enough to reach the whole history.
+type Message struct {
+	Topic string
+	Seq   int
+	Time  time.Time
+	// Author identifies who published the message.  It may be
+	// empty.
+	Author string
+	// Sig is Author's signature of the message; see Sign.
+	Sig []byte
+	// Prev holds the addresses of the previous messages on the
+	// topic.  It is empty for the first message.
+	Prev []string
+	Body []byte
+}
+
+// Encode returns the wire and storage form of m: a block of
+// "key value" header lines, a blank line, and then the body.
+func (m *Message) Encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "topic %s\n", m.Topic)
+	fmt.Fprintf(&buf, "seq %d\n", m.Seq)
+	fmt.Fprintf(&buf, "time %s\n", m.Time.UTC().Format(time.RFC3339Nano))
+	if m.Author != "" {
+		fmt.Fprintf(&buf, "author %s\n", m.Author)
+	}
+	if len(m.Sig) > 0 {
+		fmt.Fprintf(&buf, "sig %s\n", hex.EncodeToString(m.Sig))
+	}
+	for _, prev := range m.Prev {
+		fmt.Fprintf(&buf, "prev %s\n", prev)
+	}
+	fmt.Fprintf(&buf, "len %d\n", len(m.Body))
+	buf.WriteString("\n")
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+// Addr returns the content address of m.
+func (m *Message) Addr() string {
+	return Address(m.Encode())
+}
+
+// SignedBytes returns what the author of a message signs: its topic,
+// author and body.  The server fills in Seq, Time and Prev when the
+// message is published, after the author has signed it, so the
+// signature vouches for what was said and by whom, and the hash chain
+// for where it falls in the topic's history.
+func SignedBytes(topic, author string, body []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "topic %s\nauthor %s\nlen %d\n\n", topic, author, len(body))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Sign makes id the author of m and signs it.
+func (m *Message) Sign(id *Identity) {
+	m.Author = id.Addr
+	m.Sig = id.Sign(SignedBytes(m.Topic, m.Author, m.Body))
+}
+
+// Verify checks that m is signed by its author.  An unsigned message
+// fails with EACCES.
+func (m *Message) Verify() error {
+	if len(m.Sig) == 0 {
+		return Error{syscall.EACCES, "unsigned message"}
+	}
+	return Verify(m.Author, SignedBytes(m.Topic, m.Author, m.Body), m.Sig)
+}
+
+// ParseMessage decodes a message previously produced by Encode.
+func ParseMessage(buf []byte) (m *Message, err error) {
+	return ReadMessage(bytes.NewReader(buf))
+}
+
+// ReadMessage reads one encoded message from stream.  It reads
+// exactly as many bytes as the message occupies, so it can be called
+// repeatedly on a stream carrying several messages.
+func ReadMessage(stream io.Reader) (m *Message, err error) {
+	defer Return(&err)
+	m = &Message{}
+	n := -1
+	for {
+		line, err := Readline(stream, 1024)
+		Ck(err)
+		if len(line) == 0 {
+			break
+		}
+		parts := strings.SplitN(string(line), " ", 2)
+		ErrnoIf(len(parts) != 2, syscall.EBADMSG, "malformed header line: %q", line)
+		key, val := parts[0], parts[1]
+		switch key {
+		case "topic":
+			m.Topic = val
+		case "seq":
+			m.Seq, err = strconv.Atoi(val)
+			Ck(err)
+		case "time":
+			m.Time, err = time.Parse(time.RFC3339Nano, val)
+			Ck(err)
+		case "author":
+			m.Author = val
+		case "sig":
+			m.Sig, err = hex.DecodeString(val)
+			Ck(err)
+		case "prev":
+			m.Prev = append(m.Prev, val)
+		case "len":
+			n, err = strconv.Atoi(val)
+			Ck(err)
+		default:
+			ErrnoIf(true, syscall.EBADMSG, "unknown header field: %q", key)
+		}
+	}
+	ErrnoIf(n < 0, syscall.EBADMSG, "missing len header")
+	ErrnoIf(n > MaxBody, syscall.EMSGSIZE, "message body of %d bytes is over %d", n, MaxBody)
+	m.Body = make([]byte, n)
+	_, err = io.ReadFull(stream, m.Body)
+	Ck(err)
+	return
+}
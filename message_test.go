@@ -0,0 +1,40 @@
+package pup
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestMessage(t *testing.T) {
+	m := &Message{
+		Topic: "/a/b",
+		Seq:   2,
+		Time:  time.Now(),
+		Prev:  []string{Address([]byte("prev"))},
+		Body:  []byte("hello\nworld\n"),
+	}
+	buf := m.Encode()
+	got, err := ParseMessage(buf)
+	Tassert(t, err == nil, "ParseMessage: %v", err)
+	Tassert(t, got.Topic == m.Topic && got.Seq == m.Seq, "got %v", got)
+	Tassert(t, got.Time.Equal(m.Time), "time %v", got.Time)
+	Tassert(t, len(got.Prev) == 1 && got.Prev[0] == m.Prev[0], "prev %v", got.Prev)
+	Tassert(t, string(got.Body) == string(m.Body), "body '%v'", string(got.Body))
+	Tassert(t, got.Addr() == m.Addr(), "addr mismatch")
+
+	// messages are self-delimiting
+	stream := bytes.NewReader(append(m.Encode(), m.Encode()...))
+	for i := 0; i < 2; i++ {
+		got, err = ReadMessage(stream)
+		Tassert(t, err == nil, "ReadMessage: %v", err)
+		Tassert(t, got.Addr() == m.Addr(), "addr mismatch")
+	}
+	_, err = ReadMessage(stream)
+	Tassert(t, err != nil, "expected EOF")
+
+	_, err = ParseMessage([]byte("bogus\n\n"))
+	Tassert(t, err != nil, "expected error")
+}
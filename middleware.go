@@ -0,0 +1,166 @@
+package pup
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Middleware wraps a Handler in another, which can look at the
+// request before passing it on, refuse it, or look at the result.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware to the global chain, which wraps the handler of
+// every hash.  Middleware wraps everything added after it: the global
+// chain runs first, in the order added, then the hash's own chain (see
+// UseFor), then the handler.  Middleware runs after the server has
+// authenticated the stream and checked its limits.
+func (s *Server) Use(mw ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middleware = append(s.middleware, mw...)
+}
+
+// UseFor adds middleware to the chain of hash; see Use.
+func (s *Server) UseFor(hash string, mw ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hashware == nil {
+		s.hashware = make(map[string][]Middleware)
+	}
+	s.hashware[hash] = append(s.hashware[hash], mw...)
+}
+
+// chain wraps h in the middleware for hash.
+func (s *Server) chain(hash string, h Handler) Handler {
+	if h == nil {
+		return nil
+	}
+	s.mu.Lock()
+	mw := append(append([]Middleware{}, s.middleware...), s.hashware[hash]...)
+	s.mu.Unlock()
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Logging logs each stream when it ends, with its caller, how long it
+// took and the error, if any, to Request.Log.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, req *Request) (err error) {
+			defer func() {
+				who := req.Identity
+				if who == "" {
+					who = "-"
+				}
+				req.Log.Printf("%s %v %v", who, time.Since(req.Start).Round(time.Millisecond), err)
+			}()
+			return next.ServeStream(ctx, req)
+		})
+	}
+}
+
+// Recover turns a panic in the handlers it wraps into an error.  The
+// server recovers from panics anyway (see Panics); Recover lets the
+// middleware outside it see the error.  The errno is EIO unless the
+// panic value is an error that wraps one.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, req *Request) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = panicError(r)
+					req.Log.Printf("panic: %v", r)
+				}
+			}()
+			return next.ServeStream(ctx, req)
+		})
+	}
+}
+
+// panicError returns the error for a recovered panic value r.
+func panicError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			return panicked{err}
+		}
+		return panicked{Error{syscall.EIO, Spf("panic: %v", err)}}
+	}
+	return panicked{Error{syscall.EIO, Spf("panic: %v", r)}}
+}
+
+// panicked marks the error for a recovered panic, so that the server
+// sends the caller an error reply for it.
+type panicked struct {
+	error
+}
+
+func (p panicked) Unwrap() error {
+	return p.error
+}
+
+// Stat is what Metrics has counted for one hash.
+type Stat struct {
+	Hash string
+	// Calls is how many streams have started, Errors how many of
+	// them ended with an error, and Open how many are still open.
+	Calls, Errors, Open int
+	// Time is the total time the ended streams took.
+	Time time.Duration
+}
+
+// Metrics counts the streams of each hash.  Add its Middleware to a
+// server with Use.
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[string]*Stat
+}
+
+// Middleware returns the middleware that counts streams for m.
+func (m *Metrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, req *Request) (err error) {
+			m.mu.Lock()
+			if m.stats == nil {
+				m.stats = make(map[string]*Stat)
+			}
+			st := m.stats[req.Hash]
+			if st == nil {
+				st = &Stat{Hash: req.Hash}
+				m.stats[req.Hash] = st
+			}
+			st.Calls++
+			st.Open++
+			m.mu.Unlock()
+			defer func() {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				st.Open--
+				st.Time += time.Since(req.Start)
+				if err != nil {
+					st.Errors++
+				}
+			}()
+			return next.ServeStream(ctx, req)
+		})
+	}
+}
+
+// Stats returns the counts for every hash, sorted by hash.
+func (m *Metrics) Stats() (res []Stat) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, st := range m.stats {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Hash < res[j].Hash })
+	return
+}
@@ -0,0 +1,96 @@
+package pup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestMiddleware(t *testing.T) {
+	logbuf := &bytes.Buffer{}
+	s := &Server{Logger: log.New(logbuf, "", 0)}
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, req *Request) error {
+				order = append(order, name)
+				return next.ServeStream(ctx, req)
+			})
+		}
+	}
+	s.Register("sha256:aa", func(hash []byte, stream io.ReadWriteCloser) error {
+		order = append(order, "lambda")
+		_, err := stream.Write([]byte("ok"))
+		return err
+	})
+	s.Register("sha256:bb", func(hash []byte, stream io.ReadWriteCloser) error {
+		panic("oops")
+	})
+	s.Register("sha256:cc", func(hash []byte, stream io.ReadWriteCloser) error {
+		return Error{syscall.EPERM, "no"}
+	})
+	metrics := &Metrics{}
+	s.Use(trace("a"), Recover())
+	s.UseFor("sha256:aa", trace("c"))
+	s.Use(trace("b"), metrics.Middleware(), Logging())
+
+	call := func(hash string) (reply string, readErr, err error) {
+		client, server := net.Pipe()
+		done := make(chan error)
+		go func() {
+			err := s.handleStream(server)
+			server.Close()
+			done <- err
+		}()
+		client.Write([]byte(hash + "\n"))
+		buf, readErr := io.ReadAll(&replyConn{Conn: client})
+		return string(buf), readErr, <-done
+	}
+
+	// global middleware runs first, in the order added, then the
+	// hash's own
+	reply, _, err := call("sha256:aa")
+	Tassert(t, err == nil && reply == "ok", "call: %v '%s'", err, reply)
+	Tassert(t, strings.Join(order, " ") == "a b c lambda", "order: %v", order)
+	Tassert(t, strings.HasPrefix(logbuf.String(), "sha256:aa pipe - "), "log: %q", logbuf.String())
+
+	// other hashes don't get sha256:aa's middleware
+	order = nil
+	_, readErr, err := call("sha256:cc")
+	Tassert(t, errors.Is(err, syscall.EPERM) && readErr == nil, "error: %v %v", err, readErr)
+	Tassert(t, strings.Join(order, " ") == "a b", "order: %v", order)
+
+	// Recover turns a panic into an error reply
+	_, readErr, err = call("sha256:bb")
+	Tassert(t, errors.Is(err, syscall.EIO) && errors.Is(readErr, syscall.EIO), "panic: %v %v", err, readErr)
+	Tassert(t, strings.Contains(logbuf.String(), "panic: oops"), "log: %q", logbuf.String())
+
+	// Dereference wraps the lambda too
+	order = nil
+	err = s.Dereference("sha256:aa")([]byte("sha256:aa"), &MockReadWriteCloser{})
+	Tassert(t, err == nil, "Dereference: %v", err)
+	Tassert(t, strings.Join(order, " ") == "a b c lambda", "order: %v", order)
+
+	// and so does Registrations
+	for _, reg := range s.Registrations() {
+		if reg.Hash == "sha256:aa" {
+			order = nil
+			err = reg.Lambda([]byte(reg.Hash), &MockReadWriteCloser{})
+			Tassert(t, err == nil, "Registrations: %v", err)
+			Tassert(t, strings.Join(order, " ") == "a b c lambda", "order: %v", order)
+		}
+	}
+
+	stats := metrics.Stats()
+	Tassert(t, len(stats) == 3, "stats: %v", stats)
+	Tassert(t, stats[0].Hash == "sha256:aa" && stats[0].Calls == 3 && stats[0].Errors == 0 && stats[0].Open == 0, "stats: %v", stats[0])
+	Tassert(t, stats[2].Hash == "sha256:cc" && stats[2].Calls == 1 && stats[2].Errors == 1, "stats: %v", stats[2])
+}
@@ -0,0 +1,252 @@
+package ninep
+
+import (
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Client is a minimal 9P2000 client.  It sends one request at a time.
+type Client struct {
+	rw      io.ReadWriteCloser
+	mu      sync.Mutex
+	msize   uint32
+	nextfid uint32
+	root    uint32
+}
+
+// NewClient negotiates the protocol version on rw and attaches to
+// the root of the served tree as uname.
+func NewClient(rw io.ReadWriteCloser, uname string) (c *Client, err error) {
+	defer Return(&err)
+	c = &Client{rw: rw, msize: MaxMsize, nextfid: 1}
+	rep, err := c.rpc(&Fcall{Type: Tversion, Tag: NOTAG, Msize: MaxMsize, Version: Version})
+	Ck(err)
+	ErrnoIf(rep.Version != Version, syscall.EPROTONOSUPPORT, "server speaks %q", rep.Version)
+	ErrnoIf(rep.Msize < MinMsize || rep.Msize > MaxMsize, syscall.EMSGSIZE, "server msize %d", rep.Msize)
+	c.msize = rep.Msize
+	c.root = c.newfid()
+	_, err = c.rpc(&Fcall{Type: Tattach, Fid: c.root, Afid: NOFID, Uname: uname})
+	Ck(err)
+	return
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.rw.Close()
+}
+
+func (c *Client) newfid() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fid := c.nextfid
+	c.nextfid++
+	return fid
+}
+
+// rpc sends req and waits for its reply.  An Rerror reply is
+// returned as an error carrying the matching errno when there is
+// one.
+func (c *Client) rpc(req *Fcall) (rep *Fcall, err error) {
+	defer Return(&err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.rw.Write(req.Bytes())
+	Ck(err)
+	rep, err = ReadFcall(c.rw)
+	Ck(err)
+	if rep.Type == Rerror {
+		return nil, ename(rep.Ename)
+	}
+	ErrnoIf(rep.Type != req.Type+1, syscall.EBADMSG, "reply type %d to request type %d", rep.Type, req.Type)
+	return
+}
+
+// ename maps a 9P error string back to an errno if it names one.
+func ename(msg string) error {
+	for i := syscall.Errno(1); i < 256; i++ {
+		if i.Error() == msg {
+			return i
+		}
+	}
+	return &remoteError{msg}
+}
+
+type remoteError struct {
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+// walk returns a new fid for name, relative to the root.
+func (c *Client) walk(name string) (fid uint32, err error) {
+	defer Return(&err)
+	var elems []string
+	name = path.Clean("/" + name)
+	if name != "/" {
+		elems = strings.Split(name[1:], "/")
+	}
+	fid = c.newfid()
+	rep, err := c.rpc(&Fcall{Type: Twalk, Fid: c.root, Newfid: fid, Wname: elems})
+	Ck(err)
+	ErrnoIf(len(rep.Wqid) != len(elems), syscall.ENOENT, name)
+	return
+}
+
+// RemoteFile is an open file on the server.
+type RemoteFile struct {
+	c      *Client
+	fid    uint32
+	offset uint64
+	iounit uint32
+}
+
+// Open opens name with the given 9P open mode.
+func (c *Client) Open(name string, mode uint8) (f *RemoteFile, err error) {
+	defer Return(&err)
+	fid, err := c.walk(name)
+	Ck(err)
+	rep, err := c.rpc(&Fcall{Type: Topen, Fid: fid, Mode: mode})
+	if err != nil {
+		c.clunk(fid)
+		Ck(err)
+	}
+	return c.file(fid, rep.Iounit), nil
+}
+
+// Create creates and opens name in its parent directory.
+func (c *Client) Create(name string, perm uint32, mode uint8) (f *RemoteFile, err error) {
+	defer Return(&err)
+	fid, err := c.walk(path.Dir(path.Clean("/" + name)))
+	Ck(err)
+	rep, err := c.rpc(&Fcall{Type: Tcreate, Fid: fid, Name: path.Base(name), Perm: perm, Mode: mode})
+	if err != nil {
+		c.clunk(fid)
+		Ck(err)
+	}
+	return c.file(fid, rep.Iounit), nil
+}
+
+func (c *Client) file(fid, iounit uint32) *RemoteFile {
+	if iounit == 0 || iounit > c.msize-IOHDRSZ {
+		iounit = c.msize - IOHDRSZ
+	}
+	return &RemoteFile{c: c, fid: fid, iounit: iounit}
+}
+
+func (c *Client) clunk(fid uint32) error {
+	_, err := c.rpc(&Fcall{Type: Tclunk, Fid: fid})
+	return err
+}
+
+// Read implements io.Reader.
+func (f *RemoteFile) Read(buf []byte) (n int, err error) {
+	count := uint32(len(buf))
+	if count > f.iounit {
+		count = f.iounit
+	}
+	rep, err := f.c.rpc(&Fcall{Type: Tread, Fid: f.fid, Offset: f.offset, Count: count})
+	if err != nil {
+		return 0, err
+	}
+	if len(rep.Data) == 0 && count > 0 {
+		return 0, io.EOF
+	}
+	n = copy(buf, rep.Data)
+	f.offset += uint64(n)
+	return
+}
+
+// Write implements io.Writer.
+func (f *RemoteFile) Write(buf []byte) (n int, err error) {
+	for len(buf) > 0 {
+		chunk := buf
+		if uint32(len(chunk)) > f.iounit {
+			chunk = chunk[:f.iounit]
+		}
+		rep, err := f.c.rpc(&Fcall{Type: Twrite, Fid: f.fid, Offset: f.offset, Data: chunk})
+		if err != nil {
+			return n, err
+		}
+		n += int(rep.Count)
+		f.offset += uint64(rep.Count)
+		buf = buf[rep.Count:]
+	}
+	return
+}
+
+// Close clunks the file.
+func (f *RemoteFile) Close() error {
+	return f.c.clunk(f.fid)
+}
+
+// ReadFile returns the content of name.
+func (c *Client) ReadFile(name string) (buf []byte, err error) {
+	defer Return(&err)
+	f, err := c.Open(name, OREAD)
+	Ck(err)
+	defer f.Close()
+	buf, err = io.ReadAll(f)
+	Ck(err)
+	return
+}
+
+// WriteFile creates name and writes buf to it.
+func (c *Client) WriteFile(name string, buf []byte) (err error) {
+	defer Return(&err)
+	f, err := c.Create(name, 0644, OWRITE)
+	Ck(err)
+	_, err = f.Write(buf)
+	if err != nil {
+		f.Close()
+		Ck(err)
+	}
+	err = f.Close()
+	Ck(err)
+	return
+}
+
+// ReadDir returns the entries of directory name.
+func (c *Client) ReadDir(name string) (entries []Stat, err error) {
+	defer Return(&err)
+	f, err := c.Open(name, OREAD)
+	Ck(err)
+	defer f.Close()
+	// the server only returns whole entries, so always offer it a
+	// full-sized buffer
+	chunk := make([]byte, f.iounit)
+	for {
+		n, err := f.Read(chunk)
+		if err == io.EOF {
+			break
+		}
+		Ck(err)
+		buf := chunk[:n]
+		for len(buf) > 0 {
+			var st Stat
+			st, buf, err = UnmarshalStat(buf)
+			Ck(err)
+			entries = append(entries, st)
+		}
+	}
+	return
+}
+
+// Stat returns the stat entry for name.
+func (c *Client) Stat(name string) (st Stat, err error) {
+	defer Return(&err)
+	fid, err := c.walk(name)
+	Ck(err)
+	defer c.clunk(fid)
+	rep, err := c.rpc(&Fcall{Type: Tstat, Fid: fid})
+	Ck(err)
+	st, _, err = UnmarshalStat(rep.Stat)
+	Ck(err)
+	return
+}
@@ -0,0 +1,386 @@
+// Package ninep implements enough of the 9P2000 protocol to serve an
+// io/fs filesystem, plus a small client for talking to such a server.
+package ninep
+
+import (
+	"encoding/binary"
+	"io"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// message types
+const (
+	Tversion = 100 + iota
+	Rversion
+	Tauth
+	Rauth
+	Tattach
+	Rattach
+	Terror // never sent
+	Rerror
+	Tflush
+	Rflush
+	Twalk
+	Rwalk
+	Topen
+	Ropen
+	Tcreate
+	Rcreate
+	Tread
+	Rread
+	Twrite
+	Rwrite
+	Tclunk
+	Rclunk
+	Tremove
+	Rremove
+	Tstat
+	Rstat
+	Twstat
+	Rwstat
+)
+
+// open modes
+const (
+	OREAD  = 0
+	OWRITE = 1
+	ORDWR  = 2
+	OEXEC  = 3
+	OTRUNC = 0x10
+)
+
+// qid types and mode bits
+const (
+	QTDIR  = 0x80
+	QTFILE = 0x00
+	DMDIR  = 0x80000000
+)
+
+const (
+	NOTAG   = 0xffff
+	NOFID   = 0xffffffff
+	Version = "9P2000"
+	// MaxMsize is the largest message size we negotiate, and
+	// MinMsize the smallest we accept.
+	MaxMsize = 64 * 1024
+	MinMsize = IOHDRSZ + 256
+	// IOHDRSZ is the size of the Rread/Twrite header.
+	IOHDRSZ = 24
+)
+
+// Qid is the server's unique identification of a file.
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// Stat is the 9P2000 directory entry.
+type Stat struct {
+	Type   uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length uint64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+}
+
+// Fcall is one 9P message.  Only the fields used by Type are
+// meaningful.
+type Fcall struct {
+	Type    uint8
+	Tag     uint16
+	Fid     uint32
+	Afid    uint32
+	Newfid  uint32
+	Msize   uint32
+	Version string
+	Uname   string
+	Aname   string
+	Ename   string
+	Oldtag  uint16
+	Wname   []string
+	Wqid    []Qid
+	Qid     Qid
+	Mode    uint8
+	Perm    uint32
+	Name    string
+	Iounit  uint32
+	Offset  uint64
+	Count   uint32
+	Data    []byte
+	Stat    []byte
+}
+
+// encoder appends little-endian 9P fields to buf.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u8(v uint8) { e.buf = append(e.buf, v) }
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) qid(q Qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+// decoder consumes little-endian 9P fields from buf.  A short buffer
+// panics with EBADMSG; callers recover with Return.
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) take(n int) []byte {
+	ErrnoIf(len(d.buf) < n, syscall.EBADMSG, "short 9P message")
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8   { return d.take(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.take(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+
+func (d *decoder) str() string {
+	n := d.u16()
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) qid() (q Qid) {
+	q.Type = d.u8()
+	q.Version = d.u32()
+	q.Path = d.u64()
+	return
+}
+
+// Bytes returns the wire form of st, including its leading size.
+func (st *Stat) Bytes() []byte {
+	e := &encoder{}
+	e.u16(0) // size, filled in below
+	e.u16(st.Type)
+	e.u32(st.Dev)
+	e.qid(st.Qid)
+	e.u32(st.Mode)
+	e.u32(st.Atime)
+	e.u32(st.Mtime)
+	e.u64(st.Length)
+	e.str(st.Name)
+	e.str(st.Uid)
+	e.str(st.Gid)
+	e.str(st.Muid)
+	binary.LittleEndian.PutUint16(e.buf, uint16(len(e.buf)-2))
+	return e.buf
+}
+
+// UnmarshalStat decodes one stat entry from the front of buf and
+// returns it along with the bytes that follow it.
+func UnmarshalStat(buf []byte) (st Stat, rest []byte, err error) {
+	defer Return(&err)
+	d := &decoder{buf: buf}
+	n := d.u16()
+	d = &decoder{buf: d.take(int(n))}
+	rest = buf[2+int(n):]
+	st.Type = d.u16()
+	st.Dev = d.u32()
+	st.Qid = d.qid()
+	st.Mode = d.u32()
+	st.Atime = d.u32()
+	st.Mtime = d.u32()
+	st.Length = d.u64()
+	st.Name = d.str()
+	st.Uid = d.str()
+	st.Gid = d.str()
+	st.Muid = d.str()
+	return
+}
+
+// Bytes returns the wire form of f, including its leading size.
+func (f *Fcall) Bytes() []byte {
+	e := &encoder{}
+	e.u32(0) // size, filled in below
+	e.u8(f.Type)
+	e.u16(f.Tag)
+	switch f.Type {
+	case Tversion, Rversion:
+		e.u32(f.Msize)
+		e.str(f.Version)
+	case Tauth:
+		e.u32(f.Afid)
+		e.str(f.Uname)
+		e.str(f.Aname)
+	case Rauth, Rattach:
+		e.qid(f.Qid)
+	case Tattach:
+		e.u32(f.Fid)
+		e.u32(f.Afid)
+		e.str(f.Uname)
+		e.str(f.Aname)
+	case Rerror:
+		e.str(f.Ename)
+	case Tflush:
+		e.u16(f.Oldtag)
+	case Twalk:
+		e.u32(f.Fid)
+		e.u32(f.Newfid)
+		e.u16(uint16(len(f.Wname)))
+		for _, name := range f.Wname {
+			e.str(name)
+		}
+	case Rwalk:
+		e.u16(uint16(len(f.Wqid)))
+		for _, q := range f.Wqid {
+			e.qid(q)
+		}
+	case Topen:
+		e.u32(f.Fid)
+		e.u8(f.Mode)
+	case Ropen, Rcreate:
+		e.qid(f.Qid)
+		e.u32(f.Iounit)
+	case Tcreate:
+		e.u32(f.Fid)
+		e.str(f.Name)
+		e.u32(f.Perm)
+		e.u8(f.Mode)
+	case Tread:
+		e.u32(f.Fid)
+		e.u64(f.Offset)
+		e.u32(f.Count)
+	case Rread:
+		e.u32(uint32(len(f.Data)))
+		e.buf = append(e.buf, f.Data...)
+	case Twrite:
+		e.u32(f.Fid)
+		e.u64(f.Offset)
+		e.u32(uint32(len(f.Data)))
+		e.buf = append(e.buf, f.Data...)
+	case Rwrite:
+		e.u32(f.Count)
+	case Tclunk, Tremove, Tstat:
+		e.u32(f.Fid)
+	case Rstat:
+		e.u16(uint16(len(f.Stat)))
+		e.buf = append(e.buf, f.Stat...)
+	case Twstat:
+		e.u32(f.Fid)
+		e.u16(uint16(len(f.Stat)))
+		e.buf = append(e.buf, f.Stat...)
+	case Rflush, Rclunk, Rremove, Rwstat:
+	}
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// ReadFcall reads one message from r.
+func ReadFcall(r io.Reader) (f *Fcall, err error) {
+	defer Return(&err)
+	var size [4]byte
+	_, err = io.ReadFull(r, size[:])
+	Ck(err)
+	n := binary.LittleEndian.Uint32(size[:])
+	ErrnoIf(n < 7 || n > MaxMsize+IOHDRSZ, syscall.EMSGSIZE, "bad 9P message size %d", n)
+	buf := make([]byte, n-4)
+	_, err = io.ReadFull(r, buf)
+	Ck(err)
+	d := &decoder{buf: buf}
+	f = &Fcall{}
+	f.Type = d.u8()
+	f.Tag = d.u16()
+	switch f.Type {
+	case Tversion, Rversion:
+		f.Msize = d.u32()
+		f.Version = d.str()
+	case Tauth:
+		f.Afid = d.u32()
+		f.Uname = d.str()
+		f.Aname = d.str()
+	case Rauth, Rattach:
+		f.Qid = d.qid()
+	case Tattach:
+		f.Fid = d.u32()
+		f.Afid = d.u32()
+		f.Uname = d.str()
+		f.Aname = d.str()
+	case Rerror:
+		f.Ename = d.str()
+	case Tflush:
+		f.Oldtag = d.u16()
+	case Twalk:
+		f.Fid = d.u32()
+		f.Newfid = d.u32()
+		n := d.u16()
+		for i := 0; i < int(n); i++ {
+			f.Wname = append(f.Wname, d.str())
+		}
+	case Rwalk:
+		n := d.u16()
+		for i := 0; i < int(n); i++ {
+			f.Wqid = append(f.Wqid, d.qid())
+		}
+	case Topen:
+		f.Fid = d.u32()
+		f.Mode = d.u8()
+	case Ropen, Rcreate:
+		f.Qid = d.qid()
+		f.Iounit = d.u32()
+	case Tcreate:
+		f.Fid = d.u32()
+		f.Name = d.str()
+		f.Perm = d.u32()
+		f.Mode = d.u8()
+	case Tread:
+		f.Fid = d.u32()
+		f.Offset = d.u64()
+		f.Count = d.u32()
+	case Rread:
+		n := d.u32()
+		f.Data = d.take(int(n))
+	case Twrite:
+		f.Fid = d.u32()
+		f.Offset = d.u64()
+		n := d.u32()
+		f.Data = d.take(int(n))
+	case Rwrite:
+		f.Count = d.u32()
+	case Tclunk, Tremove, Tstat:
+		f.Fid = d.u32()
+	case Rstat:
+		n := d.u16()
+		f.Stat = d.take(int(n))
+	case Twstat:
+		f.Fid = d.u32()
+		n := d.u16()
+		f.Stat = d.take(int(n))
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		ErrnoIf(true, syscall.EBADMSG, "unknown 9P message type %d", f.Type)
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package ninep
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestFcall(t *testing.T) {
+	st := Stat{Qid: Qid{Type: QTDIR, Path: 42}, Mode: DMDIR | 0555, Name: "dir", Uid: "u", Gid: "g", Muid: "m"}
+	cases := []*Fcall{
+		{Type: Tversion, Tag: NOTAG, Msize: 8192, Version: Version},
+		{Type: Tattach, Tag: 1, Fid: 0, Afid: NOFID, Uname: "me", Aname: ""},
+		{Type: Twalk, Tag: 2, Fid: 0, Newfid: 1, Wname: []string{"a", "b"}},
+		{Type: Rwalk, Tag: 2, Wqid: []Qid{{Type: QTDIR, Path: 1}, {Path: 2}}},
+		{Type: Tcreate, Tag: 3, Fid: 1, Name: "x", Perm: 0644, Mode: OWRITE},
+		{Type: Twrite, Tag: 4, Fid: 1, Offset: 10, Data: []byte("hello")},
+		{Type: Rread, Tag: 5, Data: []byte("world")},
+		{Type: Rstat, Tag: 6, Stat: st.Bytes()},
+		{Type: Rerror, Tag: 7, Ename: "no such file or directory"},
+	}
+	for _, want := range cases {
+		got, err := ReadFcall(bytes.NewReader(want.Bytes()))
+		Tassert(t, err == nil, "ReadFcall: %v", err)
+		if want.Type == Twrite || want.Type == Rread {
+			want.Count = got.Count
+		}
+		Tassert(t, reflect.DeepEqual(got, want), "wanted %#v got %#v", want, got)
+	}
+
+	got, rest, err := UnmarshalStat(st.Bytes())
+	Tassert(t, err == nil, "UnmarshalStat: %v", err)
+	Tassert(t, len(rest) == 0, "rest %v", rest)
+	Tassert(t, reflect.DeepEqual(got, st), "wanted %#v got %#v", st, got)
+
+	_, err = ReadFcall(bytes.NewReader([]byte{9, 0, 0, 0, Twalk, 0, 0, 1, 0}))
+	Tassert(t, err != nil, "expected error for short message")
+}
@@ -0,0 +1,388 @@
+package ninep
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// File is a file opened for writing, or for reading and writing.
+type File interface {
+	fs.File
+	io.Writer
+}
+
+// Server serves FS over 9P2000.  Walks, reads and stats go to FS.
+// Writes need OpenFile: Tcreate and Topen with a write mode call it
+// with os.O_WRONLY or os.O_RDWR, plus os.O_CREATE for Tcreate.
+// Without OpenFile the tree is read-only.
+type Server struct {
+	FS       fs.FS
+	OpenFile func(name string, flag int) (File, error)
+	// Uid is reported as the owner of every file.
+	Uid string
+}
+
+// Serve accepts connections on l and serves each one in its own
+// goroutine.  It returns when l.Accept fails.
+func (s *Server) Serve(l net.Listener) (err error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := s.ServeConn(conn)
+			if err != nil && !errors.Is(err, io.EOF) {
+				Pl("9p:", err.Error())
+			}
+		}()
+	}
+}
+
+// fid is the server-side state of a client fid.
+type fid struct {
+	path   string
+	file   fs.File
+	wfile  File
+	isdir  bool
+	dirbuf []byte
+	// diroff is where the last directory read ended; the next one
+	// must start there or at 0
+	diroff uint64
+	pos    int64
+}
+
+// conn is the state of one client connection.
+type conn struct {
+	srv   *Server
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+// ServeConn serves 9P on a single connection until it is closed.
+// Requests are handled in the order they arrive.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	defer rw.Close()
+	c := &conn{srv: s, msize: MaxMsize, fids: make(map[uint32]*fid)}
+	defer c.clunkAll()
+	for {
+		req, err := ReadFcall(rw)
+		Ck(err)
+		rep := c.handle(req)
+		rep.Tag = req.Tag
+		_, err = rw.Write(rep.Bytes())
+		Ck(err)
+	}
+}
+
+func (c *conn) clunkAll() {
+	for _, f := range c.fids {
+		f.close()
+	}
+}
+
+func (f *fid) close() (err error) {
+	if f.wfile != nil {
+		err = f.wfile.Close()
+	} else if f.file != nil {
+		err = f.file.Close()
+	}
+	f.file = nil
+	f.wfile = nil
+	return
+}
+
+// handle dispatches one request and returns the reply.  Errors from
+// the handlers become Rerror replies.
+func (c *conn) handle(req *Fcall) (rep *Fcall) {
+	var err error
+	rep, err = c.dispatch(req)
+	if err != nil {
+		return &Fcall{Type: Rerror, Ename: errMsg(err)}
+	}
+	return
+}
+
+// errMsg turns err into a 9P error string, preferring the plain errno
+// text so clients can map it back to an errno.
+func errMsg(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno.Error()
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT.Error()
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EPERM.Error()
+	}
+	return err.Error()
+}
+
+// iounit is the most data a Rread or Twrite can carry.  Tversion
+// keeps msize from going under MinMsize, so it can't underflow.
+func (c *conn) iounit() uint32 {
+	return c.msize - IOHDRSZ
+}
+
+func (c *conn) fid(n uint32) *fid {
+	f, ok := c.fids[n]
+	ErrnoIf(!ok, syscall.EBADF, "unknown fid %d", n)
+	return f
+}
+
+func (c *conn) dispatch(req *Fcall) (rep *Fcall, err error) {
+	defer Return(&err)
+	switch req.Type {
+	case Tversion:
+		msize := req.Msize
+		ErrnoIf(msize < MinMsize, syscall.EMSGSIZE, "msize %d is under %d", msize, MinMsize)
+		if msize > MaxMsize {
+			msize = MaxMsize
+		}
+		c.msize = msize
+		version := Version
+		if req.Version != Version {
+			version = "unknown"
+		}
+		for _, f := range c.fids {
+			f.close()
+		}
+		c.fids = make(map[uint32]*fid)
+		return &Fcall{Type: Rversion, Msize: msize, Version: version}, nil
+	case Tauth:
+		ErrnoIf(true, syscall.EOPNOTSUPP, "authentication not required")
+	case Tattach:
+		_, ok := c.fids[req.Fid]
+		ErrnoIf(ok, syscall.EBADF, "fid %d in use", req.Fid)
+		qid, _, err := c.stat(".")
+		Ck(err)
+		c.fids[req.Fid] = &fid{path: "."}
+		return &Fcall{Type: Rattach, Qid: qid}, nil
+	case Tflush:
+		return &Fcall{Type: Rflush}, nil
+	case Twalk:
+		return c.walk(req)
+	case Topen:
+		return c.open(req)
+	case Tcreate:
+		return c.create(req)
+	case Tread:
+		return c.read(req)
+	case Twrite:
+		f := c.fid(req.Fid)
+		ErrnoIf(f.wfile == nil, syscall.EBADF, "fid not open for writing")
+		n, err := f.wfile.Write(req.Data)
+		Ck(err)
+		return &Fcall{Type: Rwrite, Count: uint32(n)}, nil
+	case Tclunk:
+		f := c.fid(req.Fid)
+		delete(c.fids, req.Fid)
+		err = f.close()
+		Ck(err)
+		return &Fcall{Type: Rclunk}, nil
+	case Tremove:
+		f := c.fid(req.Fid)
+		delete(c.fids, req.Fid)
+		f.close()
+		ErrnoIf(true, syscall.EPERM, "remove not supported")
+	case Tstat:
+		f := c.fid(req.Fid)
+		_, st, err := c.stat(f.path)
+		Ck(err)
+		return &Fcall{Type: Rstat, Stat: st.Bytes()}, nil
+	case Twstat:
+		// accept and ignore, so that e.g. truncating a file
+		// before writing it does not fail
+		c.fid(req.Fid)
+		return &Fcall{Type: Rwstat}, nil
+	}
+	ErrnoIf(true, syscall.EOPNOTSUPP, "unsupported 9P message type %d", req.Type)
+	return
+}
+
+// stat returns the qid and stat entry for name.
+func (c *conn) stat(name string) (qid Qid, st Stat, err error) {
+	defer Return(&err)
+	fi, err := fs.Stat(c.srv.FS, name)
+	Ck(err)
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	qid.Path = h.Sum64()
+	st.Name = fi.Name()
+	if name == "." {
+		st.Name = "/"
+	}
+	st.Mode = uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		qid.Type = QTDIR
+		st.Mode |= DMDIR
+	} else {
+		st.Length = uint64(fi.Size())
+	}
+	st.Qid = qid
+	st.Mtime = uint32(fi.ModTime().Unix())
+	st.Atime = st.Mtime
+	st.Uid = c.srv.Uid
+	st.Gid = c.srv.Uid
+	st.Muid = c.srv.Uid
+	return
+}
+
+func (c *conn) walk(req *Fcall) (rep *Fcall, err error) {
+	defer Return(&err)
+	f := c.fid(req.Fid)
+	ErrnoIf(f.file != nil || f.wfile != nil, syscall.EBADF, "walk from open fid")
+	if req.Newfid != req.Fid {
+		_, ok := c.fids[req.Newfid]
+		ErrnoIf(ok, syscall.EBADF, "fid %d in use", req.Newfid)
+	}
+	rep = &Fcall{Type: Rwalk}
+	name := f.path
+	for i, elem := range req.Wname {
+		next := path.Join(name, elem)
+		if next == ".." || (len(next) > 2 && next[:3] == "../") {
+			next = "."
+		}
+		qid, _, err := c.stat(next)
+		if err != nil {
+			// a partial walk is not an error, but the fid
+			// isn't moved
+			if i == 0 {
+				Ck(err)
+			}
+			return rep, nil
+		}
+		rep.Wqid = append(rep.Wqid, qid)
+		name = next
+	}
+	c.fids[req.Newfid] = &fid{path: name}
+	return
+}
+
+func (c *conn) open(req *Fcall) (rep *Fcall, err error) {
+	defer Return(&err)
+	f := c.fid(req.Fid)
+	ErrnoIf(f.file != nil || f.wfile != nil, syscall.EBADF, "fid already open")
+	qid, st, err := c.stat(f.path)
+	Ck(err)
+	switch req.Mode &^ OTRUNC {
+	case OREAD, OEXEC:
+		f.file, err = c.srv.FS.Open(f.path)
+		Ck(err)
+		if st.Mode&DMDIR != 0 {
+			f.isdir = true
+			err = c.readDir(f)
+			Ck(err)
+		}
+	case OWRITE, ORDWR:
+		ErrnoIf(st.Mode&DMDIR != 0, syscall.EISDIR, f.path)
+		ErrnoIf(c.srv.OpenFile == nil, syscall.EROFS, f.path)
+		flag := os.O_WRONLY
+		if req.Mode&^OTRUNC == ORDWR {
+			flag = os.O_RDWR
+		}
+		f.wfile, err = c.srv.OpenFile(f.path, flag)
+		Ck(err)
+		f.file = f.wfile
+	}
+	return &Fcall{Type: Ropen, Qid: qid, Iounit: c.iounit()}, nil
+}
+
+func (c *conn) create(req *Fcall) (rep *Fcall, err error) {
+	defer Return(&err)
+	f := c.fid(req.Fid)
+	ErrnoIf(f.file != nil || f.wfile != nil, syscall.EBADF, "fid already open")
+	ErrnoIf(req.Perm&DMDIR != 0, syscall.EPERM, "mkdir not supported")
+	ErrnoIf(c.srv.OpenFile == nil, syscall.EROFS, f.path)
+	name := path.Join(f.path, req.Name)
+	flag := os.O_WRONLY | os.O_CREATE
+	if req.Mode&^OTRUNC == ORDWR {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f.wfile, err = c.srv.OpenFile(name, flag)
+	Ck(err)
+	f.file = f.wfile
+	f.path = name
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	qid := Qid{Type: QTFILE, Path: h.Sum64()}
+	return &Fcall{Type: Rcreate, Qid: qid, Iounit: c.iounit()}, nil
+}
+
+// readDir fills f.dirbuf with the stat entries of the directory.
+func (c *conn) readDir(f *fid) (err error) {
+	defer Return(&err)
+	entries, err := fs.ReadDir(c.srv.FS, f.path)
+	Ck(err)
+	f.dirbuf = nil
+	for _, entry := range entries {
+		_, st, err := c.stat(path.Join(f.path, entry.Name()))
+		if err != nil {
+			// gone since ReadDir
+			continue
+		}
+		f.dirbuf = append(f.dirbuf, st.Bytes()...)
+	}
+	return
+}
+
+func (c *conn) read(req *Fcall) (rep *Fcall, err error) {
+	defer Return(&err)
+	f := c.fid(req.Fid)
+	ErrnoIf(f.file == nil, syscall.EBADF, "fid not open")
+	count := req.Count
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+	rep = &Fcall{Type: Rread}
+	if f.isdir {
+		// only return whole stat entries, so a read must start at
+		// an entry: at the beginning, or where the last one ended
+		ErrnoIf(req.Offset != 0 && req.Offset != f.diroff, syscall.EINVAL,
+			"directory read at offset %d, not %d", req.Offset, f.diroff)
+		buf := f.dirbuf
+		if req.Offset >= uint64(len(buf)) {
+			return
+		}
+		buf = buf[req.Offset:]
+		var n int
+		for n+2 <= len(buf) {
+			size := int(buf[n]) | int(buf[n+1])<<8
+			if n+2+size > int(count) || n+2+size > len(buf) {
+				break
+			}
+			n += 2 + size
+		}
+		rep.Data = buf[:n]
+		f.diroff = req.Offset + uint64(n)
+		return
+	}
+	buf := make([]byte, count)
+	var n int
+	ra, ok := f.file.(io.ReaderAt)
+	if ok {
+		n, err = ra.ReadAt(buf, int64(req.Offset))
+	} else {
+		// offsets of a stream opened for both reading and writing
+		// count both directions, so only check plain reads
+		ErrnoIf(f.wfile == nil && int64(req.Offset) != f.pos, syscall.ESPIPE, "non-sequential read")
+		n, err = f.file.Read(buf)
+		f.pos += int64(n)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	Ck(err)
+	rep.Data = buf[:n]
+	return
+}
@@ -0,0 +1,125 @@
+package ninep
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// memWriter collects what is written to a file created through 9P.
+type memWriter struct {
+	name  string
+	buf   bytes.Buffer
+	files map[string]string
+}
+
+func (w *memWriter) Stat() (fs.FileInfo, error)  { return nil, fs.ErrInvalid }
+func (w *memWriter) Read([]byte) (int, error)    { return 0, syscall.EBADF }
+func (w *memWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+func (w *memWriter) Close() error {
+	w.files[w.name] = w.buf.String()
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	mapfs := fstest.MapFS{
+		"hello.txt":   {Data: []byte("hello, world\n")},
+		"dir/a":       {Data: []byte("a")},
+		"dir/sub/b":   {Data: bytes.Repeat([]byte("b"), 100000)},
+		"dir/sub/c/d": {Data: []byte("d")},
+	}
+	written := make(map[string]string)
+	srv := &Server{
+		FS: mapfs,
+		OpenFile: func(name string, flag int) (File, error) {
+			return &memWriter{name: name, files: written}, nil
+		},
+		Uid: "pup",
+	}
+	cconn, sconn := net.Pipe()
+	go srv.ServeConn(sconn)
+	c, err := NewClient(cconn, "tester")
+	Tassert(t, err == nil, "NewClient: %v", err)
+	defer c.Close()
+
+	buf, err := c.ReadFile("hello.txt")
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == "hello, world\n", "got '%s'", buf)
+
+	// larger than one message
+	buf, err = c.ReadFile("dir/sub/b")
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, len(buf) == 100000, "got %d bytes", len(buf))
+
+	entries, err := c.ReadDir("dir")
+	Tassert(t, err == nil, "ReadDir: %v", err)
+	Tassert(t, len(entries) == 2, "entries %v", entries)
+	Tassert(t, entries[0].Name == "a" && entries[0].Length == 1, "entry %v", entries[0])
+	Tassert(t, entries[1].Name == "sub" && entries[1].Mode&DMDIR != 0, "entry %v", entries[1])
+
+	st, err := c.Stat("/")
+	Tassert(t, err == nil, "Stat: %v", err)
+	Tassert(t, st.Name == "/" && st.Qid.Type == QTDIR && st.Uid == "pup", "stat %v", st)
+
+	err = c.WriteFile("dir/new", []byte("written"))
+	Tassert(t, err == nil, "WriteFile: %v", err)
+	Tassert(t, written["dir/new"] == "written", "written %v", written)
+
+	_, err = c.ReadFile("nope")
+	Tassert(t, errors.Is(err, syscall.ENOENT), "err %v", err)
+	_, err = c.ReadFile("dir/nope")
+	Tassert(t, errors.Is(err, syscall.ENOENT), "err %v", err)
+}
+
+func TestServerReadOnly(t *testing.T) {
+	srv := &Server{FS: fstest.MapFS{"f": {Data: []byte("x")}}}
+	cconn, sconn := net.Pipe()
+	go srv.ServeConn(sconn)
+	c, err := NewClient(cconn, "tester")
+	Tassert(t, err == nil, "NewClient: %v", err)
+	defer c.Close()
+	err = c.WriteFile("g", []byte("y"))
+	Tassert(t, errors.Is(err, syscall.EROFS), "err %v", err)
+	_, err = c.Open("f", OWRITE)
+	Tassert(t, errors.Is(err, syscall.EROFS), "err %v", err)
+}
+
+func TestServerHostile(t *testing.T) {
+	mapfs := fstest.MapFS{"dir/a": {Data: []byte("a")}, "dir/b": {Data: []byte("b")}}
+	srv := &Server{FS: mapfs}
+	cconn, sconn := net.Pipe()
+	go srv.ServeConn(sconn)
+	c := &Client{rw: cconn, msize: MaxMsize}
+	defer c.Close()
+
+	// an msize too small for a read header is refused
+	_, err := c.rpc(&Fcall{Type: Tversion, Tag: NOTAG, Msize: IOHDRSZ - 1, Version: Version})
+	Tassert(t, errors.Is(err, syscall.EMSGSIZE), "small msize: %v", err)
+	_, err = c.rpc(&Fcall{Type: Tversion, Tag: NOTAG, Msize: MaxMsize, Version: Version})
+	Tassert(t, err == nil, "Tversion: %v", err)
+	_, err = c.rpc(&Fcall{Type: Tattach, Fid: 0, Afid: NOFID, Uname: "tester"})
+	Tassert(t, err == nil, "Tattach: %v", err)
+	_, err = c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wname: []string{"dir"}})
+	Tassert(t, err == nil, "Twalk: %v", err)
+	rep, err := c.rpc(&Fcall{Type: Topen, Fid: 1, Mode: OREAD})
+	Tassert(t, err == nil && rep.Iounit == MaxMsize-IOHDRSZ, "Topen: %v %v", err, rep)
+
+	// directory reads must start on an entry
+	rep, err = c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: 0, Count: 8192})
+	Tassert(t, err == nil && len(rep.Data) > 0, "Tread: %v", err)
+	end := uint64(len(rep.Data))
+	for _, offset := range []uint64{1, end - 1, end + 1} {
+		_, err = c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: offset, Count: 8192})
+		Tassert(t, errors.Is(err, syscall.EINVAL), "offset %d: %v", offset, err)
+	}
+	rep, err = c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: end, Count: 8192})
+	Tassert(t, err == nil && len(rep.Data) == 0, "read at end: %v %v", err, rep)
+	rep, err = c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: 0, Count: 8192})
+	Tassert(t, err == nil && uint64(len(rep.Data)) == end, "reread: %v %v", err, rep)
+}
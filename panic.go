@@ -0,0 +1,47 @@
+package pup
+
+import (
+	"context"
+	"runtime/debug"
+)
+
+// dispatch returns the handler for hash, wrapped in the middleware and
+// in panic recovery, or nil.
+func (s *Server) dispatch(hash string) Handler {
+	h := s.chain(hash, s.Handler(hash))
+	if h == nil {
+		return nil
+	}
+	return HandlerFunc(func(ctx context.Context, req *Request) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			err = panicError(r)
+			s.mu.Lock()
+			if s.panics == nil {
+				s.panics = make(map[string]int)
+			}
+			s.panics[hash]++
+			s.mu.Unlock()
+			req.Log.Printf("panic: %v\n%s", r, debug.Stack())
+		}()
+		return h.ServeStream(ctx, req)
+	})
+}
+
+// Panics returns how many times the handlers of each hash, or their
+// middleware, have panicked.  The server recovers from a panic in a
+// handler: the caller gets an error reply, with EIO unless the panic
+// value is an error that wraps another errno, and the stack trace goes
+// to Request.Log.
+func (s *Server) Panics() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]int)
+	for hash, n := range s.panics {
+		res[hash] = n
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// syncBuffer is a bytes.Buffer that the server can log to while the
+// test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPanic(t *testing.T) {
+	port := 10861
+	logbuf := &syncBuffer{}
+	s := &Server{Logger: log.New(logbuf, "", 0)}
+	s.Register("sha256:aa", func(hash []byte, stream io.ReadWriteCloser) error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	})
+	s.Register("sha256:bb", func(hash []byte, stream io.ReadWriteCloser) error {
+		// a lambda that uses Ck without Return
+		Ck(Error{syscall.EPERM, "not allowed"})
+		return nil
+	})
+	s.Register("sha256:cc", func(hash []byte, stream io.ReadWriteCloser) error {
+		_, err := stream.Write([]byte("ok"))
+		return err
+	})
+	go s.Serve("127.0.0.1", port)
+	defer s.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+	call := func(hash string) (string, error) {
+		out := &bytes.Buffer{}
+		err := c.Call(hash, bytes.NewReader(nil), out)
+		return out.String(), err
+	}
+	for i := 0; i < 2; i++ {
+		_, err := call("sha256:aa")
+		Tassert(t, errors.Is(err, syscall.EIO) && strings.Contains(err.Error(), "panic"), "panic: %v", err)
+	}
+	_, err := call("sha256:bb")
+	Tassert(t, errors.Is(err, syscall.EPERM), "errno panic: %v", err)
+
+	// the server is still up
+	out, err := call("sha256:cc")
+	Tassert(t, err == nil && out == "ok", "after panics: %v '%s'", err, out)
+
+	panics := s.Panics()
+	Tassert(t, panics["sha256:aa"] == 2 && panics["sha256:bb"] == 1 && panics["sha256:cc"] == 0, "panics: %v", panics)
+	logged := logbuf.String()
+	Tassert(t, strings.Contains(logged, "panic: assignment to entry in nil map") && strings.Contains(logged, "goroutine"), "log: %q", logged)
+
+	// lambdas called through Dereference are recovered too
+	err = s.Dereference("sha256:aa")([]byte("sha256:aa"), &MockReadWriteCloser{})
+	Tassert(t, errors.Is(err, syscall.EIO), "Dereference: %v", err)
+	Tassert(t, s.Panics()["sha256:aa"] == 3, "panics: %v", s.Panics())
+}
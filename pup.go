@@ -1,10 +1,15 @@
 package pup
 
 import (
+	"context"
 	"errors"
 	"io"
+	"log"
 	"net"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	. "github.com/stevegt/goadapt"
 )
@@ -15,47 +20,130 @@ type Registration struct {
 }
 
 type Server struct {
+	// HeaderTimeout is how long a caller may take to send a stream's
+	// header.  Zero means no limit.
+	HeaderTimeout time.Duration
+	// IdleTimeout ends a stream that has carried nothing either way
+	// for that long, and MaxDuration one that has lasted that long;
+	// see SetTimeouts.  Zero means no limit.  A stream that times out
+	// gets an ETIMEDOUT error reply if it can, is closed, and has its
+	// context cancelled; see ContextOf.
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+	// Logger is where handlers log, through Request.Log.  Nil means
+	// the standard logger.
+	Logger *log.Logger
+
+	mu       sync.Mutex
 	registry *registry
+	cache    *Cache
+	topicmap *topics
+	// authorities, if set, are the roots of the capability tokens the
+	// server accepts; see RequireTokens.  nonces holds the nonces of
+	// the tokens seen within MaxSkew, to refuse replays.
+	authorities []string
+	nonces      map[string]time.Time
+	limitmap    *limits
+	timeoutmap  map[string]timeouts
+	ctx         context.Context
+	shutdown    context.CancelFunc
+	listeners   map[net.Listener]bool
+	streams     int
+	idle        *sync.Cond
+	middleware  []Middleware
+	hashware    map[string][]Middleware
+	panics      map[string]int
+}
+
+// Cache returns the server's chunk cache.
+func (s *Server) Cache() *Cache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		s.cache = &Cache{}
+	}
+	return s.cache
 }
 
 func (s *Server) Register(hash string, lambda Lambda) {
-	if s.registry == nil {
-		s.registry = &registry{}
+	var h Handler
+	if lambda != nil {
+		h = lambda
 	}
-	s.registry.put(hash, lambda)
+	s.Handle(hash, h)
 }
 
+// Dereference returns the lambda for hash, wrapped in the middleware
+// and panic recovery, or nil.  A Handler registered with Handle is
+// adapted to a Lambda.
 func (s *Server) Dereference(hash string) (lambda Lambda) {
-	if s.registry == nil {
-		s.registry = new(registry)
-	}
-	return s.registry.get(hash)
+	return s.lambdaOf(s.dispatch(hash))
 }
 
+// Registrations returns every registered hash with its lambda,
+// wrapped as by Dereference.
 func (s *Server) Registrations() (res []Registration) {
+	s.mu.Lock()
 	if s.registry == nil {
-		s.registry = new(registry)
+		s.registry = &registry{}
+	}
+	var hashes []string
+	for hash := range *s.registry {
+		hashes = append(hashes, hash)
+	}
+	s.mu.Unlock()
+	for _, hash := range hashes {
+		if lambda := s.Dereference(hash); lambda != nil {
+			res = append(res, Registration{hash, lambda})
+		}
 	}
-	return s.registry.ls()
+	return
 }
 
+// Serve accepts connections on host:port until Shutdown.  After a
+// temporary error accepting, such as running out of file descriptors,
+// it backs off for up to a second before trying again; any other
+// error ends it.
 func (s *Server) Serve(host string, port int) (err error) {
 	defer Return(&err)
 	l, err := net.Listen("tcp", Spf("%s:%d", host, port))
 	Ck(err)
 	defer l.Close()
+	if !s.listen(l) {
+		return
+	}
 	Pl("Listening on", Spf("%s:%d", host, port))
 
+	var backoff time.Duration
 	for {
 		conn, err := l.Accept()
-		if err != nil {
-			Pl("error accepting:", err.Error())
+		if s.context().Err() != nil {
+			return nil
 		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Temporary() {
+			backoff *= 2
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			}
+			if backoff > time.Second {
+				backoff = time.Second
+			}
+			Pf("error accepting: %v; retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		Ck(err)
+		backoff = 0
 		go s.handleTcp(conn)
 	}
 }
 
+// handleTcp serves one stream per connection.  The connection is
+// closed when the lambda returns, which tells the caller the reply is
+// complete.
 func (s *Server) handleTcp(conn net.Conn) {
+	defer conn.Close()
 	// XXX deal with whitelist/blacklist here
 	err := s.handleStream(conn)
 	if err != nil {
@@ -73,22 +161,72 @@ func (e Error) Error() string {
 	return Spf("%s: %s", e.Errno.Error(), e.Msg)
 }
 
+func (e Error) Unwrap() error {
+	return e.Errno
+}
+
 func (s *Server) handleStream(stream io.ReadWriteCloser) (err error) {
+	s.enter()
+	defer s.leave()
+	start := time.Now()
+	m := newServerStream(s.context(), stream)
+	stop := func() {}
+	defer func() {
+		// a stream cut off by a limit, or whose lambda panicked,
+		// tells the caller why, unless the lambda has already
+		// replied
+		failure := m.failure()
+		if failure != nil {
+			err = failure
+		}
+		var p panicked
+		if failure != nil || errors.As(err, &p) {
+			m.reply(err)
+		}
+		stop()
+		m.cancel()
+	}()
 	defer Return(&err)
 
-	// read the leading hash
-	hash, err := Readline(stream, 1024)
+	// read the leading hash and the capability token, if any; a
+	// token's delegation chain makes the line long
+	var timer *time.Timer
+	if s.HeaderTimeout > 0 {
+		timeout := s.HeaderTimeout
+		timer = time.AfterFunc(timeout, func() {
+			m.cut(Error{syscall.ETIMEDOUT, Spf("no header within %v", timeout)})
+		})
+	}
+	header, err := Readline(m, 8192)
+	if timer != nil {
+		timer.Stop()
+	}
+	Ck(err)
+	hash, token, _ := strings.Cut(string(header), " ")
+	idle, max := s.timeouts(hash)
+	stop = s.watch(m, idle, max)
+	authed, err := s.authenticate(hash, token, m)
+	Ck(err)
+
+	req := s.newRequest(string(header), authed, start)
+	release, quota, err := s.admit(hash, req.Identity, req.RemoteAddr)
+	if err != nil {
+		m.reply(err)
+	}
 	Ck(err)
+	defer release()
+	m.limit(quota)
 
-	// get lambda by looking up the hash in the registry
-	lambda := s.Dereference(string(hash))
+	// get the handler by looking up the hash in the registry, and
+	// wrap it in the middleware and panic recovery
+	h := s.dispatch(hash)
 
-	if lambda == nil {
-		return Error{syscall.ENOSYS, string(hash)}
+	if h == nil {
+		return Error{syscall.ENOSYS, hash}
 	}
 
-	// pipe the rest of the stream to the lambda
-	err = lambda(hash, stream)
+	// pipe the rest of the stream to the handler
+	err = h.ServeStream(m.Context(), req)
 	return
 }
 
@@ -113,21 +251,14 @@ func Readline(stream io.Reader, max int) (line []byte, err error) {
 
 type Lambda func([]byte, io.ReadWriteCloser) error
 
-type registry map[string]Lambda
+type registry map[string]Handler
 
-func (r *registry) put(hash string, lambda Lambda) {
-	(*r)[hash] = lambda
+func (r *registry) put(hash string, h Handler) {
+	(*r)[hash] = h
 	return
 }
 
-func (r *registry) get(hash string) (lambda Lambda) {
-	lambda, _ = (*r)[hash]
-	return
-}
-
-func (r *registry) ls() (res []Registration) {
-	for k, v := range *r {
-		res = append(res, Registration{k, v})
-	}
+func (r *registry) get(hash string) (h Handler) {
+	h, _ = (*r)[hash]
 	return
 }
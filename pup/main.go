@@ -0,0 +1,175 @@
+// pup is a shell for poking at a pup grid.
+//
+// Run with a command, pup runs it and exits; a call without text
+// reads its input from stdin:
+//
+//	pup -addr 127.0.0.1:10840 ls
+//	echo hello | pup call sha256:...
+//
+// Run without one, pup reads commands from stdin.  On a terminal it is
+// an interactive shell with line editing and tab completion of
+// commands and known hashes; a call without text reads typed lines
+// until a line holding a single ".".  Type help for the commands.
+//
+// With -identity, registrations and published messages are signed.
+// With -caps as well, every stream presents the capabilities in the
+// file, which a server that requires tokens checks; the grant command
+// writes such a file for someone else.
+//
+// Outside the interactive shell, pup keeps running after the last
+// command while it serves registrations or prints subscriptions.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"golang.org/x/term"
+
+	"github.com/stevegt/pup"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:10840", "server to connect to")
+	name := flag.String("name", "", "name to register lambdas under (default host:pid)")
+	idPath := flag.String("identity", "", "file holding the key that signs registrations and messages; created if missing")
+	capsPath := flag.String("caps", "", "file holding the capabilities granted to -identity")
+	flag.Parse()
+
+	if *name == "" {
+		host, _ := os.Hostname()
+		*name = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	sh := &Shell{Client: &pup.Client{Addr: *addr, Name: *name}, Out: os.Stdout}
+	if *idPath != "" {
+		id, err := identity(*idPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pup: %v\n", err)
+			os.Exit(1)
+		}
+		sh.Client.Identity = id
+	}
+	if *capsPath != "" {
+		buf, err := os.ReadFile(*capsPath)
+		if err == nil {
+			sh.Client.Capabilities, err = pup.ParseChain(buf)
+		}
+		if err == nil && sh.Client.Identity == nil {
+			err = fmt.Errorf("-caps needs -identity")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pup: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if flag.NArg() > 0 {
+		sh.Input = func() io.Reader { return os.Stdin }
+		err := sh.Exec(strings.Join(flag.Args(), " "))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pup: %v\n", err)
+			os.Exit(1)
+		}
+		sh.Wait()
+		return
+	}
+	// learn the server's registrations for completion, but start
+	// anyway if it isn't up yet
+	hashes, err := sh.Client.Registrations()
+	if err == nil {
+		sh.learn(hashes...)
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		err = interact(sh)
+	} else {
+		err = script(sh, os.Stdin)
+		if err == nil {
+			sh.Wait()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pup: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// identity loads the identity saved at path, or creates one there.
+func identity(path string) (id *pup.Identity, err error) {
+	defer Return(&err)
+	id, err = pup.LoadIdentity(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	id, err = pup.NewIdentity()
+	Ck(err)
+	err = id.Save(path)
+	Ck(err)
+	fmt.Fprintf(os.Stderr, "pup: created identity %s in %s\n", id.Addr, path)
+	return
+}
+
+// interact runs the interactive shell on the terminal.
+func interact(sh *Shell) (err error) {
+	defer Return(&err)
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	Ck(err)
+	defer term.Restore(int(os.Stdin.Fd()), state)
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "pup> ")
+	t.AutoCompleteCallback = sh.Complete
+	sh.Out = t
+	sh.Input = func() io.Reader { return typed(t) }
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		Ck(err)
+		err = sh.Exec(line)
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			sh.printf("error: %v\n", err)
+		}
+	}
+}
+
+// typed reads lines from t up to a line holding a single "." and
+// returns them as a reader.
+func typed(t *term.Terminal) io.Reader {
+	t.SetPrompt("")
+	defer t.SetPrompt("pup> ")
+	var b strings.Builder
+	for {
+		line, err := t.ReadLine()
+		if err != nil || line == "." {
+			return strings.NewReader(b.String())
+		}
+		b.WriteString(line + "\n")
+	}
+}
+
+// script runs the commands read from r, stopping at the first error.
+func script(sh *Shell, r io.Reader) (err error) {
+	defer Return(&err)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		err = sh.Exec(scanner.Text())
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	Ck(scanner.Err())
+	return
+}
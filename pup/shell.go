@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+	"github.com/stevegt/pup/puplang"
+)
+
+// errQuit is returned by Exec for the quit command.
+var errQuit = errors.New("quit")
+
+// Shell runs pup shell commands against a server.  It is also a
+// puplang.Caller, so eval runs programs on the server.
+type Shell struct {
+	// Client talks to the server; connect replaces it.
+	Client *pup.Client
+	// Out receives the output of commands, including output that
+	// arrives later, such as subscribed messages.
+	Out io.Writer
+	// Input returns the input of a call that has no text on its
+	// command line: stdin when pup is run with a command, or typed
+	// lines in the interactive shell.  Nil means no input.
+	Input func() io.Reader
+
+	mu     sync.Mutex
+	bg     sync.WaitGroup
+	known  map[string]bool
+	subs   map[string]*pup.Subscription
+	interp *puplang.Interp
+}
+
+type command struct {
+	usage string
+	help  string
+	// offline commands don't need a server
+	offline bool
+	run     func(sh *Shell, args string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"connect":  {"connect host:port", "connect to a server", true, (*Shell).connect},
+		"ls":       {"ls", "list registrations", false, (*Shell).ls},
+		"call":     {"call hash [text]", "call a lambda with text, or with piped or typed input", false, (*Shell).call},
+		"register": {"register [hash] command [args...]", "serve a local command as a lambda through pupd; hash defaults to the command's content address", false, (*Shell).register},
+		"sub":      {"sub pattern", "print messages on the topics matching pattern", false, (*Shell).sub},
+		"unsub":    {"unsub pattern", "cancel a subscription", false, (*Shell).unsub},
+		"pub":      {"pub topic text", "publish text on topic", false, (*Shell).pub},
+		"get":      {"get addr", "fetch a chunk", false, (*Shell).get},
+		"eval":     {"eval program", "run a puplang program on the server", false, (*Shell).eval},
+		"grant":    {"grant participant ops scopes duration", "print a capability for participant, delegated from ours; ops and scopes are comma-separated", true, (*Shell).grant},
+		"help":     {"help", "show this list", true, (*Shell).help},
+		"quit":     {"quit", "leave the shell", true, (*Shell).quit},
+	}
+}
+
+// Exec runs one command line.  Blank lines and lines starting with
+// "#" are ignored.  Exec returns errQuit for quit.
+func (sh *Shell) Exec(line string) (err error) {
+	defer Return(&err)
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+	name, args := cut(line)
+	cmd, ok := commands[name]
+	if !ok {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "unknown command " + name + "; try help"}
+	}
+	if !cmd.offline && sh.Client == nil {
+		return pup.Error{Errno: syscall.ENOTCONN, Msg: "not connected; try connect host:port"}
+	}
+	return cmd.run(sh, args)
+}
+
+// cut splits line at the first run of blanks.
+func cut(line string) (word, rest string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i:])
+}
+
+// canonical accepts addresses in either of the forms puplang does.
+func canonical(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return addr
+	}
+	return puplang.CanonicalAddress(addr)
+}
+
+// Write writes to Out.  Commands and background subscriptions share
+// Out, so writes are serialised.
+func (sh *Shell) Write(buf []byte) (n int, err error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.Out.Write(buf)
+}
+
+func (sh *Shell) printf(format string, args ...interface{}) {
+	fmt.Fprintf(sh, format, args...)
+}
+
+// learn remembers hashes for completion.
+func (sh *Shell) learn(hashes ...string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.known == nil {
+		sh.known = make(map[string]bool)
+	}
+	for _, hash := range hashes {
+		sh.known[hash] = true
+	}
+}
+
+// Hashes returns the hashes the shell has seen, sorted: registrations,
+// called lambdas, and the addresses of published and received messages.
+func (sh *Shell) Hashes() (hashes []string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for hash := range sh.known {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return
+}
+
+// Complete is a golang.org/x/term AutoCompleteCallback.  Tab
+// completes the word before the cursor: a command name in the first
+// word, a known hash anywhere else.  If the word can't be extended,
+// the choices are listed.
+func (sh *Shell) Complete(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	if key != '\t' {
+		return
+	}
+	head := line[:pos]
+	start := strings.LastIndexAny(head, " \t") + 1
+	word := head[start:]
+	var choices []string
+	if strings.TrimSpace(head[:start]) == "" {
+		for name := range commands {
+			choices = append(choices, name)
+		}
+		sort.Strings(choices)
+	} else {
+		choices = sh.Hashes()
+	}
+	var matches []string
+	for _, choice := range choices {
+		if strings.HasPrefix(choice, word) {
+			matches = append(matches, choice)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	completion := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) == 1 {
+		completion += " "
+	}
+	if completion == word {
+		sh.printf("%s\n", strings.Join(matches, "  "))
+		return
+	}
+	newLine = head[:start] + completion + line[pos:]
+	return newLine, start + len(completion), true
+}
+
+// Wait blocks until the shell stops serving registrations and its
+// subscriptions end.
+func (sh *Shell) Wait() {
+	sh.bg.Wait()
+}
+
+// Call implements puplang.Caller.
+func (sh *Shell) Call(hash string, input io.Reader, output io.Writer) error {
+	sh.learn(hash)
+	return sh.Client.Call(hash, input, output)
+}
+
+func (sh *Shell) connect(args string) (err error) {
+	defer Return(&err)
+	if args == "" {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: connect host:port"}
+	}
+	client := &pup.Client{Addr: args}
+	if sh.Client != nil {
+		client.Name = sh.Client.Name
+		client.Identity = sh.Client.Identity
+		client.Capabilities = sh.Client.Capabilities
+	}
+	sh.Client = client
+	hashes, err := sh.Client.Registrations()
+	Ck(err)
+	sh.learn(hashes...)
+	sh.printf("connected to %s: %d registrations\n", args, len(hashes))
+	return
+}
+
+func (sh *Shell) ls(args string) (err error) {
+	defer Return(&err)
+	hashes, err := sh.Client.Registrations()
+	Ck(err)
+	sh.learn(hashes...)
+	for _, hash := range hashes {
+		sh.printf("%s\n", hash)
+	}
+	return
+}
+
+func (sh *Shell) call(args string) (err error) {
+	hash, text := cut(args)
+	if hash == "" {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: call hash [text]"}
+	}
+	hash = canonical(hash)
+	var input io.Reader = strings.NewReader("")
+	if text != "" {
+		input = strings.NewReader(text + "\n")
+	} else if sh.Input != nil {
+		input = sh.Input()
+	}
+	return sh.Call(hash, input, sh)
+}
+
+func (sh *Shell) register(args string) (err error) {
+	defer Return(&err)
+	words := strings.Fields(args)
+	if len(words) == 0 {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: register [hash] command [args...]"}
+	}
+	var hash string
+	if strings.Contains(words[0], ":") {
+		hash = canonical(words[0])
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "no command"}
+	}
+	path, err := exec.LookPath(words[0])
+	Ck(err)
+	if hash == "" {
+		code, err := os.ReadFile(path)
+		Ck(err)
+		hash = pup.Address(code)
+	}
+	lambda := pup.ExecLambda(pup.Command{Path: path, Args: words[1:], Env: os.Environ()})
+	conn, err := sh.Client.Register(hash)
+	Ck(err)
+	sh.learn(hash)
+	sh.printf("serving %s\n", hash)
+	sh.bg.Add(1)
+	go sh.serve(sh.Client, hash, lambda, conn)
+	return
+}
+
+// serve runs lambda for each call pupd routes to hash, registering
+// again after each one.
+func (sh *Shell) serve(client *pup.Client, hash string, lambda pup.Lambda, conn io.ReadWriteCloser) {
+	defer sh.bg.Done()
+	for {
+		stream := &peerStream{conn: conn}
+		// don't start the command until a caller arrives
+		err := stream.wait()
+		if err != nil {
+			sh.printf("%s: %v\n", hash, err)
+			conn.Close()
+			return
+		}
+		err = lambda([]byte(hash), stream)
+		conn.Close()
+		if err != nil {
+			sh.printf("%s: %v\n", hash, err)
+		}
+		conn, err = client.Register(hash)
+		if err != nil {
+			sh.printf("%s: %v\n", hash, err)
+			return
+		}
+	}
+}
+
+// peerStream is a registered connection as the lambda sees it, with
+// the first byte of the call read ahead.
+type peerStream struct {
+	conn  io.ReadWriteCloser
+	first []byte
+}
+
+// wait blocks until pupd routes a call to the connection.  A call
+// with no input shows up as end of file.
+func (p *peerStream) wait() error {
+	buf := make([]byte, 1)
+	n, err := p.conn.Read(buf)
+	p.first = buf[:n]
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (p *peerStream) Read(buf []byte) (int, error) {
+	if len(p.first) > 0 {
+		n := copy(buf, p.first)
+		p.first = p.first[n:]
+		return n, nil
+	}
+	return p.conn.Read(buf)
+}
+
+func (p *peerStream) Write(buf []byte) (int, error) {
+	return p.conn.Write(buf)
+}
+
+func (p *peerStream) Close() error {
+	return p.conn.Close()
+}
+
+func (sh *Shell) sub(args string) (err error) {
+	defer Return(&err)
+	if args == "" {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: sub pattern"}
+	}
+	sh.mu.Lock()
+	_, ok := sh.subs[args]
+	sh.mu.Unlock()
+	if ok {
+		return pup.Error{Errno: syscall.EEXIST, Msg: args}
+	}
+	sub, err := sh.Client.Subscribe(args)
+	Ck(err)
+	sh.mu.Lock()
+	if sh.subs == nil {
+		sh.subs = make(map[string]*pup.Subscription)
+	}
+	sh.subs[args] = sub
+	sh.mu.Unlock()
+	sh.bg.Add(1)
+	go func() {
+		defer sh.bg.Done()
+		for msg := range sub.C {
+			sh.learn(msg.Addr())
+			sh.printf("%s %d %s\n%s", msg.Topic, msg.Seq, msg.Addr(), msg.Body)
+			if len(msg.Body) > 0 && msg.Body[len(msg.Body)-1] != '\n' {
+				sh.printf("\n")
+			}
+		}
+	}()
+	return
+}
+
+func (sh *Shell) unsub(args string) (err error) {
+	sh.mu.Lock()
+	sub, ok := sh.subs[args]
+	delete(sh.subs, args)
+	sh.mu.Unlock()
+	if !ok {
+		return pup.Error{Errno: syscall.ENOENT, Msg: "not subscribed to " + args}
+	}
+	return sub.Close()
+}
+
+func (sh *Shell) pub(args string) (err error) {
+	defer Return(&err)
+	topic, text := cut(args)
+	if topic == "" {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: pub topic text"}
+	}
+	addr, err := sh.Client.Publish(topic, []byte(text+"\n"))
+	Ck(err)
+	sh.learn(addr)
+	sh.printf("%s\n", addr)
+	return
+}
+
+func (sh *Shell) get(args string) (err error) {
+	defer Return(&err)
+	if args == "" {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: get addr"}
+	}
+	content, err := sh.Client.Get(canonical(args))
+	Ck(err)
+	_, err = sh.Write(content)
+	Ck(err)
+	return
+}
+
+func (sh *Shell) eval(args string) (err error) {
+	defer Return(&err)
+	if sh.interp == nil {
+		sh.interp = &puplang.Interp{Caller: sh}
+	}
+	v, err := sh.interp.Eval(args)
+	Ck(err)
+	var out []byte
+	switch v.(type) {
+	case nil:
+		return
+	case string, *puplang.Stream:
+		out, err = puplang.Text(v)
+	default:
+		var s string
+		s, err = puplang.Format(v)
+		out = []byte(s)
+	}
+	Ck(err)
+	if len(out) == 0 || out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	_, err = sh.Write(out)
+	Ck(err)
+	return
+}
+
+// grant prints the delegation chain for participant: ours, if we hold
+// one, followed by a capability we sign.  Without capabilities of our
+// own the grant is only useful if we are one of the server's
+// authorities.
+func (sh *Shell) grant(args string) (err error) {
+	defer Return(&err)
+	parts := strings.Fields(args)
+	if len(parts) != 4 {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "usage: " + commands["grant"].usage}
+	}
+	if sh.Client == nil || sh.Client.Identity == nil {
+		return pup.Error{Errno: syscall.EINVAL, Msg: "grant needs an identity; run pup with -identity"}
+	}
+	ttl, err := time.ParseDuration(parts[3])
+	Ck(err)
+	_, err = pup.ParticipantKey(parts[0])
+	Ck(err)
+	c := sh.Client.Identity.Grant(parts[0], strings.Split(parts[1], ","), strings.Split(parts[2], ","), time.Now().Add(ttl))
+	chain := append(append([]*pup.Capability{}, sh.Client.Capabilities...), c)
+	_, err = sh.Write(pup.EncodeChain(chain))
+	Ck(err)
+	return
+}
+
+func (sh *Shell) help(args string) (err error) {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		sh.printf("%-36s %s\n", cmd.usage, cmd.help)
+	}
+	return
+}
+
+func (sh *Shell) quit(args string) error {
+	return errQuit
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+)
+
+const port = 10849
+
+const UPPER = "sha256:0f"
+
+// syncBuffer is a bytes.Buffer that subscriptions can write to while
+// the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns and clears the content.
+func (b *syncBuffer) take() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.buf.String()
+	b.buf.Reset()
+	return s
+}
+
+func testShell(t *testing.T) (sh *Shell, out *syncBuffer) {
+	s := &pup.Server{}
+	s.RegisterLookup()
+	s.RegisterPubSub()
+	s.Register(UPPER, func(hash []byte, stream io.ReadWriteCloser) error {
+		buf, err := io.ReadAll(stream)
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(bytes.ToUpper(buf))
+		return err
+	})
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	out = &syncBuffer{}
+	sh = &Shell{Out: out}
+	return
+}
+
+func TestShell(t *testing.T) {
+	sh, out := testShell(t)
+
+	err := sh.Exec("ls")
+	Tassert(t, errors.Is(err, syscall.ENOTCONN), "ls before connect: %v", err)
+	err = sh.Exec("frob")
+	Tassert(t, errors.Is(err, syscall.EINVAL), "unknown command: %v", err)
+
+	err = sh.Exec(Spf("connect 127.0.0.1:%d", port))
+	Tassert(t, err == nil, "connect: %v", err)
+	Tassert(t, strings.Contains(out.take(), "5 registrations"), "connect output")
+
+	err = sh.Exec("ls")
+	Tassert(t, err == nil, "ls: %v", err)
+	got := out.take()
+	Tassert(t, strings.HasPrefix(got, UPPER+"\n") && strings.Contains(got, pup.GET+"\n"), "ls: '%s'", got)
+
+	// text on the command line, then piped input
+	err = sh.Exec("call " + UPPER + " hello  there")
+	Tassert(t, err == nil, "call: %v", err)
+	Tassert(t, out.take() == "HELLO  THERE\n", "call output")
+	sh.Input = func() io.Reader { return strings.NewReader("piped\ninput\n") }
+	err = sh.Exec("call 2:0F")
+	Tassert(t, err == nil, "call: %v", err)
+	Tassert(t, out.take() == "PIPED\nINPUT\n", "piped call output")
+
+	err = sh.Exec("sub /news")
+	Tassert(t, err == nil, "sub: %v", err)
+	err = sh.Exec("sub /news")
+	Tassert(t, errors.Is(err, syscall.EEXIST), "sub twice: %v", err)
+	time.Sleep(100 * time.Millisecond)
+	err = sh.Exec("pub /news/today hi")
+	Tassert(t, err == nil, "pub: %v", err)
+	time.Sleep(100 * time.Millisecond)
+	// the message may arrive before pub prints its address
+	got = out.take()
+	addr := strings.Fields(got)[0]
+	if !strings.HasPrefix(addr, "sha256:") {
+		addr = strings.Fields(got)[2]
+	}
+	want := "/news/today 1 " + addr + "\nhi\n"
+	Tassert(t, got == addr+"\n"+want || got == want+addr+"\n", "pub and sub output %q", got)
+	err = sh.Exec("unsub /news")
+	Tassert(t, err == nil, "unsub: %v", err)
+	sh.Wait()
+
+	err = sh.Exec("get " + addr)
+	Tassert(t, err == nil, "get: %v", err)
+	msg, err := pup.ParseMessage([]byte(out.take()))
+	Tassert(t, err == nil && string(msg.Body) == "hi\n", "get: %v %v", err, msg)
+	err = sh.Exec("get " + pup.Address([]byte("nothing")))
+	Tassert(t, errors.Is(err, syscall.ENOENT), "get missing: %v", err)
+
+	err = sh.Exec(`eval "abc" | ` + UPPER)
+	Tassert(t, err == nil, "eval: %v", err)
+	Tassert(t, out.take() == "ABC\n", "eval output")
+	err = sh.Exec(`eval [1, "a"]`)
+	Tassert(t, err == nil, "eval: %v", err)
+	Tassert(t, out.take() == "[1, \"a\"]\n", "eval output")
+
+	Tassert(t, sh.Exec("quit") == errQuit, "quit")
+}
+
+func TestComplete(t *testing.T) {
+	sh := &Shell{Out: &bytes.Buffer{}}
+	sh.learn("sha256:abc1", "sha256:abd2", "sha256:f00")
+
+	complete := func(line string) (string, bool) {
+		newLine, pos, ok := sh.Complete(line, len(line), '\t')
+		Tassert(t, !ok || pos == len(newLine), "pos %d in '%s'", pos, newLine)
+		return newLine, ok
+	}
+	line, ok := complete("ca")
+	Tassert(t, ok && line == "call ", "got '%s'", line)
+	line, ok = complete("call sha256:f")
+	Tassert(t, ok && line == "call sha256:f00 ", "got '%s'", line)
+	line, ok = complete("call sha256:a")
+	Tassert(t, ok && line == "call sha256:ab", "got '%s'", line)
+
+	// no progress lists the choices
+	_, ok = complete("call sha256:ab")
+	Tassert(t, !ok, "expected no completion")
+	Tassert(t, sh.Out.(*bytes.Buffer).String() == "sha256:abc1  sha256:abd2\n", "choices '%s'", sh.Out)
+
+	_, ok = complete("call x")
+	Tassert(t, !ok, "expected no completion")
+	_, _, ok = sh.Complete("ca", 2, 'x')
+	Tassert(t, !ok, "only tab completes")
+
+	// completing in the middle of a line keeps the rest
+	newLine, pos, ok := sh.Complete("get sha256:f rest", 12, '\t')
+	Tassert(t, ok && newLine == "get sha256:f00  rest" && pos == 15, "got '%s' %d", newLine, pos)
+}
+
+func TestGrant(t *testing.T) {
+	root, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	id, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	other, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	out := &bytes.Buffer{}
+	sh := &Shell{Out: out, Client: &pup.Client{Identity: id, Capabilities: []*pup.Capability{
+		root.Grant(id.Addr, []string{"call"}, []string{"*"}, time.Now().Add(time.Hour))}}}
+
+	err = sh.Exec("grant " + other.Addr + " call sha256:ab* 10m")
+	Tassert(t, err == nil, "grant: %v", err)
+	chain, err := pup.ParseChain(out.Bytes())
+	Tassert(t, err == nil && len(chain) == 2, "ParseChain: %v %v", err, chain)
+	tok := pup.NewToken(chain, other, "sha256:abc", time.Now())
+	err = tok.Verify([]string{root.Addr}, "sha256:abc", time.Now())
+	Tassert(t, err == nil && tok.Authorize("call", "sha256:abc") == nil, "delegated token: %v", err)
+
+	for _, line := range []string{"grant " + other.Addr + " call *", "grant alice call * 10m"} {
+		err = sh.Exec(line)
+		Tassert(t, errors.Is(err, syscall.EINVAL), "%s: %v", line, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+)
+
+// authenticate checks the signature on a registration, if it has one.
+// If d.RequireSigned is set, unsigned registrations are refused, and
+// an unsigned one may never claim a participant address as its name.
+// A signed registration is refused if it was signed more than pup.MaxSkew
+// from now, or if its signature has been used before.
+func (d *Dispatcher) authenticate(req *pup.RegisterRequest) (err error) {
+	defer Return(&err)
+	if len(req.Sig) == 0 {
+		ErrnoIf(d.RequireSigned, syscall.EACCES, "unsigned registration for %s", req.Hash)
+		ErrnoIf(strings.HasPrefix(req.Name, "ed25519:"), syscall.EACCES,
+			"unsigned registration for %s names participant %s", req.Hash, req.Name)
+		return
+	}
+	err = req.Verify()
+	Ck(err)
+	now := time.Now()
+	skew := now.Sub(req.Time)
+	if skew < 0 {
+		skew = -skew
+	}
+	ErrnoIf(skew > pup.MaxSkew, syscall.EACCES, "registration for %s signed at %v", req.Hash, req.Time)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// signatures older than the window can't be replayed anyway
+	for sig, t := range d.seen {
+		if now.Sub(t) > pup.MaxSkew {
+			delete(d.seen, sig)
+		}
+	}
+	sig := string(req.Sig)
+	_, replayed := d.seen[sig]
+	ErrnoIf(replayed, syscall.EACCES, "replayed registration for %s", req.Hash)
+	d.seen[sig] = req.Time
+	return
+}
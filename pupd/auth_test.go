@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+func TestAuthenticate(t *testing.T) {
+	d := &Dispatcher{}
+	d.init()
+	id, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+
+	req := pup.NewRegisterRequest(UPPER, id, time.Now())
+	err = d.authenticate(req)
+	Tassert(t, err == nil, "authenticate: %v", err)
+	err = d.authenticate(req)
+	Tassert(t, errors.Is(err, syscall.EACCES), "replay: %v", err)
+	err = d.authenticate(pup.NewRegisterRequest(UPPER, id, time.Now().Add(-2*pup.MaxSkew)))
+	Tassert(t, errors.Is(err, syscall.EACCES), "stale: %v", err)
+	forged := pup.NewRegisterRequest(UPPER, id, time.Now())
+	forged.Hash = ADD
+	err = d.authenticate(forged)
+	Tassert(t, errors.Is(err, syscall.EACCES), "forged: %v", err)
+
+	err = d.authenticate(&pup.RegisterRequest{Hash: UPPER, Name: "peer"})
+	Tassert(t, err == nil, "unsigned: %v", err)
+	err = d.authenticate(&pup.RegisterRequest{Hash: UPPER, Name: id.Addr})
+	Tassert(t, errors.Is(err, syscall.EACCES), "unsigned participant: %v", err)
+	d.RequireSigned = true
+	err = d.authenticate(&pup.RegisterRequest{Hash: UPPER, Name: "peer"})
+	Tassert(t, errors.Is(err, syscall.EACCES), "unsigned when required: %v", err)
+}
+
+func TestSignedRegistration(t *testing.T) {
+	d := &Dispatcher{RequireSigned: true}
+	go func() {
+		err := d.Dispatch("127.0.0.1", 10854)
+		Tassert(t, err == nil, "Dispatch: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	addr := "127.0.0.1:10854"
+
+	// unsigned registrations are closed without a stream
+	conn, err := (&pup.Client{Addr: addr}).Register(UPPER)
+	Tassert(t, err == nil, "Register: %v", err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	Tassert(t, err == io.EOF, "unsigned registration: %v", err)
+	conn.Close()
+
+	id, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	signed := &pup.Client{Addr: addr, Identity: id}
+	name := registerPeer(t, signed, UPPER, bytes.ToUpper)
+	Tassert(t, name != "", "no peer")
+	time.Sleep(100 * time.Millisecond)
+	out := &bytes.Buffer{}
+	err = signed.Call(UPPER, bytes.NewReader([]byte("signed")), out)
+	Tassert(t, err == nil && out.String() == "SIGNED", "Call: %v '%s'", err, out)
+}
+
+func TestTokenRegistration(t *testing.T) {
+	root, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	d := &Dispatcher{}
+	err = d.Configure(&Config{Authorities: []string{root.Addr}})
+	Tassert(t, err == nil, "Configure: %v", err)
+	go func() {
+		err := d.Dispatch("127.0.0.1", 10856)
+		Tassert(t, err == nil, "Dispatch: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	addr := "127.0.0.1:10856"
+	expires := time.Now().Add(time.Hour)
+	client := func(ops ...string) *pup.Client {
+		id, err := pup.NewIdentity()
+		Tassert(t, err == nil, "NewIdentity: %v", err)
+		return &pup.Client{Addr: addr, Identity: id, Capabilities: []*pup.Capability{
+			root.Grant(id.Addr, ops, []string{UPPER}, expires)}}
+	}
+
+	// a peer that may only call the hash can't register it
+	caller := client("call")
+	conn, err := caller.Register(UPPER)
+	Tassert(t, err == nil, "Register: %v", err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	Tassert(t, err == io.EOF, "registration without the capability: %v", err)
+	conn.Close()
+
+	registerPeer(t, client("register"), UPPER, bytes.ToUpper)
+	time.Sleep(100 * time.Millisecond)
+	out := &bytes.Buffer{}
+	err = caller.Call(UPPER, bytes.NewReader([]byte("token")), out)
+	Tassert(t, err == nil && out.String() == "TOKEN", "Call: %v '%s'", err, out)
+
+	// 9P would bypass the tokens
+	err = d.Serve9P("unix", filepath.Join(t.TempDir(), "pupd.9p"))
+	Tassert(t, errors.Is(err, syscall.EACCES), "Serve9P: %v", err)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+)
+
+// Config is pupd's configuration file, in JSON:
+//
+//	{
+//	    "host": "127.0.0.1",
+//	    "port": 10840,
+//	    "9p": {"network": "unix", "addr": "/tmp/pupd.9p"},
+//	    "lambdas": [
+//	        {"manifest": "/etc/pup/resize.manifest"},
+//	        {
+//	            "hash": "sha256:...",
+//	            "language": "python3",
+//	            "entrypoint": "/usr/local/lib/pup/handler.py",
+//	            "args": ["-v"],
+//	            "timeout": "30s"
+//	        }
+//	    ],
+//	    "consensus": [
+//	        {"hash": "sha256:...", "quorum": 3, "tiebreak": "lowest"}
+//	    ],
+//	    "vectors": "quarantine",
+//	    "requireSigned": true,
+//	    "authorities": ["ed25519:..."],
+//	    "limits": [
+//	        {"hash": "*", "rate": 100, "concurrency": 16, "bytes": 1048576},
+//	        {"ip": "192.0.2.7", "rate": 1, "burst": 5}
+//	    ],
+//	    "timeouts": {"header": "10s", "idle": "1m", "max": "10m"}
+//	}
+type Config struct {
+	Host    string         `json:"host"`
+	Port    int            `json:"port"`
+	Ninep   *NinepConfig   `json:"9p"`
+	Lambdas []LambdaConfig `json:"lambdas"`
+	// Consensus sets the policies for hashes that several peers
+	// implement.
+	Consensus []ConsensusConfig `json:"consensus"`
+	// Vectors says what to do with peers that fail a hash's test
+	// vectors: "refuse", the default, or "quarantine".
+	Vectors string `json:"vectors"`
+	// RequireSigned refuses unsigned registrations.
+	RequireSigned bool `json:"requireSigned"`
+	// Authorities, if set, are the participants whose capabilities
+	// pupd accepts; every stream must then present a token rooted at
+	// one of them, and pupd won't serve 9P.  See
+	// pup.Server.RequireTokens.
+	Authorities []string `json:"authorities"`
+	// Limits bound the streams of lambda hashes, peers and source
+	// addresses.
+	Limits []LimitConfig `json:"limits"`
+	// Timeouts bound how long streams may take.
+	Timeouts *TimeoutsConfig `json:"timeouts"`
+}
+
+// TimeoutsConfig sets pup.Server's HeaderTimeout, IdleTimeout and
+// MaxDuration, as time.ParseDuration strings.  Registrations and
+// subscriptions are exempt from the idle and maximum timeouts.
+type TimeoutsConfig struct {
+	Header string `json:"header"`
+	Idle   string `json:"idle"`
+	Max    string `json:"max"`
+}
+
+// NinepConfig says where to serve the grid filesystem.
+type NinepConfig struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+// LambdaConfig describes the code behind a lambda hash, either in a
+// manifest file or inline; see pup.Manifest.  The other fields
+// configure executables and scripts, see pup.Command, and wasm
+// modules.
+type LambdaConfig struct {
+	Manifest   string `json:"manifest"`
+	Hash       string `json:"hash"`
+	Language   string `json:"language"`
+	Entrypoint string `json:"entrypoint"`
+
+	Args []string `json:"args"`
+	Dir  string   `json:"dir"`
+	Env  []string `json:"env"`
+	// Timeout is a time.ParseDuration string.
+	Timeout string `json:"timeout"`
+	// MemoryPages limits a wasm module's memory.
+	MemoryPages uint32 `json:"memoryPages"`
+}
+
+// ConsensusConfig is the consensus policy for one hash; see
+// pup.Policy.  TieBreak is "fail", the default, "first" or "lowest".
+type ConsensusConfig struct {
+	Hash     string `json:"hash"`
+	Quorum   int    `json:"quorum"`
+	TieBreak string `json:"tiebreak"`
+}
+
+// LimitConfig is a pup.Limit on the streams of one lambda hash,
+// participant or source IP address; exactly one of Hash, Peer and IP
+// is set.  Any of them may be "*" to limit each hash, participant or
+// address that has no limit of its own.
+type LimitConfig struct {
+	Hash        string  `json:"hash"`
+	Peer        string  `json:"peer"`
+	IP          string  `json:"ip"`
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+	Concurrency int     `json:"concurrency"`
+	Bytes       int64   `json:"bytes"`
+}
+
+// Set sets the limit lc describes on server.
+func (lc *LimitConfig) Set(server *pup.Server) (err error) {
+	defer Return(&err)
+	var kinds []pup.LimitKind
+	var key string
+	for kind, k := range []string{lc.Hash, lc.Peer, lc.IP} {
+		if k != "" {
+			kinds = append(kinds, pup.LimitKind(kind))
+			key = k
+		}
+	}
+	ErrnoIf(len(kinds) != 1, syscall.EINVAL, "a limit needs one of hash, peer and ip")
+	server.SetLimit(kinds[0], key, pup.Limit{Rate: lc.Rate, Burst: lc.Burst, Concurrency: lc.Concurrency, Bytes: lc.Bytes})
+	return
+}
+
+// Policy returns the pup.Policy cc describes.
+func (cc *ConsensusConfig) Policy() (policy pup.Policy, err error) {
+	defer Return(&err)
+	policy.Quorum = cc.Quorum
+	if cc.TieBreak != "" {
+		policy.TieBreak, err = pup.ParseTieBreak(cc.TieBreak)
+		Ck(err)
+	}
+	return
+}
+
+// LoadConfig reads the configuration file at path.
+func LoadConfig(path string) (cfg *Config, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(path)
+	Ck(err)
+	cfg = &Config{}
+	err = json.Unmarshal(buf, cfg)
+	Ck(err)
+	return
+}
+
+// Register verifies the code lc describes and registers it on
+// server.
+func (lc *LambdaConfig) Register(server *pup.Server) (err error) {
+	defer Return(&err)
+	m := &pup.Manifest{Hash: lc.Hash, Language: lc.Language, Entrypoint: lc.Entrypoint}
+	if lc.Manifest != "" {
+		m, err = pup.LoadManifest(lc.Manifest)
+		Ck(err)
+	}
+	ErrnoIf(m.Hash == "" || m.Language == "" || m.Entrypoint == "", syscall.EINVAL,
+		"lambda needs a manifest, or hash, language and entrypoint")
+	cmd := pup.Command{Args: lc.Args, Dir: lc.Dir, Env: lc.Env}
+	limits := pup.WasmLimits{MemoryPages: lc.MemoryPages}
+	if lc.Timeout != "" {
+		cmd.Timeout, err = time.ParseDuration(lc.Timeout)
+		Ck(err)
+		limits.Timeout = cmd.Timeout
+	}
+	err = server.RegisterManifest(m, cmd, limits)
+	Ck(err)
+	return
+}
+
+// Configure registers the lambdas in cfg and sets its consensus,
+// test vector and access policies, its limits and its timeouts.
+func (d *Dispatcher) Configure(cfg *Config) (err error) {
+	defer Return(&err)
+	d.init()
+	d.RequireSigned = cfg.RequireSigned
+	switch cfg.Vectors {
+	case "", "refuse":
+	case "quarantine":
+		d.Quarantine = true
+	default:
+		return pup.Error{Errno: syscall.EINVAL, Msg: Spf("unknown vectors policy %q", cfg.Vectors)}
+	}
+	for _, a := range cfg.Authorities {
+		_, err = pup.ParticipantKey(a)
+		Ck(err)
+	}
+	if len(cfg.Authorities) > 0 {
+		d.server.RequireTokens(cfg.Authorities...)
+	}
+	for _, lc := range cfg.Lambdas {
+		err = lc.Register(d.server)
+		Ck(err)
+	}
+	for _, lc := range cfg.Limits {
+		err = lc.Set(d.server)
+		Ck(err)
+	}
+	if tc := cfg.Timeouts; tc != nil {
+		for _, t := range []struct {
+			s string
+			d *time.Duration
+		}{{tc.Header, &d.server.HeaderTimeout}, {tc.Idle, &d.server.IdleTimeout}, {tc.Max, &d.server.MaxDuration}} {
+			if t.s != "" {
+				*t.d, err = time.ParseDuration(t.s)
+				Ck(err)
+			}
+		}
+	}
+	for _, cc := range cfg.Consensus {
+		policy, err := cc.Policy()
+		Ck(err)
+		err = d.SetPolicy(cc.Hash, policy)
+		Ck(err)
+	}
+	return
+}
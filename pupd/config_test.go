@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "rev.sh")
+	err := os.WriteFile(script, []byte("rev\n"), 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+	m, err := pup.NewManifest("sh", script)
+	Tassert(t, err == nil, "NewManifest: %v", err)
+	manifest := filepath.Join(dir, "rev.manifest")
+	err = os.WriteFile(manifest, m.Encode(), 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+
+	path := filepath.Join(dir, "pupd.json")
+	err = os.WriteFile(path, []byte(Spf(`{
+		"port": 10846,
+		"lambdas": [
+			{"manifest": %q, "timeout": "5s"},
+			{"hash": "sha256:wrong", "language": "sh", "entrypoint": %q}
+		]
+	}`, manifest, script)), 0644)
+	Tassert(t, err == nil, "WriteFile: %v", err)
+
+	cfg, err := LoadConfig(path)
+	Tassert(t, err == nil, "LoadConfig: %v", err)
+	Tassert(t, cfg.Port == 10846 && cfg.Ninep == nil && len(cfg.Lambdas) == 2, "cfg %v", cfg)
+
+	// the second lambda's hash doesn't match its code
+	d := &Dispatcher{}
+	err = d.Configure(cfg)
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "Configure: %v", err)
+	lambda := d.server.Dereference(m.Hash)
+	Tassert(t, lambda != nil, "not registered")
+	s := &memStream{Reader: strings.NewReader("abc\n")}
+	err = lambda([]byte(m.Hash), s)
+	Tassert(t, err == nil, "lambda: %v", err)
+	Tassert(t, s.out.String() == "cba\n", "got '%s'", s.out.String())
+
+	err = d.Configure(&Config{Lambdas: []LambdaConfig{{Hash: "sha256:x"}}})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "err %v", err)
+
+	err = d.Configure(&Config{Vectors: "quarantine"})
+	Tassert(t, err == nil && d.Quarantine, "quarantine: %v", err)
+	err = d.Configure(&Config{Vectors: "ignore"})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "err %v", err)
+	err = d.Configure(&Config{Authorities: []string{"alice"}})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "err %v", err)
+	err = d.Configure(&Config{Limits: []LimitConfig{{Hash: "*", Concurrency: 1}}})
+	Tassert(t, err == nil, "limits: %v", err)
+	err = d.Configure(&Config{Limits: []LimitConfig{{Hash: "*", IP: "*", Rate: 1}}})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "err %v", err)
+	err = d.Configure(&Config{Timeouts: &TimeoutsConfig{Header: "2s", Max: "1m"}})
+	Tassert(t, err == nil && d.server.HeaderTimeout == 2*time.Second && d.server.MaxDuration == time.Minute &&
+		d.server.IdleTimeout == 0, "timeouts: %v", err)
+	err = d.Configure(&Config{Timeouts: &TimeoutsConfig{Idle: "soon"}})
+	Tassert(t, err != nil, "bad timeout accepted")
+}
+
+// memStream reads from Reader and collects writes in out.
+type memStream struct {
+	io.Reader
+	out bytes.Buffer
+}
+
+func (m *memStream) Write(buf []byte) (int, error) { return m.out.Write(buf) }
+func (m *memStream) Close() error                  { return nil }
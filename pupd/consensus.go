@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+)
+
+// registration is a peer waiting for a stream.  Each registration
+// serves one stream; the peer registers again to serve another.
+type registration struct {
+	name string
+	req  *pup.RegisterRequest
+	conn io.ReadWriteCloser
+	done chan struct{}
+	// err is why the registration was ended without serving, if it
+	// was
+	err error
+}
+
+// serve proxies stream to the peer and releases its registration.
+// If the stream's context ends first, for instance because the stream
+// timed out, the peer's connection is closed to stop the proxy.
+func (p *registration) serve(hash []byte, stream io.ReadWriteCloser) error {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-pup.ContextOf(stream).Done():
+			p.conn.Close()
+		case <-finished:
+		}
+	}()
+	proxy(stream, p.conn)
+	close(finished)
+	close(p.done)
+	return nil
+}
+
+// offer queues p to serve the next stream for hash, once its request
+// has claimed the hash or been found to need no claim; see claim.
+// Several peers can register the same hash: a hash with a consensus
+// policy is sent to a quorum of them, any other hash to the peer that
+// has waited longest.
+func (d *Dispatcher) offer(hash string, p *registration) (err error) {
+	if p.req != nil {
+		err = d.claim(p.req, true)
+		if err != nil {
+			return
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.peers[hash]; !ok {
+		d.server.Register(hash, d.route)
+	}
+	d.peers[hash] = append(d.peers[hash], p)
+	d.cond.Broadcast()
+	return
+}
+
+// withdraw removes p from the peers queued or parked for hash, if it
+// is still there.
+func (d *Dispatcher) withdraw(hash string, p *registration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.unpark(hash, p)
+	queue := d.peers[hash]
+	for i, q := range queue {
+		if q == p {
+			d.peers[hash] = append(append([]*registration{}, queue[:i]...), queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// take dequeues n of the peers registered for hash, waiting up to
+// d.Wait for them to register.
+func (d *Dispatcher) take(hash string, n int) (peers []*registration, err error) {
+	wait := d.Wait
+	if wait == 0 {
+		wait = 5 * time.Second
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	timedOut := false
+	timer := time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		timedOut = true
+		d.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for len(d.peers[hash]) < n && !timedOut {
+		d.cond.Wait()
+	}
+	queue := d.peers[hash]
+	if len(queue) < n {
+		return nil, pup.Error{Errno: syscall.EAGAIN, Msg: Spf("%s: want %d peers, have %d", hash, n, len(queue))}
+	}
+	peers = append(peers, queue[:n]...)
+	d.peers[hash] = append([]*registration{}, queue[n:]...)
+	return
+}
+
+// route is the lambda for every hash peers register.
+func (d *Dispatcher) route(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	d.mu.Lock()
+	policy, ok := d.policies[string(hash)]
+	d.mu.Unlock()
+	if !ok {
+		peers, err := d.take(string(hash), 1)
+		Ck(err)
+		return peers[0].serve(hash, stream)
+	}
+	peers, err := d.take(string(hash), policy.Quorum)
+	Ck(err)
+	var impls []pup.Implementation
+	for _, p := range peers {
+		impls = append(impls, pup.Implementation{Name: p.name, Lambda: p.serve})
+	}
+	return pup.Consensus(impls, policy, d.report)(hash, stream)
+}
+
+// SetPolicy makes calls to hash run on policy.Quorum of the peers
+// registered for it.  Outcomes with dissenters or without consensus
+// are published on ConsensusTopic(hash).
+func (d *Dispatcher) SetPolicy(hash string, policy pup.Policy) (err error) {
+	defer Return(&err)
+	d.init()
+	ErrnoIf(policy.Quorum < 1, syscall.EINVAL, "%s: quorum must be at least 1", hash)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.policies[hash] = policy
+	return
+}
+
+// ConsensusTopic returns the topic that flags disagreement about
+// hash: "sha256:ab12..." reports on "/consensus/sha256/ab12...".
+func ConsensusTopic(hash string) string {
+	return "/consensus/" + strings.Replace(hash, ":", "/", 1)
+}
+
+func (d *Dispatcher) report(outcome *pup.Outcome) {
+	if outcome.Result != "" && len(outcome.Dissenters()) == 0 {
+		return
+	}
+	_, err := d.server.Publish(ConsensusTopic(outcome.Hash), outcome.Encode())
+	if err != nil {
+		Pl("publishing consensus outcome:", err)
+	}
+}
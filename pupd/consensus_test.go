@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+const ADD = "sha256:add0"
+
+// registerPeer registers a peer for hash that answers one stream with
+// reply(input), and returns the peer's name.
+func registerPeer(t *testing.T, c *pup.Client, hash string, reply func([]byte) []byte) string {
+	conn, err := c.Register(hash)
+	Tassert(t, err == nil, "Register: %v", err)
+	go func() {
+		defer conn.Close()
+		in, err := io.ReadAll(conn)
+		Tassert(t, err == nil, "ReadAll: %v", err)
+		conn.Write(reply(in))
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestConsensus(t *testing.T) {
+	d := &Dispatcher{Wait: 200 * time.Millisecond}
+	go func() {
+		err := d.Dispatch("127.0.0.1", 10850)
+		Tassert(t, err == nil, "Dispatch: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	c := &pup.Client{Addr: "127.0.0.1:10850"}
+	call := func(hash, input string) (string, error) {
+		out := &bytes.Buffer{}
+		err := c.Call(hash, strings.NewReader(input), out)
+		return out.String(), err
+	}
+
+	// without a policy, peers registered for the same hash take
+	// turns instead of replacing each other
+	registerPeer(t, c, ADD, bytes.ToUpper)
+	registerPeer(t, c, ADD, bytes.ToLower)
+	time.Sleep(100 * time.Millisecond)
+	out1, err := call(ADD, "MiXed")
+	Tassert(t, err == nil, "call: %v", err)
+	out2, err := call(ADD, "MiXed")
+	Tassert(t, err == nil, "call: %v", err)
+	Tassert(t, out1 == "MIXED" && out2 == "mixed", "got '%s' '%s'", out1, out2)
+
+	err = d.SetPolicy(ADD, pup.Policy{Quorum: 3})
+	Tassert(t, err == nil, "SetPolicy: %v", err)
+	sub, err := d.server.Subscribe(ConsensusTopic(ADD))
+	Tassert(t, err == nil, "Subscribe: %v", err)
+	defer sub.Close()
+
+	// the majority answer wins and the dissenter is flagged
+	registerPeer(t, c, ADD, bytes.ToUpper)
+	dissenter := registerPeer(t, c, ADD, func([]byte) []byte { return []byte("bogus") })
+	registerPeer(t, c, ADD, bytes.ToUpper)
+	time.Sleep(100 * time.Millisecond)
+	out, err := call(ADD, "abc")
+	Tassert(t, err == nil && out == "ABC", "call: %v '%s'", err, out)
+	select {
+	case msg := <-sub.C:
+		want := Spf("vote %s %s\n", pup.Address([]byte("bogus")), dissenter)
+		Tassert(t, strings.Contains(string(msg.Body), want), "report\n%s", msg.Body)
+		Tassert(t, strings.Contains(string(msg.Body), "result "+pup.Address([]byte("ABC"))+"\n"), "report\n%s", msg.Body)
+	case <-time.After(time.Second):
+		t.Fatal("no consensus report")
+	}
+
+	// too few peers for the quorum
+	registerPeer(t, c, ADD, bytes.ToUpper)
+	time.Sleep(100 * time.Millisecond)
+	_, err = d.take(ADD, 3)
+	Tassert(t, errors.Is(err, syscall.EAGAIN), "take: %v", err)
+
+	err = d.SetPolicy(ADD, pup.Policy{})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "SetPolicy: %v", err)
+}
+
+func TestConsensusConfig(t *testing.T) {
+	d := &Dispatcher{}
+	err := d.Configure(&Config{Consensus: []ConsensusConfig{{Hash: ADD, Quorum: 2, TieBreak: "lowest"}}})
+	Tassert(t, err == nil, "Configure: %v", err)
+	Tassert(t, d.policies[ADD] == pup.Policy{Quorum: 2, TieBreak: pup.TieLowest}, "policy %v", d.policies[ADD])
+	err = d.Configure(&Config{Consensus: []ConsensusConfig{{Hash: ADD, Quorum: 2, TieBreak: "coin"}}})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "Configure: %v", err)
+}
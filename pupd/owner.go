@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sort"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+)
+
+// AuditTopic is where pupd publishes every change of ownership of a
+// registered hash, and every registration refused because of one.
+// Each message body holds "event", "hash", "owner" and "peer" lines,
+// and an "error" line for refusals.  The events are "claim",
+// "transfer", "disown" and "refuse".
+const AuditTopic = "/audit/registrations"
+
+// claim decides whether the peer that sent req may register its hash.
+// Hashes pupd serves itself, such as REGISTER and the lambdas in its
+// configuration, can't be registered at all.  Otherwise the first
+// signed registration of a hash makes its participant the owner, and
+// from then on the hash may only be registered by the owner, or by
+// peers whose requests the owner co-signed; see pup.CoSign.  Unsigned
+// registrations never own a hash, and are refused once it has an
+// owner.
+//
+// The registrar calls claim before it admits a registration, to refuse
+// it early, and offer calls it again with admitted set; only then does
+// a signed registration of an unowned hash claim it.  A peer that
+// fails the hash's test vectors never gets that far, so it can't
+// squat on the hash.  Registrations already queued for the hash that
+// the new owner doesn't allow are ended with EACCES.
+func (d *Dispatcher) claim(req *pup.RegisterRequest, admitted bool) (err error) {
+	d.mu.Lock()
+	_, routed := d.peers[req.Hash]
+	owner, owned := d.owners[req.Hash]
+	switch {
+	case !routed && d.server.Dereference(req.Hash) != nil:
+		err = pup.Error{Errno: syscall.EEXIST, Msg: req.Hash + " is served by pupd"}
+	case !owned && len(req.Sig) > 0 && admitted:
+		d.owners[req.Hash] = req.Name
+		evicted := d.evict(req.Hash, req.Name)
+		d.mu.Unlock()
+		d.audit("claim", req.Hash, req.Name, req.Name, nil)
+		d.end(req.Hash, req.Name, evicted)
+		return
+	case !owned:
+	default:
+		err = allowed(req.Hash, req, owner)
+	}
+	d.mu.Unlock()
+	if err != nil {
+		d.audit("refuse", req.Hash, owner, req.Name, err)
+	}
+	return
+}
+
+// allowed returns an Error with EACCES unless owner lets the peer that
+// sent req register its hash: req must be signed, and either come from
+// owner or be co-signed by it.  A nil req is unsigned.
+func allowed(hash string, req *pup.RegisterRequest, owner string) error {
+	if req == nil || len(req.Sig) == 0 {
+		return pup.Error{Errno: syscall.EACCES, Msg: Spf("unsigned registration for %s, owned by %s", hash, owner)}
+	}
+	if req.Name == owner {
+		return nil
+	}
+	return req.VerifyCoSig(owner)
+}
+
+// evict removes the registrations queued for hash that owner doesn't
+// allow, and returns them.  The caller holds d.mu.
+func (d *Dispatcher) evict(hash, owner string) (evicted []*registration) {
+	var kept []*registration
+	for _, p := range d.peers[hash] {
+		p.err = allowed(hash, p.req, owner)
+		if p.err != nil {
+			evicted = append(evicted, p)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	if len(evicted) > 0 {
+		d.peers[hash] = kept
+	}
+	return
+}
+
+// end ends the registrations evict removed, and audits each refusal.
+func (d *Dispatcher) end(hash, owner string, evicted []*registration) {
+	for _, p := range evicted {
+		d.audit("refuse", hash, owner, p.name, p.err)
+		close(p.done)
+	}
+}
+
+// Owner returns the participant that owns hash, or "" if it has no
+// owner.
+func (d *Dispatcher) Owner(hash string) string {
+	d.init()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.owners[hash]
+}
+
+// Owners returns the hashes that have owners, sorted.
+func (d *Dispatcher) Owners() (hashes []string) {
+	d.init()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for hash := range d.owners {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return
+}
+
+// SetOwner hands hash to the participant owner, or leaves it without
+// an owner if owner is "", so that the next signed registration
+// claims it.  Peers the old owner co-signed lose their consent, and
+// their queued registrations are ended like those of other peers the
+// new owner doesn't allow.
+func (d *Dispatcher) SetOwner(hash, owner string) (err error) {
+	defer Return(&err)
+	d.init()
+	event := "transfer"
+	if owner == "" {
+		event = "disown"
+	} else {
+		_, err = pup.ParticipantKey(owner)
+		Ck(err)
+	}
+	var evicted []*registration
+	d.mu.Lock()
+	old := d.owners[hash]
+	if owner == "" {
+		delete(d.owners, hash)
+	} else {
+		d.owners[hash] = owner
+		evicted = d.evict(hash, owner)
+	}
+	d.mu.Unlock()
+	if old != owner {
+		d.audit(event, hash, owner, old, nil)
+	}
+	d.end(hash, owner, evicted)
+	return
+}
+
+// audit publishes an event on AuditTopic.  For a transfer or disown,
+// peer is the previous owner.
+func (d *Dispatcher) audit(event, hash, owner, peer string, reason error) {
+	body := Spf("event %s\nhash %s\nowner %s\npeer %s\n", event, hash, owner, peer)
+	if reason != nil {
+		body += Spf("error %v\n", reason)
+	}
+	_, err := d.server.Publish(AuditTopic, []byte(body))
+	if err != nil {
+		Pl("publishing audit event:", err)
+	}
+}
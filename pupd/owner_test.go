@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+func TestClaim(t *testing.T) {
+	d := &Dispatcher{}
+	d.init()
+	owner, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	other, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	req := func(id *pup.Identity) *pup.RegisterRequest {
+		return pup.NewRegisterRequest(UPPER, id, time.Now())
+	}
+
+	// unsigned registrations of an unowned hash don't claim it
+	err = d.claim(&pup.RegisterRequest{Hash: UPPER, Name: "peer"}, true)
+	Tassert(t, err == nil && d.Owner(UPPER) == "", "unsigned: %v %q", err, d.Owner(UPPER))
+
+	// the first signed registration does, once it is admitted
+	err = d.claim(req(owner), false)
+	Tassert(t, err == nil && d.Owner(UPPER) == "", "before admission: %v %q", err, d.Owner(UPPER))
+	err = d.claim(req(owner), true)
+	Tassert(t, err == nil && d.Owner(UPPER) == owner.Addr, "claim: %v %q", err, d.Owner(UPPER))
+	err = d.claim(req(owner), true)
+	Tassert(t, err == nil, "owner: %v", err)
+	err = d.claim(req(other), true)
+	Tassert(t, errors.Is(err, syscall.EACCES), "hijack: %v", err)
+	err = d.claim(&pup.RegisterRequest{Hash: UPPER, Name: "peer"}, true)
+	Tassert(t, errors.Is(err, syscall.EACCES), "unsigned: %v", err)
+
+	// the owner can consent to another peer
+	cosigned := req(other)
+	cosigned.CoSig = pup.CoSign(owner, UPPER, other.Addr)
+	parsed, err := pup.ParseRegisterRequest(cosigned.Encode())
+	Tassert(t, err == nil, "ParseRegisterRequest: %v", err)
+	err = d.claim(parsed, true)
+	Tassert(t, err == nil, "co-signed: %v", err)
+	forged := req(other)
+	forged.CoSig = pup.CoSign(other, UPPER, other.Addr)
+	err = d.claim(forged, true)
+	Tassert(t, errors.Is(err, syscall.EACCES), "self co-signed: %v", err)
+
+	err = d.claim(pup.NewRegisterRequest(REGISTER, owner, time.Now()), true)
+	Tassert(t, errors.Is(err, syscall.EEXIST), "pupd's own hash: %v", err)
+
+	err = d.SetOwner(UPPER, other.Addr)
+	Tassert(t, err == nil, "SetOwner: %v", err)
+	err = d.claim(req(owner), true)
+	Tassert(t, errors.Is(err, syscall.EACCES), "old owner: %v", err)
+	err = d.SetOwner(UPPER, "alice")
+	Tassert(t, errors.Is(err, syscall.EINVAL), "SetOwner: %v", err)
+	err = d.SetOwner(UPPER, "")
+	Tassert(t, err == nil && len(d.Owners()) == 0, "disown: %v %v", err, d.Owners())
+
+	var events []string
+	log, err := d.server.Log(d.server.Head(AuditTopic).Addr())
+	Tassert(t, err == nil, "Log: %v", err)
+	for _, msg := range log {
+		events = append(events, strings.TrimPrefix(strings.Split(string(msg.Body), "\n")[0], "event "))
+	}
+	want := "claim refuse refuse refuse refuse transfer refuse disown"
+	Tassert(t, strings.Join(events, " ") == want, "events %v", events)
+}
+
+func TestEvict(t *testing.T) {
+	d := &Dispatcher{}
+	d.init()
+	owner, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	other, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	queue := func(req *pup.RegisterRequest) *registration {
+		p := &registration{name: req.Name, req: req, done: make(chan struct{})}
+		err := d.offer(UPPER, p)
+		Tassert(t, err == nil, "offer: %v", err)
+		return p
+	}
+	ended := func(p *registration) bool {
+		select {
+		case <-p.done:
+			return errors.Is(p.err, syscall.EACCES)
+		default:
+			return false
+		}
+	}
+
+	// claiming a hash ends the queued registrations the owner
+	// doesn't allow
+	unsigned := queue(&pup.RegisterRequest{Hash: UPPER, Name: "peer"})
+	mine := queue(pup.NewRegisterRequest(UPPER, owner, time.Now()))
+	Tassert(t, ended(unsigned), "unsigned registration still queued")
+	Tassert(t, !ended(mine), "owner's registration ended")
+
+	// a co-signature is no good without the peer's own signature
+	err = d.claim(&pup.RegisterRequest{Hash: UPPER, Name: other.Addr, CoSig: pup.CoSign(owner, UPPER, other.Addr)}, true)
+	Tassert(t, errors.Is(err, syscall.EACCES), "unsigned co-signed: %v", err)
+
+	// so does a transfer
+	cosigned := pup.NewRegisterRequest(UPPER, other, time.Now())
+	cosigned.CoSig = pup.CoSign(owner, UPPER, other.Addr)
+	theirs := queue(cosigned)
+	err = d.SetOwner(UPPER, other.Addr)
+	Tassert(t, err == nil, "SetOwner: %v", err)
+	Tassert(t, ended(mine), "old owner's registration still queued")
+	Tassert(t, !ended(theirs), "new owner's registration ended")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	Tassert(t, len(d.peers[UPPER]) == 1 && d.peers[UPPER][0] == theirs, "queue %v", d.peers[UPPER])
+}
+
+func TestOwnership(t *testing.T) {
+	d := &Dispatcher{}
+	go func() {
+		err := d.Dispatch("127.0.0.1", 10857)
+		Tassert(t, err == nil, "Dispatch: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	addr := "127.0.0.1:10857"
+	owner, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+	other, err := pup.NewIdentity()
+	Tassert(t, err == nil, "NewIdentity: %v", err)
+
+	registerPeer(t, &pup.Client{Addr: addr, Identity: owner}, UPPER, bytes.ToUpper)
+	time.Sleep(100 * time.Millisecond)
+
+	// a registration by someone else is closed without a stream, and
+	// callers still reach the owner
+	conn, err := (&pup.Client{Addr: addr, Identity: other}).Register(UPPER)
+	Tassert(t, err == nil, "Register: %v", err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	Tassert(t, err == io.EOF, "hijack: %v", err)
+	conn.Close()
+	out := &bytes.Buffer{}
+	err = (&pup.Client{Addr: addr}).Call(UPPER, bytes.NewReader([]byte("owned")), out)
+	Tassert(t, err == nil && out.String() == "OWNED", "Call: %v '%s'", err, out)
+
+	// with the owner's co-signature it is accepted
+	cosigned := &pup.Client{Addr: addr, Identity: other,
+		CoSigs: map[string][]byte{UPPER: pup.CoSign(owner, UPPER, other.Addr)}}
+	registerPeer(t, cosigned, UPPER, bytes.ToLower)
+	time.Sleep(100 * time.Millisecond)
+	out.Reset()
+	err = (&pup.Client{Addr: addr}).Call(UPPER, bytes.NewReader([]byte("Owned")), out)
+	Tassert(t, err == nil && out.String() == "owned", "Call: %v '%s'", err, out)
+}
@@ -1,26 +1,158 @@
 package main
 
 import (
+	"flag"
 	"io"
+	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	. "github.com/stevegt/goadapt"
 
 	"github.com/stevegt/pup"
+	"github.com/stevegt/pup/ninep"
 )
 
-const REGISTER = "sha256:c17dcddbc7b307ab652109d2c1a01fdd53890dffcbce3215da41d8104e551b0b"
+const REGISTER = pup.REGISTER
+
+func main() {
+	cfg := &Config{}
+	configPath := flag.String("config", "", "JSON configuration file")
+	host := flag.String("host", "", "address to listen on (default 127.0.0.1)")
+	port := flag.Int("port", 0, "port to listen on (default 10840)")
+	flag.Parse()
+
+	var err error
+	if *configPath != "" {
+		cfg, err = LoadConfig(*configPath)
+		if err != nil {
+			Pl(err)
+			os.Exit(1)
+		}
+	}
+	// flags override the file
+	if *host != "" {
+		cfg.Host = *host
+	}
+	if *port != 0 {
+		cfg.Port = *port
+	}
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 10840
+	}
+
+	d := &Dispatcher{}
+	err = d.Configure(cfg)
+	if err != nil {
+		Pl(err)
+		os.Exit(1)
+	}
+	if cfg.Ninep != nil {
+		go func() {
+			err := d.Serve9P(cfg.Ninep.Network, cfg.Ninep.Addr)
+			Pl(err)
+			os.Exit(1)
+		}()
+	}
+	// end open streams cleanly, stopping their lambdas
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		d.Shutdown()
+	}()
+	err = d.Dispatch(cfg.Host, cfg.Port)
+	if err != nil {
+		Pl(err)
+		os.Exit(1)
+	}
+}
 
 type Dispatcher struct {
-	server pup.Server
+	// Wait is how long a call waits for enough peers to register
+	// its hash.  Zero means 5 seconds.
+	Wait time.Duration
+	// Quarantine parks the registrations of peers that fail a test
+	// vector instead of refusing them; see admit.
+	Quarantine bool
+	// RequireSigned refuses registrations that aren't signed by a
+	// participant; see pup.RegisterRequest.
+	RequireSigned bool
+
+	server *pup.Server
+	once   sync.Once
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	peers    map[string][]*registration
+	policies map[string]pup.Policy
+	trials   map[string]*trial
+	seen     map[string]time.Time
+	owners   map[string]string
+}
+
+func (d *Dispatcher) init() {
+	d.once.Do(func() {
+		d.cond = sync.NewCond(&d.mu)
+		d.peers = make(map[string][]*registration)
+		d.policies = make(map[string]pup.Policy)
+		d.trials = make(map[string]*trial)
+		d.seen = make(map[string]time.Time)
+		d.owners = make(map[string]string)
+		d.server = &pup.Server{}
+		d.server.Register(REGISTER, d.registrar)
+		d.server.RegisterPubSub()
+		d.server.RegisterLookup()
+		d.server.RegisterVectors()
+		// registrations wait for callers, and subscriptions for
+		// messages, as long as they like
+		d.server.SetTimeouts(REGISTER, 0, 0)
+		d.server.SetTimeouts(pup.SUBSCRIBE, 0, 0)
+	})
 }
 
 func (d *Dispatcher) Dispatch(host string, port int) (err error) {
 	defer Return(&err)
-	d.server = pup.Server{}
-	s := d.server
-	s.Register(REGISTER, d.registrar)
-	err = s.Serve(host, port)
+	d.init()
+	err = d.server.Serve(host, port)
+	Ck(err)
+	return
+}
+
+// Shutdown stops dispatching; see pup.Server.Shutdown.
+func (d *Dispatcher) Shutdown() {
+	d.init()
+	d.server.Shutdown()
+}
+
+// Serve9P serves the grid filesystem -- topics, registrations and
+// the chunk cache, see pup.GridFS -- over 9P2000.  network is "tcp"
+// or "unix".  9P can't carry tokens, so Serve9P refuses with EACCES
+// if the server requires them.
+func (d *Dispatcher) Serve9P(network, addr string) (err error) {
+	defer Return(&err)
+	d.init()
+	ErrnoIf(d.server.TokensRequired(), syscall.EACCES, "not serving 9P: it can't carry the tokens the server requires")
+	l, err := net.Listen(network, addr)
+	Ck(err)
+	defer l.Close()
+	Pl("Serving 9P on", network, addr)
+	g := d.server.FS()
+	srv := &ninep.Server{
+		FS: g,
+		OpenFile: func(name string, flag int) (ninep.File, error) {
+			return g.OpenFile(name, flag)
+		},
+		Uid: "pup",
+	}
+	err = srv.Serve(l)
 	Ck(err)
 	return
 }
@@ -34,17 +166,33 @@ func (d *Dispatcher) registrar(hash []byte, peer io.ReadWriteCloser) (err error)
 	line, err := pup.Readline(peer, 1024)
 	Ck(err)
 	parts := strings.Split(string(line), " ")
-	// XXX ensure len(parts) is 2
 	cmd := parts[0]
-	subhash := parts[1]
 	switch cmd {
 	case "a":
-		// make a lambda that routes all streams with hash to peer
-		f := func(subhash []byte, caller io.ReadWriteCloser) (err error) {
-			proxy(caller, peer)
-			return
+		// queue the peer to serve the next stream with the hash,
+		// once it has passed the hash's test vectors
+		req, err := pup.ParseRegisterRequest(string(line))
+		Ck(err)
+		err = d.authenticate(req)
+		Ck(err)
+		err = d.server.Authorize(peer, "register", req.Hash)
+		Ck(err)
+		err = d.claim(req, false)
+		Ck(err)
+		p := &registration{name: req.Name, req: req, conn: peer, done: make(chan struct{})}
+		if conn, ok := peer.(interface{ RemoteAddr() net.Addr }); ok && req.Name == "" && conn.RemoteAddr() != nil {
+			p.name = conn.RemoteAddr().String()
+		}
+		err = d.admit(req.Hash, p)
+		Ck(err)
+		// keep the peer's connection open while it's in use, or
+		// until the stream ends, for instance at shutdown
+		select {
+		case <-p.done:
+			err = p.err
+		case <-pup.ContextOf(peer).Done():
+			d.withdraw(req.Hash, p)
 		}
-		d.server.Register(string(subhash), f)
 	default:
 		Pf("unknown registrar cmd: %s\n", cmd)
 	}
@@ -52,21 +200,24 @@ func (d *Dispatcher) registrar(hash []byte, peer io.ReadWriteCloser) (err error)
 	return
 }
 
-// proxy routes messages between publisher and subscribers
+// proxy routes messages between publisher and subscribers.  It
+// returns when the peer stops sending.
 // XXX or we do use streams instead of messages, and
 // maintain/contract for virtual circuits
 func proxy(caller, peer io.ReadWriteCloser) {
 	// XXX might need to do something more useful with io.Copy errors
-	go func() {
-		_, err := io.Copy(caller, peer)
-		if err != nil {
-			Spf("peer to caller: %v", err)
-		}
-	}()
 	go func() {
 		_, err := io.Copy(peer, caller)
 		if err != nil {
 			Spf("caller to peer: %v", err)
 		}
+		// tell the peer the input is complete
+		if cw, ok := peer.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
 	}()
+	_, err := io.Copy(caller, peer)
+	if err != nil {
+		Spf("peer to caller: %v", err)
+	}
 }
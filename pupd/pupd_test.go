@@ -3,11 +3,13 @@ package main
 import (
 	"io"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
 	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/pup"
+	"github.com/stevegt/pup/ninep"
 )
 
 const port = 10843
@@ -29,22 +31,14 @@ func peer(t *testing.T) (err error) {
 	defer conn.Close()
 
 	// register us as a lambda
-	go func() {
-		_, err := conn.Write([]byte(s1))
-		Tassert(t, err == nil, "conn.Write: %v", err)
-	}()
-	time.Sleep(1 * time.Second)
-	// expect empty output
-	got := make([]byte, 1024)
-	n, err := conn.Read(got)
-	Tassert(t, n == 0, "wanted '' got '%v'", got)
-
-	// verify hash
-	hash, err := pup.Readline(conn, 1024)
+	_, err = conn.Write([]byte(s1))
+	Tassert(t, err == nil, "conn.Write: %v", err)
+
+	// the caller's content arrives without the hash, which pupd
+	// has already read; echo it back
+	content, err := pup.Readline(conn, 1024)
 	Tassert(t, err == nil, "%v", err)
-	Tassert(t, string(hash) == CALLBACK, "wanted '%s' got '%v'", CALLBACK, hash)
-	// echo back the content
-	_, err = io.Copy(conn, conn)
+	_, err = conn.Write(append(content, '\n'))
 	Tassert(t, err == nil, "%v", err)
 	return
 }
@@ -52,17 +46,18 @@ func peer(t *testing.T) (err error) {
 func TestDispatcher(t *testing.T) {
 
 	// start dispatcher
-	d := Dispatcher{}
+	d := &Dispatcher{}
+	d.init()
 	go func() {
 		err := d.Dispatch("127.0.0.1", port)
 		Tassert(t, err == nil, "Dispatcher: %v", err)
 	}()
-	time.Sleep(1 * time.Second)
+	time.Sleep(500 * time.Millisecond)
 
 	// start peer -- this peer will register a lambda that in turn
-	// just echoes back the content of any message sent to it
+	// just echoes back the content of the message sent to it
 	go peer(t)
-	time.Sleep(1 * time.Second)
+	time.Sleep(100 * time.Millisecond)
 
 	// show registration list
 	for k, v := range d.server.Registrations() {
@@ -75,15 +70,96 @@ func TestDispatcher(t *testing.T) {
 	defer conn.Close()
 
 	// send a message to the peer
+	_, err = conn.Write([]byte(s2))
+	Tassert(t, err == nil, "conn.Write: %v", err)
+
+	// verify the response content matches what we sent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := pup.Readline(conn, 1024)
+	Tassert(t, err == nil, "Readline: %v", err)
+	Tassert(t, string(got)+"\n" == s2content, "wanted '%v' got '%v'", s2content, string(got))
+}
+
+func TestServe9P(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "pupd.9p")
+	d := &Dispatcher{}
 	go func() {
-		_, err := conn.Write([]byte(s2))
-		Tassert(t, err == nil, "conn.Write: %v", err)
+		err := d.Serve9P("unix", sock)
+		Tassert(t, err == nil, "Serve9P: %v", err)
 	}()
-	time.Sleep(1 * time.Second)
+	time.Sleep(100 * time.Millisecond)
 
-	// verify the response content matches what we sent
-	got := make([]byte, 1024)
-	n, err := conn.Read(got)
-	Tassert(t, string(got[:n]) == s2content, "wanted '%v' got '%v'", []byte(s2content), got)
+	conn, err := net.Dial("unix", sock)
+	Tassert(t, err == nil, "Dial: %v", err)
+	c, err := ninep.NewClient(conn, "tester")
+	Tassert(t, err == nil, "NewClient: %v", err)
+	defer c.Close()
+
+	msg, err := d.server.Publish("/news", []byte("hello"))
+	Tassert(t, err == nil, "Publish: %v", err)
+
+	// read a message and the chunk behind it
+	buf, err := c.ReadFile("news/" + pup.MessageName(msg))
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == "hello", "got '%s'", buf)
+	buf, err = c.ReadFile(".chunks/" + msg.Addr())
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == string(msg.Encode()), "got '%s'", buf)
+
+	// registrations show up as files
+	entries, err := c.ReadDir(".lambdas")
+	Tassert(t, err == nil, "ReadDir: %v", err)
+	names := map[string]bool{}
+	for _, st := range entries {
+		names[st.Name] = true
+	}
+	Tassert(t, names[REGISTER] && names[pup.PUBLISH], "entries %v", names)
+
+	// creating a file in a topic directory publishes it
+	err = c.WriteFile("news/draft", []byte("extra"))
+	Tassert(t, err == nil, "WriteFile: %v", err)
+	Tassert(t, string(d.server.Head("/news").Body) == "extra", "head %v", d.server.Head("/news"))
+
+	// writing to a lambda's file runs it, and reading returns its reply
+	f, err := c.Open(".lambdas/"+pup.PUBLISH, ninep.ORDWR)
+	Tassert(t, err == nil, "Open: %v", err)
+	_, err = f.Write([]byte("/news 4\nmore"))
+	Tassert(t, err == nil, "Write: %v", err)
+	buf, err = io.ReadAll(f)
+	Tassert(t, err == nil, "ReadAll: %v", err)
+	err = f.Close()
+	Tassert(t, err == nil, "Close: %v", err)
+	head := d.server.Head("/news")
+	Tassert(t, string(head.Body) == "more", "head %v", head)
+	Tassert(t, string(buf) == head.Addr()+"\n", "got '%s'", buf)
+}
 
+func TestShutdown(t *testing.T) {
+	d := &Dispatcher{}
+	go func() {
+		err := d.Dispatch("127.0.0.1", 10862)
+		Tassert(t, err == nil, "Dispatch: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// a peer waits in the queue for a caller that never comes
+	c := &pup.Client{Addr: "127.0.0.1:10862"}
+	conn, err := c.Register(CALLBACK)
+	Tassert(t, err == nil, "Register: %v", err)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		d.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown hung on a queued registration")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	Tassert(t, len(d.peers[CALLBACK]) == 0, "queued peers %v", d.peers[CALLBACK])
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+
+	"github.com/stevegt/pup"
+)
+
+// trial tracks a participant's progress through the test vectors for
+// one hash.
+type trial struct {
+	passed  map[pup.Vector]bool
+	pending map[pup.Vector]bool
+	// failure is the first vector the peer failed
+	failure error
+	// parked holds quarantined registrations
+	parked []*registration
+}
+
+// next returns the vector to test the peer with, or false if it has
+// passed them all.  Vectors already being tested are only repeated if
+// nothing else is left.
+func (tr *trial) next(vectors []pup.Vector) (v pup.Vector, ok bool) {
+	var again []pup.Vector
+	for _, v := range vectors {
+		switch {
+		case tr.passed[v]:
+		case tr.pending[v]:
+			again = append(again, v)
+		default:
+			return v, true
+		}
+	}
+	if len(again) > 0 {
+		return again[0], true
+	}
+	return
+}
+
+// admit decides what to do with registration p for hash.  If test
+// vectors are published for hash (see pup.VectorTopic), a
+// participant's registrations are used to run them, one per
+// registration, until it has passed every one; only then are its
+// registrations offered to callers.  A registration from a participant
+// that failed a vector is refused with the failure, or parked if
+// d.Quarantine is set.  Registrations for a hash with vectors must be
+// signed, so that a peer can't take over another's trial by using its
+// name.
+func (d *Dispatcher) admit(hash string, p *registration) (err error) {
+	defer Return(&err)
+	vectors, err := d.server.Vectors(hash)
+	Ck(err)
+	if len(vectors) == 0 {
+		return d.offer(hash, p)
+	}
+	ErrnoIf(p.req == nil || len(p.req.Sig) == 0, syscall.EACCES, "%s has test vectors; sign the registration", hash)
+	name := p.req.Name
+
+	key := trialKey(hash, name)
+	d.mu.Lock()
+	tr := d.trials[key]
+	if tr == nil {
+		tr = &trial{passed: make(map[pup.Vector]bool), pending: make(map[pup.Vector]bool)}
+		d.trials[key] = tr
+	}
+	if tr.failure != nil {
+		defer d.mu.Unlock()
+		if d.Quarantine {
+			tr.parked = append(tr.parked, p)
+			return
+		}
+		return tr.failure
+	}
+	v, ok := tr.next(vectors)
+	if !ok {
+		d.mu.Unlock()
+		return d.offer(hash, p)
+	}
+	tr.pending[v] = true
+	d.mu.Unlock()
+
+	err = d.server.CheckVector(hash, p.serve, v)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(tr.pending, v)
+	if err != nil {
+		Pl("peer", name, "failed:", err)
+		if tr.failure == nil {
+			tr.failure = err
+		}
+		return
+	}
+	tr.passed[v] = true
+	return
+}
+
+// trialKey returns the key of participant's trial for hash in
+// d.trials.
+func trialKey(hash, participant string) string {
+	return hash + " " + participant
+}
+
+// unpark drops p from the registrations parked for hash, if it is
+// there.  The caller holds d.mu.
+func (d *Dispatcher) unpark(hash string, p *registration) {
+	if p.req == nil {
+		return
+	}
+	tr := d.trials[trialKey(hash, p.req.Name)]
+	if tr == nil {
+		return
+	}
+	for i, q := range tr.parked {
+		if q == p {
+			tr.parked = append(append([]*registration{}, tr.parked[:i]...), tr.parked[i+1:]...)
+			return
+		}
+	}
+}
+
+// Quarantined returns the "<hash> <participant>" pairs of the
+// participants that failed a test vector, sorted.
+func (d *Dispatcher) Quarantined() (keys []string) {
+	d.init()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, tr := range d.trials {
+		if tr.failure != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+// Release forgives a participant that failed a test vector for hash:
+// it is tested again from scratch, starting with its parked
+// registrations whose streams are still open.
+func (d *Dispatcher) Release(hash, participant string) {
+	d.init()
+	key := trialKey(hash, participant)
+	d.mu.Lock()
+	tr := d.trials[key]
+	delete(d.trials, key)
+	d.mu.Unlock()
+	if tr == nil {
+		return
+	}
+	for _, p := range tr.parked {
+		if pup.ContextOf(p.conn).Err() != nil {
+			continue
+		}
+		go func(p *registration) {
+			err := d.admit(hash, p)
+			if err != nil {
+				Pl("peer", participant, "refused:", err)
+				p.err = err
+				close(p.done)
+			}
+		}(p)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+const UPPER = "sha256:0f"
+
+func TestVectors(t *testing.T) {
+	d := &Dispatcher{Wait: 200 * time.Millisecond}
+	go func() {
+		err := d.Dispatch("127.0.0.1", 10852)
+		Tassert(t, err == nil, "Dispatch: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	addr := "127.0.0.1:10852"
+	c := &pup.Client{Addr: addr}
+	_, err := c.AddVector(UPPER, []byte("abc"), []byte("ABC"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+	_, err = c.AddVector(UPPER, []byte("x"), []byte("X"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+
+	// refused registrations are closed without a stream
+	refused := func(c *pup.Client) bool {
+		conn, err := c.Register(UPPER)
+		Tassert(t, err == nil, "Register: %v", err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(make([]byte, 1))
+		return n == 0 && err == io.EOF
+	}
+	Tassert(t, refused(c), "unsigned registration accepted")
+	Tassert(t, refused(&pup.Client{Addr: addr, Name: "good"}), "named registration accepted")
+	peer := func() *pup.Client {
+		id, err := pup.NewIdentity()
+		Tassert(t, err == nil, "NewIdentity: %v", err)
+		return &pup.Client{Addr: addr, Identity: id}
+	}
+
+	// a bad peer fails the first vector and is refused from then on,
+	// without getting to own the hash
+	bad := peer()
+	registerPeer(t, bad, UPPER, bytes.ToLower)
+	time.Sleep(100 * time.Millisecond)
+	Tassert(t, refused(bad), "bad peer accepted")
+	q := d.Quarantined()
+	Tassert(t, len(q) == 1 && q[0] == UPPER+" "+bad.Identity.Addr, "quarantined %v", q)
+	Tassert(t, d.Owner(UPPER) == "", "bad peer owns the hash")
+
+	// a good peer's first registrations run the vectors, and the
+	// next one serves callers
+	good := peer()
+	for i := 0; i < 2; i++ {
+		registerPeer(t, good, UPPER, bytes.ToUpper)
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, err = d.take(UPPER, 1)
+	Tassert(t, err != nil, "test registrations were offered to callers")
+	registerPeer(t, good, UPPER, bytes.ToUpper)
+	time.Sleep(100 * time.Millisecond)
+	out := &bytes.Buffer{}
+	err = c.Call(UPPER, bytes.NewReader([]byte("hello")), out)
+	Tassert(t, err == nil && out.String() == "HELLO", "Call: %v '%s'", err, out)
+	Tassert(t, d.Owner(UPPER) == good.Identity.Addr, "owner %q", d.Owner(UPPER))
+
+	// with quarantine, the bad peer's registrations are parked until
+	// released, and dropped if their streams end first
+	d.Quarantine = true
+	bad.CoSigs = map[string][]byte{UPPER: pup.CoSign(good.Identity, UPPER, bad.Identity.Addr)}
+	d.server.SetTimeouts(pup.REGISTER, 0, 200*time.Millisecond)
+	conn, err := bad.Register(UPPER)
+	Tassert(t, err == nil, "Register: %v", err)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	d.server.SetTimeouts(pup.REGISTER, 0, 0)
+	parked := func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.trials[trialKey(UPPER, bad.Identity.Addr)].parked)
+	}
+	Tassert(t, parked() == 1, "parked %d", parked())
+	time.Sleep(200 * time.Millisecond)
+	Tassert(t, parked() == 0, "timed out registration still parked")
+	called := make(chan bool, 1)
+	registerPeer(t, bad, UPPER, func(in []byte) []byte {
+		called <- true
+		return bytes.ToUpper(in)
+	})
+	time.Sleep(100 * time.Millisecond)
+	Tassert(t, len(called) == 0, "parked registration was used")
+	d.Release(UPPER, bad.Identity.Addr)
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("released registration was not tested")
+	}
+	time.Sleep(100 * time.Millisecond)
+	Tassert(t, len(d.Quarantined()) == 0, "quarantined %v", d.Quarantined())
+}
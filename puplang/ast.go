@@ -0,0 +1,109 @@
+package puplang
+
+// Node is a node in the syntax tree.
+type Node interface {
+	// Pos returns the position of the node's first token.
+	Pos() Pos
+}
+
+// Program is a parsed puplang source file.
+type Program struct {
+	Stmts []Node
+}
+
+// Let binds Name to the value of Value for the rest of the enclosing
+// program or block.
+type Let struct {
+	At    Pos
+	Name  string
+	Value Node
+}
+
+// Ident refers to a bound name.
+type Ident struct {
+	At   Pos
+	Name string
+}
+
+// Address is an address literal, as written.
+type Address struct {
+	At    Pos
+	Value string
+}
+
+// String is a string literal.  Value is unquoted.
+type String struct {
+	At    Pos
+	Value string
+}
+
+// Number is a number literal.  Text is the literal as written.
+type Number struct {
+	At   Pos
+	Text string
+}
+
+// List is a list literal.
+type List struct {
+	At    Pos
+	Elems []Node
+}
+
+// Record is a record literal.
+type Record struct {
+	At     Pos
+	Fields []Field
+}
+
+// Field is one name = value pair in a Record.
+type Field struct {
+	Name  string
+	Value Node
+}
+
+// Call applies Fn to Args.
+type Call struct {
+	At   Pos
+	Fn   Node
+	Args []Node
+}
+
+// Pipe passes the value of Left to Right.  See the package comment.
+type Pipe struct {
+	At    Pos
+	Left  Node
+	Right Node
+}
+
+// Select picks the field Name out of the record X.
+type Select struct {
+	At   Pos
+	X    Node
+	Name string
+}
+
+// Func is a function literal.
+type Func struct {
+	At     Pos
+	Params []string
+	Body   []Node
+}
+
+func (n *Program) Pos() Pos {
+	if len(n.Stmts) == 0 {
+		return Pos{1, 1}
+	}
+	return n.Stmts[0].Pos()
+}
+
+func (n *Let) Pos() Pos     { return n.At }
+func (n *Ident) Pos() Pos   { return n.At }
+func (n *Address) Pos() Pos { return n.At }
+func (n *String) Pos() Pos  { return n.At }
+func (n *Number) Pos() Pos  { return n.At }
+func (n *List) Pos() Pos    { return n.At }
+func (n *Record) Pos() Pos  { return n.At }
+func (n *Call) Pos() Pos    { return n.At }
+func (n *Pipe) Pos() Pos    { return n.At }
+func (n *Select) Pos() Pos  { return n.At }
+func (n *Func) Pos() Pos    { return n.At }
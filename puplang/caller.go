@@ -0,0 +1,53 @@
+package puplang
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/stevegt/pup"
+)
+
+// Caller runs the lambda at an address.  Call sends input to the
+// lambda, copies the lambda's reply to output, and returns once the
+// lambda is done.
+type Caller interface {
+	Call(hash string, input io.Reader, output io.Writer) error
+}
+
+// Local calls lambdas registered on Server.
+type Local struct {
+	Server *pup.Server
+}
+
+// Call implements Caller.
+func (l *Local) Call(hash string, input io.Reader, output io.Writer) (err error) {
+	lambda := l.Server.Dereference(hash)
+	if lambda == nil {
+		return pup.Error{Errno: syscall.ENOSYS, Msg: hash}
+	}
+	return lambda([]byte(hash), &callStream{Reader: input, Writer: output})
+}
+
+// Remote calls lambdas through a pup server or pupd dispatcher.  The
+// server closes the connection when the lambda returns.  If the stream
+// breaks one of the server's limits or the lambda panics before
+// replying, Call returns the error, errno and all; other failures just
+// end the reply early.
+type Remote struct {
+	Client *pup.Client
+}
+
+// Call implements Caller.
+func (r *Remote) Call(hash string, input io.Reader, output io.Writer) error {
+	return r.Client.Call(hash, input, output)
+}
+
+// callStream is the stream a local lambda sees.
+type callStream struct {
+	io.Reader
+	io.Writer
+}
+
+func (c *callStream) Close() error {
+	return nil
+}
@@ -0,0 +1,50 @@
+// Package puplang parses puplang, the glue language and data format
+// of PUP.  A puplang program is a sequence of statements; the value
+// of the last one is the program's result.  Addresses are literals,
+// so a program can name any function or chunk on the grid directly.
+//
+// The grammar, in EBNF:
+//
+//	Program   = { Stmt ";" } [ Stmt ] .
+//	Stmt      = Let | Expr .
+//	Let       = "let" ident "=" Expr .
+//	Expr      = Postfix { "|" Postfix } .
+//	Postfix   = Primary { Call | Select } .
+//	Call      = "(" [ Expr { "," Expr } [ "," ] ] ")" .
+//	Select    = "." ident .
+//	Primary   = address | string | number | ident
+//	          | List | Record | Func | "(" Expr ")" .
+//	List      = "[" [ Expr { "," Expr } [ "," ] ] "]" .
+//	Record    = "{" [ Field { "," Field } [ "," ] ] "}" .
+//	Field     = ident "=" Expr .
+//	Func      = "fn" "(" [ ident { "," ident } [ "," ] ] ")" Block .
+//	Block     = "{" { Stmt ";" } [ Stmt ] "}" .
+//
+// "x | f" passes x to f as its last argument, so "x | f(y)" is the
+// same as "f(y, x)".
+//
+// Calling an address runs the lambda registered there, through the
+// interpreter's Caller.  The arguments' bytes (see Text) are sent to
+// the lambda in order, and the call's value is the lambda's output,
+// which streams: every stage of a pipeline runs at once, each reading
+// the previous one's output as it is produced.
+//
+// Lexical elements:
+//
+//	address   = alg ":" hexdigit { hexdigit } .
+//	alg       = ( letter | digit ) { letter | digit } .
+//	ident     = ( letter | "_" ) { letter | digit | "_" } .
+//	number    = digit { digit } [ "." digit { digit } ] .
+//	string    = a Go interpreted or raw string literal .
+//
+// An address is written as the algorithm name or number, a colon and
+// the hash in hex, with no spaces: "sha256:ab12..." or, in the form
+// used by draft/pup-1.md, "2:ab12...".  "let" and "fn" are keywords.
+// Comments run from "#" to the end of the line.
+//
+// As in Go, a newline ends a statement if the line's last token is
+// an identifier, address, string, number, or one of ")", "]" and
+// "}".  A list, call or record that spans lines therefore needs a
+// trailing comma, and a pipeline continues onto the next line only
+// if the line ends with "|".
+package puplang
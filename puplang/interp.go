@@ -0,0 +1,287 @@
+package puplang
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/stevegt/pup"
+)
+
+// EvalError is an error raised while running a program, at the
+// position of the expression that failed.
+type EvalError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *EvalError) Error() string {
+	return e.Pos.String() + ": " + e.Err.Error()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// Interp runs puplang programs.  Top-level bindings persist from one
+// Run to the next, so an Interp can back a REPL.
+type Interp struct {
+	// Caller runs the lambdas that programs call by address.
+	Caller Caller
+	// Globals are bound in every program, alongside the builtins
+	// len and str.
+	Globals map[string]Value
+	// MaxDepth caps how deeply function calls may nest; a program
+	// that goes deeper fails with ELOOP.  Zero means 1000.
+	MaxDepth int
+
+	top   *scope
+	depth int
+}
+
+type scope struct {
+	vars   map[string]Value
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (v Value, ok bool) {
+	for ; s != nil; s = s.parent {
+		v, ok = s.vars[name]
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+var builtins = map[string]Value{
+	"len": Builtin(builtinLen),
+	"str": Builtin(builtinStr),
+}
+
+// Run evaluates the statements of prog and returns the value of the
+// last one.  A Let has no value.  Lambda calls run concurrently and
+// their results stream; an error in one shows up when its output is
+// read, e.g. by Text.
+func (in *Interp) Run(prog *Program) (v Value, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		eerr, ok := r.(*EvalError)
+		if !ok {
+			panic(r)
+		}
+		err = eerr
+	}()
+	if in.top == nil {
+		globals := &scope{vars: make(map[string]Value)}
+		for name, v := range builtins {
+			globals.vars[name] = v
+		}
+		for name, v := range in.Globals {
+			globals.vars[name] = v
+		}
+		in.top = &scope{vars: make(map[string]Value), parent: globals}
+	}
+	return in.block(in.top, prog.Stmts), nil
+}
+
+// Eval parses and runs src.
+func (in *Interp) Eval(src string) (v Value, err error) {
+	prog, err := Parse(src)
+	if err != nil {
+		return
+	}
+	return in.Run(prog)
+}
+
+func fail(pos Pos, err error) {
+	panic(&EvalError{pos, err})
+}
+
+func failf(pos Pos, errno syscall.Errno, msg string) {
+	fail(pos, pup.Error{Errno: errno, Msg: msg})
+}
+
+func (in *Interp) block(sc *scope, stmts []Node) (v Value) {
+	for _, stmt := range stmts {
+		v = in.eval(sc, stmt)
+	}
+	return
+}
+
+func (in *Interp) eval(sc *scope, n Node) Value {
+	switch n := n.(type) {
+	case *Let:
+		sc.vars[n.Name] = in.eval(sc, n.Value)
+		return nil
+	case *Ident:
+		v, ok := sc.lookup(n.Name)
+		if !ok {
+			failf(n.At, syscall.ENOENT, "undefined: "+n.Name)
+		}
+		return v
+	case *Address:
+		return Addr(CanonicalAddress(n.Value))
+	case *String:
+		return n.Value
+	case *Number:
+		f, err := strconv.ParseFloat(n.Text, 64)
+		if err != nil {
+			fail(n.At, err)
+		}
+		return f
+	case *List:
+		list := []Value{}
+		for _, elem := range n.Elems {
+			list = append(list, in.eval(sc, elem))
+		}
+		return list
+	case *Record:
+		rec := &RecordValue{Fields: make(map[string]Value)}
+		for _, f := range n.Fields {
+			if _, ok := rec.Fields[f.Name]; !ok {
+				rec.Names = append(rec.Names, f.Name)
+			}
+			rec.Fields[f.Name] = in.eval(sc, f.Value)
+		}
+		return rec
+	case *Call:
+		fn := in.eval(sc, n.Fn)
+		return in.call(n.At, fn, in.args(sc, n.Args))
+	case *Pipe:
+		left := in.eval(sc, n.Left)
+		if call, ok := n.Right.(*Call); ok {
+			fn := in.eval(sc, call.Fn)
+			return in.call(n.At, fn, append(in.args(sc, call.Args), left))
+		}
+		return in.call(n.At, in.eval(sc, n.Right), []Value{left})
+	case *Select:
+		x := in.eval(sc, n.X)
+		rec, ok := x.(*RecordValue)
+		if !ok {
+			failf(n.At, syscall.EINVAL, "not a record")
+		}
+		v, ok := rec.Fields[n.Name]
+		if !ok {
+			failf(n.At, syscall.ENOENT, "no field "+n.Name)
+		}
+		return v
+	case *Func:
+		return &Closure{Func: n, scope: sc}
+	case *Program:
+		return in.block(sc, n.Stmts)
+	}
+	panic("unknown node type")
+}
+
+func (in *Interp) args(sc *scope, nodes []Node) (args []Value) {
+	for _, n := range nodes {
+		args = append(args, in.eval(sc, n))
+	}
+	return
+}
+
+func (in *Interp) call(pos Pos, fn Value, args []Value) Value {
+	switch fn := fn.(type) {
+	case Addr:
+		if in.Caller == nil {
+			failf(pos, syscall.ENOSYS, "no caller to run "+string(fn))
+		}
+		var readers []io.Reader
+		for _, arg := range args {
+			r, err := reader(arg)
+			if err != nil {
+				fail(pos, err)
+			}
+			readers = append(readers, r)
+		}
+		out := NewStream()
+		go func() {
+			err := in.Caller.Call(string(fn), io.MultiReader(readers...), out)
+			if err != nil {
+				err = &EvalError{pos, err}
+			}
+			out.Finish(err)
+		}()
+		return out
+	case *Closure:
+		params := fn.Func.Params
+		if len(args) != len(params) {
+			failf(pos, syscall.EINVAL, fmt.Sprintf("want %d arguments, got %d", len(params), len(args)))
+		}
+		max := in.MaxDepth
+		if max == 0 {
+			max = 1000
+		}
+		if in.depth >= max {
+			failf(pos, syscall.ELOOP, fmt.Sprintf("calls nested over %d deep", max))
+		}
+		in.depth++
+		defer func() { in.depth-- }()
+		sc := &scope{vars: make(map[string]Value), parent: fn.scope}
+		for i, name := range params {
+			sc.vars[name] = args[i]
+		}
+		return in.block(sc, fn.Func.Body)
+	case Builtin:
+		v, err := fn(args)
+		if err != nil {
+			fail(pos, err)
+		}
+		return v
+	}
+	failf(pos, syscall.EINVAL, "not a function")
+	return nil
+}
+
+// algorithms maps the hash algorithm numbers in draft/pup-1.md to
+// the names pup uses.
+var algorithms = map[string]string{
+	"0": "md5",
+	"1": "sha1",
+	"2": "sha256",
+	"3": "sha512",
+}
+
+// CanonicalAddress rewrites an address written with an algorithm
+// number, such as "2:ab12", into the form pup uses, "sha256:ab12".
+// The hash is lowercased.
+func CanonicalAddress(addr string) string {
+	i := strings.Index(addr, ":")
+	alg, hash := addr[:i], strings.ToLower(addr[i+1:])
+	if name, ok := algorithms[alg]; ok {
+		alg = name
+	}
+	return alg + ":" + hash
+}
+
+func builtinLen(args []Value) (v Value, err error) {
+	if len(args) != 1 {
+		return nil, pup.Error{Errno: syscall.EINVAL, Msg: "len takes one argument"}
+	}
+	switch x := args[0].(type) {
+	case []Value:
+		return float64(len(x)), nil
+	case *RecordValue:
+		return float64(len(x.Names)), nil
+	}
+	text, err := Text(args[0])
+	return float64(len(text)), err
+}
+
+func builtinStr(args []Value) (v Value, err error) {
+	var b strings.Builder
+	for _, arg := range args {
+		text, err := Text(arg)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(text)
+	}
+	return b.String(), nil
+}
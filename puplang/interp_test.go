@@ -0,0 +1,157 @@
+package puplang
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+var (
+	upperHash = pup.Address([]byte("upper"))
+	revHash   = pup.Address([]byte("rev"))
+)
+
+func upper(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	buf, err := io.ReadAll(stream)
+	Ck(err)
+	_, err = stream.Write(bytes.ToUpper(buf))
+	Ck(err)
+	return
+}
+
+func rev(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	buf, err := io.ReadAll(stream)
+	Ck(err)
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	_, err = stream.Write(buf)
+	Ck(err)
+	return
+}
+
+func testServer() *pup.Server {
+	s := &pup.Server{}
+	s.Register(upperHash, upper)
+	s.Register(revHash, rev)
+	return s
+}
+
+func evalText(t *testing.T, in *Interp, src string) string {
+	v, err := in.Eval(src)
+	Tassert(t, err == nil, "%q: %v", src, err)
+	text, err := Text(v)
+	Tassert(t, err == nil, "%q: %v", src, err)
+	return string(text)
+}
+
+func TestInterp(t *testing.T) {
+	in := &Interp{Caller: &Local{Server: testServer()}}
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{`"abc" | ` + upperHash, "ABC"},
+		{`"abc" | ` + upperHash + ` | ` + revHash, "CBA"},
+		// args are sent in order, piped input last
+		{`"c" | ` + upperHash + `("a", "b")`, "ABC"},
+		{upperHash + `([1, "x"], {a = 2.5})`, `[1, "X"]{A = 2.5}`},
+		{`let up = ` + upperHash + "\n" + `let f = fn(x) { x | up | ` + revHash + ` }` + "\n" + `f("ab")`, "BA"},
+		{`{a = "x", b = {c = "y"}}.b.c`, "y"},
+		{`len([1, 2, 3])`, "3"},
+		{`len("abc" | ` + upperHash + `)`, "3"},
+		{`str("a", 1, [2])`, "a1[2]"},
+		// draft address syntax
+		{`"q" | 2:` + strings.TrimPrefix(upperHash, "sha256:"), "Q"},
+		{`let a = 1`, ""},
+	}
+	for _, c := range cases {
+		got := evalText(t, in, c.src)
+		Tassert(t, got == c.want, "%q: got %q want %q", c.src, got, c.want)
+	}
+
+	// top-level bindings persist between runs
+	evalText(t, in, `let greeting = "hi"`)
+	Tassert(t, evalText(t, in, `greeting | `+upperHash) == "HI", "binding lost")
+}
+
+func TestInterpErrors(t *testing.T) {
+	in := &Interp{Caller: &Local{Server: testServer()}}
+	cases := []struct {
+		src   string
+		errno syscall.Errno
+		pos   Pos
+	}{
+		{"x", syscall.ENOENT, Pos{1, 1}},
+		{"{a = 1}.b", syscall.ENOENT, Pos{1, 8}},
+		{"1.a", syscall.EINVAL, Pos{1, 2}},
+		{`"x"(1)`, syscall.EINVAL, Pos{1, 4}},
+		{"fn(a) { a }(1, 2)", syscall.EINVAL, Pos{1, 12}},
+	}
+	for _, c := range cases {
+		_, err := in.Eval(c.src)
+		var eerr *EvalError
+		Tassert(t, errors.As(err, &eerr), "%q: err %v", c.src, err)
+		Tassert(t, eerr.Pos == c.pos, "%q: pos %v", c.src, eerr.Pos)
+		Tassert(t, errors.Is(err, c.errno), "%q: err %v", c.src, err)
+	}
+
+	// lambda errors show up when the output is read
+	v, err := in.Eval(`"x" | sha256:0bad`)
+	Tassert(t, err == nil, "Eval: %v", err)
+	_, err = Text(v)
+	Tassert(t, errors.Is(err, syscall.ENOSYS), "err %v", err)
+	Tassert(t, strings.HasPrefix(err.Error(), "1:5: "), "err %v", err)
+
+	_, err = in.Eval("f(")
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "err %v", err)
+
+	// runaway recursion fails rather than overflowing the stack, and
+	// the interpreter is still usable afterwards
+	_, err = in.Eval("let f = fn(x) { f(x) }\nf(1)")
+	Tassert(t, errors.Is(err, syscall.ELOOP), "err %v", err)
+	v, err = in.Eval("fn(a) { a }(1)")
+	Tassert(t, err == nil && v == 1.0, "after recursion: %v %v", v, err)
+	_, err = (&Interp{}).Eval(upperHash + "()")
+	Tassert(t, errors.Is(err, syscall.ENOSYS), "err %v", err)
+}
+
+func TestInterpStreams(t *testing.T) {
+	// the second stage sees the first stage's output before the
+	// first stage finishes
+	s := testServer()
+	ready := make(chan bool)
+	first := pup.Address([]byte("first"))
+	s.Register(first, func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		stream.Write([]byte("ping\n"))
+		<-ready
+		stream.Write([]byte("done\n"))
+		return
+	})
+	second := pup.Address([]byte("second"))
+	s.Register(second, func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		line, err := pup.Readline(stream, 1024)
+		if err != nil {
+			return
+		}
+		close(ready)
+		rest, err := io.ReadAll(stream)
+		stream.Write([]byte(string(line) + "|" + string(rest)))
+		return
+	})
+	in := &Interp{Caller: &Local{Server: s}}
+	got := evalText(t, in, first+"() | "+second)
+	Tassert(t, got == "ping|done\n", "got %q", got)
+
+	// a stream can be read more than once
+	got = evalText(t, in, `let x = "ab" | `+upperHash+"\n"+`str(x, x | `+revHash+`)`)
+	Tassert(t, got == "ABBA", "got %q", got)
+}
@@ -0,0 +1,291 @@
+package puplang
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// Pos is a position in the source, counting lines and columns from 1.
+// Columns count bytes.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return strconv.Itoa(p.Line) + ":" + strconv.Itoa(p.Col)
+}
+
+// SyntaxError is an error in puplang source.
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+	// Errno is what the error unwraps to; zero means EBADMSG.
+	Errno syscall.Errno
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// Unwrap lets callers test syntax errors against syscall.EBADMSG,
+// like the other parse errors in pup, or against Errno if it is set.
+func (e *SyntaxError) Unwrap() error {
+	if e.Errno != 0 {
+		return e.Errno
+	}
+	return syscall.EBADMSG
+}
+
+// Token kinds.
+type Kind int
+
+const (
+	EOF Kind = iota
+	SEMI
+	IDENT
+	ADDRESS
+	STRING
+	NUMBER
+	LET
+	FN
+	LPAREN
+	RPAREN
+	LBRACK
+	RBRACK
+	LBRACE
+	RBRACE
+	COMMA
+	ASSIGN
+	PIPE
+	DOT
+)
+
+var kindNames = [...]string{
+	EOF:     "end of input",
+	SEMI:    "newline or ';'",
+	IDENT:   "identifier",
+	ADDRESS: "address",
+	STRING:  "string",
+	NUMBER:  "number",
+	LET:     "'let'",
+	FN:      "'fn'",
+	LPAREN:  "'('",
+	RPAREN:  "')'",
+	LBRACK:  "'['",
+	RBRACK:  "']'",
+	LBRACE:  "'{'",
+	RBRACE:  "'}'",
+	COMMA:   "','",
+	ASSIGN:  "'='",
+	PIPE:    "'|'",
+	DOT:     "'.'",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+var punct = map[byte]Kind{
+	';': SEMI,
+	'(': LPAREN,
+	')': RPAREN,
+	'[': LBRACK,
+	']': RBRACK,
+	'{': LBRACE,
+	'}': RBRACE,
+	',': COMMA,
+	'=': ASSIGN,
+	'|': PIPE,
+	'.': DOT,
+}
+
+// Token is one lexical token.  Text is the token's source text; for
+// a SEMI inserted at a newline it is "\n".
+type Token struct {
+	Kind Kind
+	Pos  Pos
+	Text string
+}
+
+// Lexer splits puplang source into tokens.
+type Lexer struct {
+	src  string
+	off  int
+	line int
+	col  int
+	// semi is true if a newline here would end a statement
+	semi bool
+}
+
+// NewLexer returns a lexer for src.
+func NewLexer(src string) *Lexer {
+	return &Lexer{src: src, line: 1, col: 1}
+}
+
+func (l *Lexer) pos() Pos {
+	return Pos{l.line, l.col}
+}
+
+func (l *Lexer) peek() byte {
+	if l.off < len(l.src) {
+		return l.src[l.off]
+	}
+	return 0
+}
+
+func (l *Lexer) advance() {
+	if l.src[l.off] == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	l.off++
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// Next returns the next token.  At the end of the source it returns
+// EOF, preceded by a SEMI if the last line needs one.
+func (l *Lexer) Next() (tok Token, err error) {
+	for {
+		c := l.peek()
+		if c == '\n' && l.semi {
+			tok = Token{SEMI, l.pos(), "\n"}
+			l.advance()
+			l.semi = false
+			return
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			l.advance()
+			continue
+		}
+		if c == '#' {
+			for l.off < len(l.src) && l.peek() != '\n' {
+				l.advance()
+			}
+			continue
+		}
+		break
+	}
+	start := l.pos()
+	if l.off >= len(l.src) {
+		if l.semi {
+			l.semi = false
+			return Token{SEMI, start, ""}, nil
+		}
+		return Token{EOF, start, ""}, nil
+	}
+	tok, err = l.scan(start)
+	if err != nil {
+		return
+	}
+	switch tok.Kind {
+	case IDENT, ADDRESS, STRING, NUMBER, RPAREN, RBRACK, RBRACE:
+		l.semi = true
+	default:
+		l.semi = false
+	}
+	return
+}
+
+func (l *Lexer) errorf(pos Pos, msg string) error {
+	return &SyntaxError{Pos: pos, Msg: msg}
+}
+
+func (l *Lexer) scan(start Pos) (tok Token, err error) {
+	c := l.peek()
+	begin := l.off
+	switch {
+	case isLetter(c) || isDigit(c):
+		for isLetter(l.peek()) || isDigit(l.peek()) {
+			l.advance()
+		}
+		word := l.src[begin:l.off]
+		if l.peek() == ':' {
+			l.advance()
+			if !isHex(l.peek()) {
+				return tok, l.errorf(l.pos(), "address "+strconv.Quote(word+":")+" has no hash")
+			}
+			for isHex(l.peek()) {
+				l.advance()
+			}
+			if isLetter(l.peek()) {
+				return tok, l.errorf(l.pos(), "invalid character in address hash")
+			}
+			return Token{ADDRESS, start, l.src[begin:l.off]}, nil
+		}
+		if isDigit(c) {
+			return l.number(start, begin)
+		}
+		switch word {
+		case "let":
+			return Token{LET, start, word}, nil
+		case "fn":
+			return Token{FN, start, word}, nil
+		}
+		return Token{IDENT, start, word}, nil
+	case c == '"' || c == '`':
+		return l.string(start, begin)
+	}
+	kind, ok := punct[c]
+	if !ok {
+		return tok, l.errorf(start, "unexpected character "+strconv.QuoteRune(rune(c)))
+	}
+	l.advance()
+	return Token{kind, start, l.src[begin:l.off]}, nil
+}
+
+// number finishes a number whose leading digits have been read.
+func (l *Lexer) number(start Pos, begin int) (tok Token, err error) {
+	for i := begin; i < l.off; i++ {
+		if !isDigit(l.src[i]) {
+			return tok, l.errorf(start, "malformed number "+strconv.Quote(l.src[begin:l.off]))
+		}
+	}
+	if l.peek() == '.' && l.off+1 < len(l.src) && isDigit(l.src[l.off+1]) {
+		l.advance()
+		for isDigit(l.peek()) {
+			l.advance()
+		}
+	}
+	if isLetter(l.peek()) {
+		return tok, l.errorf(l.pos(), "invalid character in number")
+	}
+	return Token{NUMBER, start, l.src[begin:l.off]}, nil
+}
+
+// string reads a quoted string.  Text is the unquoted value.
+func (l *Lexer) string(start Pos, begin int) (tok Token, err error) {
+	quote := l.peek()
+	l.advance()
+	for {
+		if l.off >= len(l.src) || quote == '"' && l.peek() == '\n' {
+			return tok, l.errorf(start, "unterminated string")
+		}
+		c := l.peek()
+		l.advance()
+		if c == quote {
+			break
+		}
+		if c == '\\' && quote == '"' && l.off < len(l.src) {
+			l.advance()
+		}
+	}
+	val, err := strconv.Unquote(l.src[begin:l.off])
+	if err != nil {
+		return tok, l.errorf(start, "invalid string literal")
+	}
+	return Token{STRING, start, val}, nil
+}
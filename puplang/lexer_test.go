@@ -0,0 +1,81 @@
+package puplang
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func lexAll(t *testing.T, src string) (toks []Token, err error) {
+	l := NewLexer(src)
+	for {
+		tok, err := l.Next()
+		if err != nil {
+			return toks, err
+		}
+		toks = append(toks, tok)
+		if tok.Kind == EOF {
+			return toks, nil
+		}
+	}
+}
+
+func TestLexer(t *testing.T) {
+	src := "let h = sha256:ab12 # comment\n  2:ff(\"a\\n\", 1.5, `raw`) | f.x\n"
+	toks, err := lexAll(t, src)
+	Tassert(t, err == nil, "lex: %v", err)
+	want := []Token{
+		{LET, Pos{1, 1}, "let"},
+		{IDENT, Pos{1, 5}, "h"},
+		{ASSIGN, Pos{1, 7}, "="},
+		{ADDRESS, Pos{1, 9}, "sha256:ab12"},
+		{SEMI, Pos{1, 30}, "\n"},
+		{ADDRESS, Pos{2, 3}, "2:ff"},
+		{LPAREN, Pos{2, 7}, "("},
+		{STRING, Pos{2, 8}, "a\n"},
+		{COMMA, Pos{2, 13}, ","},
+		{NUMBER, Pos{2, 15}, "1.5"},
+		{COMMA, Pos{2, 18}, ","},
+		{STRING, Pos{2, 20}, "raw"},
+		{RPAREN, Pos{2, 25}, ")"},
+		{PIPE, Pos{2, 27}, "|"},
+		{IDENT, Pos{2, 29}, "f"},
+		{DOT, Pos{2, 30}, "."},
+		{IDENT, Pos{2, 31}, "x"},
+		{SEMI, Pos{2, 32}, "\n"},
+		{EOF, Pos{3, 1}, ""},
+	}
+	Tassert(t, len(toks) == len(want), "got %v", toks)
+	for i := range want {
+		Tassert(t, toks[i] == want[i], "token %d: got %v want %v", i, toks[i], want[i])
+	}
+
+	// no semicolon after an operator, one at EOF after an operand
+	toks, err = lexAll(t, "a |\nb")
+	Tassert(t, err == nil, "lex: %v", err)
+	Tassert(t, len(toks) == 5 && toks[3].Kind == SEMI && toks[3].Text == "", "got %v", toks)
+}
+
+func TestLexerErrors(t *testing.T) {
+	cases := []struct {
+		src string
+		pos Pos
+	}{
+		{"sha256:", Pos{1, 8}},
+		{"sha256:abz", Pos{1, 10}},
+		{"12ab", Pos{1, 1}},
+		{"1.5x", Pos{1, 4}},
+		{"\"abc", Pos{1, 1}},
+		{"\"ab\nc\"", Pos{1, 1}},
+		{"a\n  @", Pos{2, 3}},
+	}
+	for _, c := range cases {
+		_, err := lexAll(t, c.src)
+		var serr *SyntaxError
+		Tassert(t, errors.As(err, &serr), "%q: err %v", c.src, err)
+		Tassert(t, serr.Pos == c.pos, "%q: got %v want %v", c.src, serr.Pos, c.pos)
+		Tassert(t, errors.Is(err, syscall.EBADMSG), "%q: err %v", c.src, err)
+	}
+}
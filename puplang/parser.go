@@ -0,0 +1,220 @@
+package puplang
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// MaxNesting caps how deeply expressions may nest in source: brackets,
+// calls, records and function bodies all count.  Deeper source fails
+// with a SyntaxError that unwraps to EINVAL.
+const MaxNesting = 1000
+
+// Parse parses a puplang program.  Errors are *SyntaxError values
+// giving the position of the first problem found.
+func Parse(src string) (prog *Program, err error) {
+	p := &parser{lex: NewLexer(src)}
+	defer p.recover(&err)
+	p.next()
+	prog = &Program{Stmts: p.stmts(EOF)}
+	p.expect(EOF)
+	return
+}
+
+// ParseExpr parses a single expression, such as a REPL line.
+func ParseExpr(src string) (expr Node, err error) {
+	p := &parser{lex: NewLexer(src)}
+	defer p.recover(&err)
+	p.next()
+	expr = p.expr()
+	if p.tok.Kind == SEMI {
+		p.next()
+	}
+	p.expect(EOF)
+	return
+}
+
+// parser is a recursive-descent parser with one token of lookahead.
+// Errors panic with a *SyntaxError, which Parse recovers.
+type parser struct {
+	lex   *Lexer
+	tok   Token
+	depth int
+}
+
+func (p *parser) recover(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	serr, ok := r.(*SyntaxError)
+	if !ok {
+		panic(r)
+	}
+	*err = serr
+}
+
+func (p *parser) next() {
+	tok, err := p.lex.Next()
+	if err != nil {
+		panic(err)
+	}
+	p.tok = tok
+}
+
+func (p *parser) errorf(pos Pos, msg string) {
+	panic(&SyntaxError{Pos: pos, Msg: msg})
+}
+
+// expect consumes a token of kind k and returns it.
+func (p *parser) expect(k Kind) Token {
+	tok := p.tok
+	if tok.Kind != k {
+		p.errorf(tok.Pos, "expected "+k.String()+", found "+p.found())
+	}
+	p.next()
+	return tok
+}
+
+func (p *parser) found() string {
+	switch p.tok.Kind {
+	case IDENT, ADDRESS, NUMBER:
+		return p.tok.Kind.String() + " " + p.tok.Text
+	case SEMI:
+		if p.tok.Text == "\n" {
+			return "newline"
+		}
+	}
+	return p.tok.Kind.String()
+}
+
+// stmts parses statements up to, but not including, end.
+func (p *parser) stmts(end Kind) (stmts []Node) {
+	for {
+		for p.tok.Kind == SEMI {
+			p.next()
+		}
+		if p.tok.Kind == end || p.tok.Kind == EOF {
+			return
+		}
+		stmts = append(stmts, p.stmt())
+		if p.tok.Kind != end && p.tok.Kind != EOF {
+			p.expect(SEMI)
+		}
+	}
+}
+
+func (p *parser) stmt() Node {
+	if p.tok.Kind != LET {
+		return p.expr()
+	}
+	at := p.tok.Pos
+	p.next()
+	name := p.expect(IDENT).Text
+	p.expect(ASSIGN)
+	return &Let{At: at, Name: name, Value: p.expr()}
+}
+
+// expr parses an expression.  Every nested expression is parsed
+// through expr, so it is where the nesting is counted.
+func (p *parser) expr() Node {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > MaxNesting {
+		panic(&SyntaxError{Pos: p.tok.Pos, Msg: "expressions nested over " + strconv.Itoa(MaxNesting) + " deep", Errno: syscall.EINVAL})
+	}
+	x := p.postfix()
+	for p.tok.Kind == PIPE {
+		at := p.tok.Pos
+		p.next()
+		x = &Pipe{At: at, Left: x, Right: p.postfix()}
+	}
+	return x
+}
+
+func (p *parser) postfix() Node {
+	x := p.primary()
+	for {
+		switch p.tok.Kind {
+		case LPAREN:
+			at := p.tok.Pos
+			p.next()
+			x = &Call{At: at, Fn: x, Args: p.exprList(RPAREN)}
+		case DOT:
+			at := p.tok.Pos
+			p.next()
+			x = &Select{At: at, X: x, Name: p.expect(IDENT).Text}
+		default:
+			return x
+		}
+	}
+}
+
+// exprList parses comma-separated expressions up to and including
+// end.
+func (p *parser) exprList(end Kind) (list []Node) {
+	for p.tok.Kind != end {
+		list = append(list, p.expr())
+		if p.tok.Kind != end {
+			p.expect(COMMA)
+		}
+	}
+	p.next()
+	return
+}
+
+func (p *parser) primary() Node {
+	tok := p.tok
+	switch tok.Kind {
+	case ADDRESS:
+		p.next()
+		return &Address{At: tok.Pos, Value: tok.Text}
+	case STRING:
+		p.next()
+		return &String{At: tok.Pos, Value: tok.Text}
+	case NUMBER:
+		p.next()
+		return &Number{At: tok.Pos, Text: tok.Text}
+	case IDENT:
+		p.next()
+		return &Ident{At: tok.Pos, Name: tok.Text}
+	case LBRACK:
+		p.next()
+		return &List{At: tok.Pos, Elems: p.exprList(RBRACK)}
+	case LBRACE:
+		p.next()
+		rec := &Record{At: tok.Pos}
+		for p.tok.Kind != RBRACE {
+			name := p.expect(IDENT).Text
+			p.expect(ASSIGN)
+			rec.Fields = append(rec.Fields, Field{Name: name, Value: p.expr()})
+			if p.tok.Kind != RBRACE {
+				p.expect(COMMA)
+			}
+		}
+		p.next()
+		return rec
+	case FN:
+		p.next()
+		fn := &Func{At: tok.Pos}
+		p.expect(LPAREN)
+		for p.tok.Kind != RPAREN {
+			fn.Params = append(fn.Params, p.expect(IDENT).Text)
+			if p.tok.Kind != RPAREN {
+				p.expect(COMMA)
+			}
+		}
+		p.next()
+		p.expect(LBRACE)
+		fn.Body = p.stmts(RBRACE)
+		p.expect(RBRACE)
+		return fn
+	case LPAREN:
+		p.next()
+		x := p.expr()
+		p.expect(RPAREN)
+		return x
+	}
+	p.errorf(tok.Pos, "expected expression, found "+p.found())
+	return nil
+}
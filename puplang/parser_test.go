@@ -0,0 +1,99 @@
+package puplang
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestParse(t *testing.T) {
+	src := `
+let add = sha256:0a1b
+let f = fn(x, y) {
+	let z = add(x, y)
+	z
+}
+[1, "two", {a = 3, b = f}] | f(2:ff).a
+`
+	prog, err := Parse(src)
+	Tassert(t, err == nil, "Parse: %v", err)
+	Tassert(t, len(prog.Stmts) == 3, "stmts %v", prog.Stmts)
+
+	let := prog.Stmts[0].(*Let)
+	Tassert(t, let.Name == "add" && let.Pos() == Pos{2, 1}, "let %v", let)
+	addr := let.Value.(*Address)
+	Tassert(t, addr.Value == "sha256:0a1b" && addr.Pos() == Pos{2, 11}, "addr %v", addr)
+
+	fn := prog.Stmts[1].(*Let).Value.(*Func)
+	Tassert(t, len(fn.Params) == 2 && fn.Params[1] == "y" && len(fn.Body) == 2, "fn %v", fn)
+	call := fn.Body[0].(*Let).Value.(*Call)
+	Tassert(t, call.Fn.(*Ident).Name == "add" && len(call.Args) == 2, "call %v", call)
+
+	// pipes bind loosest, selects and calls tightest
+	pipe := prog.Stmts[2].(*Pipe)
+	list := pipe.Left.(*List)
+	Tassert(t, len(list.Elems) == 3, "list %v", list)
+	rec := list.Elems[2].(*Record)
+	Tassert(t, rec.Fields[1].Name == "b" && rec.Fields[1].Value.(*Ident).Name == "f", "record %v", rec)
+	sel := pipe.Right.(*Select)
+	Tassert(t, sel.Name == "a" && sel.X.(*Call).Args[0].(*Address).Value == "2:ff", "select %v", sel)
+
+	// multi-line lists need trailing commas, as in Go
+	_, err = Parse("[\n\t1,\n\t2,\n]")
+	Tassert(t, err == nil, "Parse: %v", err)
+
+	expr, err := ParseExpr("f(x)\n")
+	Tassert(t, err == nil, "ParseExpr: %v", err)
+	Tassert(t, expr.(*Call).Fn.(*Ident).Name == "f", "expr %v", expr)
+	_, err = ParseExpr("let x = 1")
+	Tassert(t, err != nil, "expected error")
+
+	prog, err = Parse("  # nothing\n")
+	Tassert(t, err == nil && len(prog.Stmts) == 0, "Parse: %v %v", prog, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		src string
+		msg string
+	}{
+		{"let = 1", "1:5: expected identifier, found '='"},
+		{"f(a b)", "1:5: expected ',', found identifier b"},
+		{"[1,\n2\n]", "2:2: expected ',', found newline"},
+		{"{a 1}", "1:4: expected '=', found number 1"},
+		{"fn(x) {\n\tx\n", "3:1: expected '}', found end of input"},
+		{"a b", "1:3: expected newline or ';', found identifier b"},
+		{"f(,)", "1:3: expected expression, found ','"},
+		{"x.1", "1:3: expected identifier, found number 1"},
+		{"let x = sha256:", "1:16: address \"sha256:\" has no hash"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.src)
+		var serr *SyntaxError
+		Tassert(t, errors.As(err, &serr), "%q: err %v", c.src, err)
+		Tassert(t, err.Error() == c.msg, "%q: got %q want %q", c.src, err.Error(), c.msg)
+	}
+}
+
+func TestParseNesting(t *testing.T) {
+	nest := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + "1" + strings.Repeat(close, n)
+	}
+	_, err := Parse(nest("(", ")", MaxNesting-1))
+	Tassert(t, err == nil, "Parse: %v", err)
+	for _, src := range []string{
+		nest("(", ")", MaxNesting),
+		nest("[", "]", MaxNesting),
+		nest("f(", ")", MaxNesting),
+		nest("fn() {", "}", MaxNesting),
+	} {
+		_, err = Parse(src)
+		var serr *SyntaxError
+		Tassert(t, errors.As(err, &serr) && errors.Is(err, syscall.EINVAL), "%.10s...: err %v", src, err)
+	}
+	_, err = ParseExpr(nest("{a = ", "}", MaxNesting))
+	Tassert(t, errors.Is(err, syscall.EINVAL), "ParseExpr: %v", err)
+}
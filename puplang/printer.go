@@ -0,0 +1,105 @@
+package puplang
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Print returns the canonical source form of n.  Parsing the result
+// gives back a tree equal to n, apart from positions.  Comments and
+// the original layout are not kept.
+func Print(n Node) string {
+	p := &printer{}
+	p.node(n)
+	return p.String()
+}
+
+type printer struct {
+	strings.Builder
+	depth int
+}
+
+func (p *printer) newline() {
+	p.WriteString("\n")
+	p.WriteString(strings.Repeat("\t", p.depth))
+}
+
+func (p *printer) node(n Node) {
+	switch n := n.(type) {
+	case *Program:
+		for _, stmt := range n.Stmts {
+			p.node(stmt)
+			p.WriteString("\n")
+		}
+	case *Let:
+		p.WriteString("let " + n.Name + " = ")
+		p.node(n.Value)
+	case *Ident:
+		p.WriteString(n.Name)
+	case *Address:
+		p.WriteString(n.Value)
+	case *String:
+		p.WriteString(strconv.Quote(n.Value))
+	case *Number:
+		p.WriteString(n.Text)
+	case *List:
+		p.WriteString("[")
+		p.list(n.Elems)
+		p.WriteString("]")
+	case *Record:
+		p.WriteString("{")
+		for i, f := range n.Fields {
+			if i > 0 {
+				p.WriteString(", ")
+			}
+			p.WriteString(f.Name + " = ")
+			p.node(f.Value)
+		}
+		p.WriteString("}")
+	case *Call:
+		p.operand(n.Fn)
+		p.WriteString("(")
+		p.list(n.Args)
+		p.WriteString(")")
+	case *Select:
+		p.operand(n.X)
+		p.WriteString("." + n.Name)
+	case *Pipe:
+		p.node(n.Left)
+		p.WriteString(" | ")
+		p.operand(n.Right)
+	case *Func:
+		p.WriteString("fn(" + strings.Join(n.Params, ", ") + ") {")
+		if len(n.Body) > 0 {
+			p.depth++
+			for _, stmt := range n.Body {
+				p.newline()
+				p.node(stmt)
+			}
+			p.depth--
+			p.newline()
+		}
+		p.WriteString("}")
+	}
+}
+
+func (p *printer) list(nodes []Node) {
+	for i, n := range nodes {
+		if i > 0 {
+			p.WriteString(", ")
+		}
+		p.node(n)
+	}
+}
+
+// operand prints n where only a postfix expression may appear.
+func (p *printer) operand(n Node) {
+	switch n.(type) {
+	case *Pipe:
+		p.WriteString("(")
+		p.node(n)
+		p.WriteString(")")
+	default:
+		p.node(n)
+	}
+}
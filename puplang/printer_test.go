@@ -0,0 +1,47 @@
+package puplang
+
+import (
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestPrint(t *testing.T) {
+	src := `let add = sha256:0a1b  # the adder
+let f = fn(x,y){ let z = add(x,y); z }
+let g = fn() {}
+[1,"two\n",{a=3,b=f},] | f(2:ff).a
+(x | g)(1) | h
+`
+	want := `let add = sha256:0a1b
+let f = fn(x, y) {
+	let z = add(x, y)
+	z
+}
+let g = fn() {}
+[1, "two\n", {a = 3, b = f}] | f(2:ff).a
+(x | g)(1) | h
+`
+	prog, err := Parse(src)
+	Tassert(t, err == nil, "Parse: %v", err)
+	got := Print(prog)
+	Tassert(t, got == want, "got:\n%s\nwant:\n%s", got, want)
+
+	// the canonical form parses back to the same program
+	again, err := Parse(got)
+	Tassert(t, err == nil, "Parse: %v", err)
+	Tassert(t, Print(again) == got, "got:\n%s", Print(again))
+
+	// nested functions indent
+	prog, err = Parse("[fn(a) { fn(b) { a } }]")
+	Tassert(t, err == nil, "Parse: %v", err)
+	got = Print(prog)
+	want = "[fn(a) {\n\tfn(b) {\n\t\ta\n\t}\n}]\n"
+	Tassert(t, got == want, "got:\n%s", got)
+	again, err = Parse(got)
+	Tassert(t, err == nil && Print(again) == got, "reparse: %v", err)
+
+	// a pipe on the right of a pipe needs parentheses
+	pipe := &Pipe{Left: &Ident{Name: "a"}, Right: &Pipe{Left: &Ident{Name: "b"}, Right: &Ident{Name: "c"}}}
+	Tassert(t, Print(pipe) == "a | (b | c)", "got %s", Print(pipe))
+}
@@ -0,0 +1,43 @@
+package puplang
+
+import (
+	"io"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+// Script returns a lambda that runs prog, calling other lambdas
+// through caller.  The rest of the lambda's stream is bound to
+// "input", and the program's result is streamed back.  Each call runs
+// in a fresh interpreter.
+func Script(prog *Program, caller Caller) pup.Lambda {
+	return func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		defer Return(&err)
+		input := NewStream()
+		go func() {
+			_, err := io.Copy(input, stream)
+			input.Finish(err)
+		}()
+		in := &Interp{Caller: caller, Globals: map[string]Value{"input": input}}
+		v, err := in.Run(prog)
+		Ck(err)
+		r, err := reader(v)
+		Ck(err)
+		_, err = io.Copy(stream, r)
+		Ck(err)
+		return
+	}
+}
+
+// RegisterScript parses src and registers it on server under the
+// content address of src, so a script is just another lambda.  The
+// script calls other lambdas on the same server.
+func RegisterScript(server *pup.Server, src string) (hash string, err error) {
+	defer Return(&err)
+	prog, err := Parse(src)
+	Ck(err)
+	hash = pup.Address([]byte(src))
+	server.Register(hash, Script(prog, &Local{Server: server}))
+	return
+}
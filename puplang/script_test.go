@@ -0,0 +1,45 @@
+package puplang
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+func TestScript(t *testing.T) {
+	s := testServer()
+	src := "# shout the input backwards\ninput | " + upperHash + " | " + revHash + "\n"
+	hash, err := RegisterScript(s, src)
+	Tassert(t, err == nil, "RegisterScript: %v", err)
+	Tassert(t, hash == pup.Address([]byte(src)), "hash %s", hash)
+
+	// a script is called like any other lambda, including from
+	// another script
+	var out bytes.Buffer
+	err = (&Local{Server: s}).Call(hash, strings.NewReader("abc"), &out)
+	Tassert(t, err == nil, "Call: %v", err)
+	Tassert(t, out.String() == "CBA", "got %q", out.String())
+
+	in := &Interp{Caller: &Local{Server: s}}
+	got := evalText(t, in, `"xy" | `+hash+` | `+upperHash)
+	Tassert(t, got == "YX", "got %q", got)
+
+	_, err = RegisterScript(s, "input |")
+	Tassert(t, err != nil, "expected error")
+}
+
+func TestRemote(t *testing.T) {
+	s := testServer()
+	hash, err := RegisterScript(s, "input | "+revHash)
+	Tassert(t, err == nil, "RegisterScript: %v", err)
+	go s.Serve("127.0.0.1", 10847)
+	time.Sleep(100 * time.Millisecond)
+
+	in := &Interp{Caller: &Remote{Client: &pup.Client{Addr: "127.0.0.1:10847"}}}
+	got := evalText(t, in, `"abc" | `+upperHash+` | `+hash)
+	Tassert(t, got == "CBA", "got %q", got)
+}
@@ -0,0 +1,189 @@
+package puplang
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Value is the result of evaluating a puplang expression.  It is one
+// of string, float64, Addr, *Stream, []Value, *RecordValue, *Closure
+// or Builtin, or nil for a program with no result.
+type Value interface{}
+
+// Addr is an address value.  Calling it runs the lambda registered
+// at that address.
+type Addr string
+
+// RecordValue is the value of a record literal.  Names keeps the
+// fields in the order they were written.
+type RecordValue struct {
+	Names  []string
+	Fields map[string]Value
+}
+
+// Closure is a function literal together with the scope it was
+// evaluated in.
+type Closure struct {
+	Func  *Func
+	scope *scope
+}
+
+// Builtin is a function implemented in Go.
+type Builtin func(args []Value) (Value, error)
+
+// Stream is the output of a lambda call, filled in as the lambda
+// writes it.  Any number of readers can read it from the start, each
+// at its own pace, so a stream can be used more than once and a
+// lambda never blocks on a slow reader.
+type Stream struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	done bool
+	err  error
+}
+
+// NewStream returns an empty, unfinished stream.
+func NewStream() *Stream {
+	s := &Stream{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write appends to the stream.
+func (s *Stream) Write(buf []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, buf...)
+	s.cond.Broadcast()
+	return len(buf), nil
+}
+
+// Finish marks the end of the stream.  Readers see err, or io.EOF if
+// err is nil, after the last byte.
+func (s *Stream) Finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// Reader returns a reader positioned at the start of the stream.
+func (s *Stream) Reader() io.Reader {
+	return &streamReader{s: s}
+}
+
+// Bytes waits for the stream to finish and returns its content.
+func (s *Stream) Bytes() ([]byte, error) {
+	buf, err := io.ReadAll(s.Reader())
+	return buf, err
+}
+
+type streamReader struct {
+	s   *Stream
+	off int
+}
+
+func (r *streamReader) Read(buf []byte) (n int, err error) {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for r.off == len(s.buf) && !s.done {
+		s.cond.Wait()
+	}
+	if r.off < len(s.buf) {
+		n = copy(buf, s.buf[r.off:])
+		r.off += n
+		return
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, io.EOF
+}
+
+// Text returns the bytes v stands for when it is sent to a lambda or
+// returned from a script: the content of a string or stream, or the
+// Format of anything else.
+func Text(v Value) (text []byte, err error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case *Stream:
+		return v.Bytes()
+	case nil:
+		return nil, nil
+	}
+	s, err := Format(v)
+	return []byte(s), err
+}
+
+// reader is like Text, but streams.
+func reader(v Value) (io.Reader, error) {
+	if s, ok := v.(*Stream); ok {
+		return s.Reader(), nil
+	}
+	text, err := Text(v)
+	return bytes.NewReader(text), err
+}
+
+// Format returns v in puplang syntax.  Strings and streams are
+// quoted; functions are shown but can't be parsed back.
+func Format(v Value) (s string, err error) {
+	var b strings.Builder
+	err = format(&b, v)
+	return b.String(), err
+}
+
+func format(b *strings.Builder, v Value) (err error) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("nil")
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case Addr:
+		b.WriteString(string(v))
+	case *Stream:
+		buf, err := v.Bytes()
+		if err != nil {
+			return err
+		}
+		b.WriteString(strconv.Quote(string(buf)))
+	case []Value:
+		b.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			err = format(b, elem)
+			if err != nil {
+				return
+			}
+		}
+		b.WriteString("]")
+	case *RecordValue:
+		b.WriteString("{")
+		for i, name := range v.Names {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(name + " = ")
+			err = format(b, v.Fields[name])
+			if err != nil {
+				return
+			}
+		}
+		b.WriteString("}")
+	case *Closure:
+		b.WriteString("fn(" + strings.Join(v.Func.Params, ", ") + ") {...}")
+	case Builtin:
+		b.WriteString("builtin")
+	}
+	return
+}
@@ -0,0 +1,307 @@
+package pup
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Since selects the point in each topic's history that a subscription
+// replays from before it switches to live delivery.  Set at most one
+// field; the zero Since replays nothing.
+type Since struct {
+	// After is the address of a message the subscriber already has.
+	// Replay starts with the message that follows it on its topic.
+	// Other topics matching the pattern replay the messages
+	// published after it.
+	After string
+	// Seq replays the messages whose sequence number is Seq or
+	// greater.
+	Seq int
+	// Time replays the messages published at or after Time.
+	Time time.Time
+}
+
+// IsZero returns true if since replays nothing.
+func (since Since) IsZero() bool {
+	return since.After == "" && since.Seq == 0 && since.Time.IsZero()
+}
+
+// durable is the server-side state of a named subscriber: the
+// addresses of the messages it has acknowledged on each topic, plus
+// the starting point for topics it has not acknowledged anything on
+// yet.  Sequence numbers won't do, because after a merge two
+// messages on a topic can share one.
+type durable struct {
+	since Since
+	acked map[string]map[string]bool
+}
+
+// ack records msg as acknowledged.  The messages msg follows are
+// acknowledged along with it, so their addresses can go.
+func (d *durable) ack(msg *Message) {
+	acked := d.acked[msg.Topic]
+	if acked == nil {
+		acked = make(map[string]bool)
+		d.acked[msg.Topic] = acked
+	}
+	acked[msg.Addr()] = true
+	for _, prev := range msg.Prev {
+		delete(acked, prev)
+	}
+}
+
+// covered returns the addresses in log, a topic's history, that the
+// subscriber has acknowledged: the acknowledged messages and every
+// message they follow.  It returns nil if the subscriber hasn't
+// acknowledged anything on the topic.
+func (d *durable) covered(topic string, log []*Message) map[string]bool {
+	acked := d.acked[topic]
+	if len(acked) == 0 {
+		return nil
+	}
+	byAddr := make(map[string]*Message)
+	for _, msg := range log {
+		byAddr[msg.Addr()] = msg
+	}
+	covered := make(map[string]bool)
+	var stack []string
+	for addr := range acked {
+		stack = append(stack, addr)
+	}
+	for len(stack) > 0 {
+		addr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if covered[addr] {
+			continue
+		}
+		covered[addr] = true
+		if msg, ok := byAddr[addr]; ok {
+			stack = append(stack, msg.Prev...)
+		}
+	}
+	return covered
+}
+
+// SubscribeFrom is like Subscribe, but first delivers the messages
+// selected by since from each matching topic's history.  Replayed
+// messages are queued before any live message, and no message is
+// delivered twice or skipped in the switch from replay to live.
+func (s *Server) SubscribeFrom(pattern string, since Since) (sub *Subscription, err error) {
+	return s.subscribe("", pattern, since)
+}
+
+// SubscribeDurable is like SubscribeFrom, but the server remembers
+// the subscriber by name.  The subscriber calls Ack on each message
+// once it has been processed.  When a subscriber reconnects under the
+// same name, delivery resumes after the last acknowledged message on
+// each topic, so every message is delivered at least once.  since is
+// only used the first time name is seen; if it is zero, the durable
+// subscription starts with the messages published from then on.  An
+// empty name is an Error with EINVAL.
+func (s *Server) SubscribeDurable(name, pattern string, since Since) (sub *Subscription, err error) {
+	if name == "" {
+		return nil, Error{syscall.EINVAL, "durable subscription needs a name"}
+	}
+	return s.subscribe(name, pattern, since)
+}
+
+func (s *Server) subscribe(name, pattern string, since Since) (sub *Subscription, err error) {
+	defer Return(&err)
+	_, err = path.Match(pattern, "/")
+	Ck(err)
+
+	t := s.topics()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var d *durable
+	if name != "" {
+		d = t.durables[name]
+		if d == nil {
+			d = &durable{since: since, acked: make(map[string]map[string]bool)}
+			if since.IsZero() {
+				d.since = Since{Time: time.Now()}
+			}
+			t.durables[name] = d
+		}
+		since = d.since
+	}
+	var after *Message
+	if since.After != "" {
+		buf, err := s.Cache().Get(since.After)
+		Ck(err)
+		after, err = ParseMessage(buf)
+		Ck(err)
+	}
+
+	// decide whether a message from a topic's history is replayed;
+	// covered holds what a durable subscriber has acknowledged on
+	// the message's topic
+	replay := func(msg *Message, covered map[string]bool) bool {
+		if covered != nil {
+			return !covered[msg.Addr()]
+		}
+		switch {
+		case after != nil && msg.Topic == after.Topic:
+			return msg.Seq > after.Seq
+		case after != nil:
+			return msg.Time.After(after.Time)
+		case since.Seq > 0:
+			return msg.Seq >= since.Seq
+		case !since.Time.IsZero():
+			return !msg.Time.Before(since.Time)
+		}
+		return false
+	}
+
+	// we hold the topics lock from here until the subscription is
+	// live, so nothing can be published between the last replayed
+	// message and the first live one
+	var msgs []*Message
+	// a plain subscription with nothing to replay needn't walk the
+	// logs
+	if d != nil || !since.IsZero() {
+		for topic, head := range t.heads {
+			if !MatchTopic(pattern, topic) {
+				continue
+			}
+			log, err := s.Log(head.Addr())
+			Ck(err)
+			var covered map[string]bool
+			if d != nil {
+				covered = d.covered(topic, log)
+			}
+			for _, msg := range log {
+				if replay(msg, covered) {
+					msgs = append(msgs, msg)
+				}
+			}
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Time.Before(msgs[j].Time)
+	})
+
+	sub = newSubscription(pattern, func(sub *Subscription) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subs, sub)
+	})
+	for _, msg := range msgs {
+		sub.deliver(msg)
+	}
+	if d != nil {
+		sub.ack = func(msg *Message) error {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			d.ack(msg)
+			return nil
+		}
+	}
+	t.subs[sub] = true
+	return
+}
+
+// Ack acknowledges msg on a durable subscription.  Acks are
+// cumulative: acknowledging a message also acknowledges every message
+// it follows, through its Prev links.  After a merge, a message on a
+// branch the acknowledged one doesn't follow is still
+// unacknowledged.  Ack does nothing on a subscription that isn't
+// durable.
+func (sub *Subscription) Ack(msg *Message) error {
+	if sub.ack == nil {
+		return nil
+	}
+	return sub.ack(msg)
+}
+
+// ack acknowledges the message at addr on sub.
+func (s *Server) ack(sub *Subscription, addr string) (err error) {
+	defer Return(&err)
+	buf, err := s.Cache().Get(addr)
+	Ck(err)
+	msg, err := ParseMessage(buf)
+	Ck(err)
+	err = sub.Ack(msg)
+	Ck(err)
+	return
+}
+
+// Log returns every message reachable from the message at head by
+// following Prev links, oldest first.
+func (s *Server) Log(head string) (msgs []*Message, err error) {
+	defer Return(&err)
+	seen := make(map[string]bool)
+	stack := []string{head}
+	for len(stack) > 0 {
+		addr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		buf, err := s.Cache().Get(addr)
+		Ck(err)
+		msg, err := ParseMessage(buf)
+		Ck(err)
+		msgs = append(msgs, msg)
+		stack = append(stack, msg.Prev...)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if msgs[i].Seq != msgs[j].Seq {
+			return msgs[i].Seq < msgs[j].Seq
+		}
+		return msgs[i].Time.Before(msgs[j].Time)
+	})
+	return
+}
+
+// subscribeLine formats the SUBSCRIBE request line.
+func subscribeLine(name, pattern string, since Since) string {
+	fields := []string{pattern}
+	if name != "" {
+		fields = append(fields, "name="+name)
+	}
+	if since.After != "" {
+		fields = append(fields, "after="+since.After)
+	}
+	if since.Seq > 0 {
+		fields = append(fields, Spf("seq=%d", since.Seq))
+	}
+	if !since.Time.IsZero() {
+		fields = append(fields, "time="+since.Time.UTC().Format(time.RFC3339Nano))
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseSubscribe parses the SUBSCRIBE request line.
+func parseSubscribe(line string) (name, pattern string, since Since, err error) {
+	defer Return(&err)
+	fields := strings.Split(line, " ")
+	pattern = fields[0]
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		ErrnoIf(len(kv) != 2, syscall.EINVAL, "malformed field: %q", field)
+		switch kv[0] {
+		case "name":
+			name = kv[1]
+		case "after":
+			since.After = kv[1]
+		case "seq":
+			since.Seq, err = strconv.Atoi(kv[1])
+			Ck(err)
+		case "time":
+			since.Time, err = time.Parse(time.RFC3339Nano, kv[1])
+			Ck(err)
+		default:
+			ErrnoIf(true, syscall.EINVAL, "unknown field: %q", kv[0])
+		}
+	}
+	return
+}
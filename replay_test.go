@@ -0,0 +1,151 @@
+package pup
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func publishN(t *testing.T, s *Server, topic string, n int) (msgs []*Message) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg, err := s.Publish(topic, []byte(Spf("%s %d", topic, i+1)))
+		Tassert(t, err == nil, "Publish: %v", err)
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+func TestReplay(t *testing.T) {
+	cases := []struct {
+		since func(msgs []*Message) Since
+		first int
+	}{
+		{func(msgs []*Message) Since { return Since{Seq: 3} }, 3},
+		{func(msgs []*Message) Since { return Since{After: msgs[1].Addr()} }, 3},
+		{func(msgs []*Message) Since { return Since{Time: msgs[3].Time} }, 4},
+		{func(msgs []*Message) Since { return Since{} }, 6},
+	}
+	for i, c := range cases {
+		s := &Server{}
+		msgs := publishN(t, s, "/log", 5)
+
+		log, err := s.Log(msgs[4].Addr())
+		Tassert(t, err == nil, "Log: %v", err)
+		Tassert(t, len(log) == 5 && log[0].Seq == 1 && log[4].Seq == 5, "log %v", log)
+
+		sub, err := s.SubscribeFrom("/log", c.since(msgs))
+		Tassert(t, err == nil, "SubscribeFrom: %v", err)
+		for seq := c.first; seq <= 5; seq++ {
+			msg := recv(t, sub)
+			Tassert(t, msg.Seq == seq, "case %d: wanted seq %d got %d", i, seq, msg.Seq)
+		}
+
+		// switch to live
+		live, err := s.Publish("/log", []byte("live"))
+		Tassert(t, err == nil, "Publish: %v", err)
+		msg := recv(t, sub)
+		Tassert(t, msg.Addr() == live.Addr(), "case %d: wanted live message got %v", i, msg)
+		sub.Close()
+	}
+}
+
+func TestDurable(t *testing.T) {
+	s := &Server{}
+
+	sub, err := s.SubscribeDurable("worker", "/jobs", Since{})
+	Tassert(t, err == nil, "SubscribeDurable: %v", err)
+	msgs := publishN(t, s, "/jobs", 4)
+	for i := 0; i < 4; i++ {
+		msg := recv(t, sub)
+		Tassert(t, msg.Seq == i+1, "seq %v", msg.Seq)
+		// the worker crashes after processing two jobs
+		if i < 2 {
+			err = sub.Ack(msg)
+			Tassert(t, err == nil, "Ack: %v", err)
+		}
+	}
+	sub.Close()
+
+	// meanwhile, more work arrives on a new topic too
+	publishN(t, s, "/jobs/urgent", 1)
+
+	// on reconnect, the unacked jobs are delivered again
+	sub, err = s.SubscribeDurable("worker", "/jobs", Since{})
+	Tassert(t, err == nil, "SubscribeDurable: %v", err)
+	defer sub.Close()
+	got := []*Message{recv(t, sub), recv(t, sub), recv(t, sub)}
+	Tassert(t, got[0].Addr() == msgs[2].Addr(), "got %v", got[0])
+	Tassert(t, got[1].Addr() == msgs[3].Addr(), "got %v", got[1])
+	Tassert(t, got[2].Topic == "/jobs/urgent", "got %v", got[2])
+
+	_, err = s.SubscribeDurable("", "/jobs", Since{})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "unnamed durable subscription: %v", err)
+}
+
+func TestDurableMerge(t *testing.T) {
+	a := &Server{}
+	b := &Server{}
+	sub, err := a.SubscribeDurable("worker", "/doc", Since{})
+	Tassert(t, err == nil, "SubscribeDurable: %v", err)
+	m1, err := a.Publish("/doc", []byte("one"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	_, err = b.Merge(exchange(t, a, b, "/doc"), nil)
+	Tassert(t, err == nil, "Merge: %v", err)
+
+	// the worker acks a2, which has the same seq as b2
+	a2, err := a.Publish("/doc", []byte("from a"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	for _, want := range []*Message{m1, a2} {
+		msg := recv(t, sub)
+		Tassert(t, msg.Addr() == want.Addr(), "got %v", msg)
+		err = sub.Ack(msg)
+		Tassert(t, err == nil, "Ack: %v", err)
+	}
+	sub.Close()
+	b2, err := b.Publish("/doc", []byte("from b"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	merged, err := a.Merge(exchange(t, b, a, "/doc"), nil)
+	Tassert(t, err == nil, "Merge: %v", err)
+
+	// b2 is still delivered, then the merge
+	sub, err = a.SubscribeDurable("worker", "/doc", Since{})
+	Tassert(t, err == nil, "SubscribeDurable: %v", err)
+	defer sub.Close()
+	got := recv(t, sub)
+	Tassert(t, got.Addr() == b2.Addr(), "wanted b2, got %v", got)
+	got = recv(t, sub)
+	Tassert(t, got.Addr() == merged.Addr(), "wanted the merge, got %v", got)
+}
+
+func TestClientDurable(t *testing.T) {
+	port := 10845
+	s := &Server{}
+	s.RegisterPubSub()
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(1 * time.Second)
+	c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+
+	msgs := publishN(t, s, "/q", 3)
+	sub, err := c.SubscribeDurable("w", "/q", Since{Seq: 1})
+	Tassert(t, err == nil, "SubscribeDurable: %v", err)
+	msg := recv(t, sub)
+	Tassert(t, msg.Addr() == msgs[0].Addr(), "got %v", msg)
+	err = sub.Ack(msg)
+	Tassert(t, err == nil, "Ack: %v", err)
+	time.Sleep(100 * time.Millisecond)
+	sub.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	sub, err = c.SubscribeDurable("w", "/q", Since{})
+	Tassert(t, err == nil, "SubscribeDurable: %v", err)
+	defer sub.Close()
+	msg = recv(t, sub)
+	Tassert(t, msg.Addr() == msgs[1].Addr(), "got %v", msg)
+}
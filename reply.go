@@ -0,0 +1,144 @@
+package pup
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// A stream that breaks a limit (see SetLimit and the Server timeouts),
+// that Shutdown cuts off, or whose lambda panics, gets an error reply
+// unless the lambda has already written to it: a NUL byte, the errno in decimal, a space,
+// the message and a newline, after which the server closes the
+// stream.  Other streams get only what their lambdas write.  Client
+// connections turn an error reply into an Error from Read; output
+// that starts with a NUL byte only looks like one if it is exactly
+// such a line.
+
+// WriteError writes the error reply for err to w.  The errno is the
+// one err wraps, or EIO if it doesn't wrap one.  The message leaves
+// out the files and lines goadapt errors record.
+func WriteError(w io.Writer, err error) error {
+	errno := syscall.EIO
+	errors.As(err, &errno)
+	msg := err.Error()
+	var e Error
+	var m interface{ Msg() string }
+	if errors.As(err, &e) {
+		msg = e.Msg
+	} else if errors.As(err, &m) {
+		msg = strings.TrimSuffix(m.Msg(), ": "+errno.Error())
+	}
+	msg = strings.ReplaceAll(msg, "\n", " ")
+	_, err = w.Write([]byte("\x00" + strconv.Itoa(int(errno)) + " " + msg + "\n"))
+	return err
+}
+
+// ParseError parses an error reply, without its leading NUL byte and
+// trailing newline.
+func ParseError(line []byte) error {
+	e, ok := errorLine(line)
+	if !ok {
+		return Error{syscall.EBADMSG, Spf("malformed error reply %q", line)}
+	}
+	return e
+}
+
+// errorLine parses an error reply like ParseError, and reports whether
+// line is well-formed: a nonzero errno in decimal digits, a space and
+// the message.
+func errorLine(line []byte) (error, bool) {
+	num, msg, ok := strings.Cut(string(line), " ")
+	if !ok || num == "" || strings.Trim(num, "0123456789") != "" {
+		return nil, false
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n == 0 {
+		return nil, false
+	}
+	return Error{syscall.Errno(n), msg}, true
+}
+
+// replyConn is a client connection that checks the reply for an error
+// reply.  Only a reply that is one well-formed error line and nothing
+// more counts as one; anything else is passed on as output, even if
+// it starts with a NUL byte.
+type replyConn struct {
+	net.Conn
+	started bool
+	// pending is what checking the reply read of it, and tail the
+	// error reading stopped at, if any
+	pending []byte
+	tail    error
+	err     error
+}
+
+func (rc *replyConn) Read(p []byte) (n int, err error) {
+	if rc.err != nil {
+		return 0, rc.err
+	}
+	if !rc.started && len(p) > 0 {
+		rc.started = true
+		rc.err = rc.check()
+		if rc.err != nil {
+			return 0, rc.err
+		}
+	}
+	if len(rc.pending) > 0 {
+		n = copy(p, rc.pending)
+		rc.pending = rc.pending[n:]
+		return
+	}
+	if rc.tail != nil {
+		return 0, rc.tail
+	}
+	return rc.Conn.Read(p)
+}
+
+// check reads the start of the reply, and returns the error if it is
+// an error reply.  Otherwise it leaves what it read in pending.
+func (rc *replyConn) check() error {
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(rc.Conn, buf)
+	if err != nil {
+		rc.tail = err
+		return nil
+	}
+	rc.pending = buf
+	if buf[0] != 0 {
+		return nil
+	}
+	line, err := Readline(rc.Conn, 1024)
+	rc.pending = append(rc.pending, line...)
+	if err == ELONGLINE {
+		return nil
+	}
+	if err != nil {
+		rc.tail = err
+		return nil
+	}
+	rc.pending = append(rc.pending, '\n')
+	// the server closes the stream after an error reply, which may
+	// reset it if the request wasn't all read
+	n, err := io.ReadFull(rc.Conn, buf)
+	if n > 0 {
+		rc.pending = append(rc.pending, buf...)
+		return nil
+	}
+	rc.tail = err
+	e, ok := errorLine(line)
+	if !ok {
+		return nil
+	}
+	rc.pending = nil
+	return e
+}
+
+func (rc *replyConn) CloseWrite() error {
+	return wrapper{rc.Conn}.CloseWrite()
+}
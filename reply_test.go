@@ -0,0 +1,49 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestErrorReply(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteError(buf, Error{syscall.EBUSY, "too\nbusy"})
+	Tassert(t, err == nil && buf.String() == "\x0016 too busy\n", "WriteError: %v %q", err, buf)
+
+	// goadapt errors lose their files and lines
+	buf.Reset()
+	err = WriteError(buf, func() (err error) {
+		defer Return(&err)
+		ErrnoIf(true, syscall.EACCES, "go away")
+		return
+	}())
+	Tassert(t, err == nil && buf.String() == "\x0013 go away\n", "WriteError: %v %q", err, buf)
+	buf.Reset()
+	WriteError(buf, io.ErrUnexpectedEOF)
+	Tassert(t, buf.String() == "\x005 unexpected EOF\n", "no errno: %q", buf)
+
+	err = ParseError([]byte("x y"))
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "ParseError: %v", err)
+
+	// only a reply that is one whole error line is an error reply
+	for _, reply := range []string{"\x0016 busy\n", "fine", "", "\x0016 busy\nmore", "\x00x y\n", "\x000 zero\n", "\x0016 busy"} {
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte(reply))
+			server.Close()
+		}()
+		got, err := io.ReadAll(&replyConn{Conn: client})
+		if reply != "\x0016 busy\n" {
+			Tassert(t, err == nil && string(got) == reply, "ReadAll: %v %q", err, got)
+			continue
+		}
+		var e Error
+		Tassert(t, errors.As(err, &e) && e.Errno == syscall.EBUSY && e.Msg == "busy" && len(got) == 0, "ReadAll: %v '%s'", err, got)
+	}
+}
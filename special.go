@@ -0,0 +1,121 @@
+package pup
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// lambdaFile is an open special file in .lambdas.  The lambda is
+// started by the first read or write: writes stream to the lambda's
+// input, and the first read ends the input and returns the lambda's
+// output.  Output is buffered, so a lambda never blocks on a reader
+// that is itself waiting for the next write.
+type lambdaFile struct {
+	info fileInfo
+	reg  *Registration
+
+	once    sync.Once
+	inr     *io.PipeReader
+	inw     *io.PipeWriter
+	mu      sync.Mutex
+	cond    *sync.Cond
+	out     bytes.Buffer
+	started bool
+	done    bool
+	err     error
+}
+
+func newLambdaFile(info fileInfo, reg *Registration) *lambdaFile {
+	f := &lambdaFile{info: info, reg: reg}
+	f.inr, f.inw = io.Pipe()
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// start runs the lambda, once.
+func (f *lambdaFile) start() {
+	f.once.Do(func() {
+		f.mu.Lock()
+		f.started = true
+		f.mu.Unlock()
+		go func() {
+			err := f.reg.Lambda([]byte(f.reg.Hash), &lambdaStream{f})
+			// writes after the lambda has returned fail
+			if err != nil {
+				f.inr.CloseWithError(err)
+			} else {
+				f.inr.CloseWithError(io.ErrClosedPipe)
+			}
+			f.mu.Lock()
+			f.done = true
+			f.err = err
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		}()
+	})
+}
+
+func (f *lambdaFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// Write streams buf to the lambda's input.
+func (f *lambdaFile) Write(buf []byte) (n int, err error) {
+	f.start()
+	return f.inw.Write(buf)
+}
+
+// Read ends the lambda's input and returns its output.  At the end
+// of the output, Read returns the lambda's error, or io.EOF.
+func (f *lambdaFile) Read(buf []byte) (n int, err error) {
+	f.start()
+	f.inw.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.out.Len() == 0 && !f.done {
+		f.cond.Wait()
+	}
+	if f.out.Len() > 0 {
+		return f.out.Read(buf)
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, io.EOF
+}
+
+// Close ends the lambda's input and, if the lambda was started,
+// waits for it to return.  Any output not yet read is discarded.
+func (f *lambdaFile) Close() error {
+	f.inw.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.started {
+		return nil
+	}
+	for !f.done {
+		f.cond.Wait()
+	}
+	return f.err
+}
+
+// lambdaStream is the lambda's side of a lambdaFile.
+type lambdaStream struct {
+	f *lambdaFile
+}
+
+func (s *lambdaStream) Read(buf []byte) (int, error) {
+	return s.f.inr.Read(buf)
+}
+
+func (s *lambdaStream) Write(buf []byte) (n int, err error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	n, err = s.f.out.Write(buf)
+	s.f.cond.Broadcast()
+	return
+}
+
+func (s *lambdaStream) Close() error {
+	return s.f.inr.Close()
+}
@@ -0,0 +1,62 @@
+package pup
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestLambdaFiles(t *testing.T) {
+	s := &Server{}
+	s.Register("echo", echoContent)
+	s.Register("hash", echoHash)
+	s.Register("fail", func(hash []byte, stream io.ReadWriteCloser) error {
+		return syscall.EDOM
+	})
+	g := s.FS()
+
+	entries, err := fs.ReadDir(g, ".lambdas")
+	Tassert(t, err == nil, "ReadDir: %v", err)
+	Tassert(t, len(entries) == 3 && entries[0].Name() == "echo", "entries %v", entries)
+
+	// stat doesn't run the lambda
+	fi, err := fs.Stat(g, ".lambdas/fail")
+	Tassert(t, err == nil, "Stat: %v", err)
+	Tassert(t, fi.Mode() == 0666, "mode %v", fi.Mode())
+
+	// reading runs the lambda with no input
+	buf, err := fs.ReadFile(g, ".lambdas/hash")
+	Tassert(t, err == nil, "ReadFile: %v", err)
+	Tassert(t, string(buf) == "hash", "got '%s'", buf)
+
+	// written bytes are the lambda's input
+	f, err := g.OpenFile(".lambdas/echo", os.O_RDWR)
+	Tassert(t, err == nil, "OpenFile: %v", err)
+	_, err = f.Write([]byte("hello "))
+	Tassert(t, err == nil, "Write: %v", err)
+	_, err = f.Write([]byte("world"))
+	Tassert(t, err == nil, "Write: %v", err)
+	buf, err = io.ReadAll(f)
+	Tassert(t, err == nil, "ReadAll: %v", err)
+	Tassert(t, string(buf) == "hello world", "got '%s'", buf)
+	err = f.Close()
+	Tassert(t, err == nil, "Close: %v", err)
+
+	// write-only: Close reports the lambda's error
+	f, err = g.OpenFile(".lambdas/fail", os.O_WRONLY)
+	Tassert(t, err == nil, "OpenFile: %v", err)
+	f.Write([]byte("x"))
+	err = f.Close()
+	Tassert(t, errors.Is(err, syscall.EDOM), "Close: %v", err)
+
+	_, err = fs.ReadFile(g, ".lambdas/fail")
+	Tassert(t, errors.Is(err, syscall.EDOM), "ReadFile: %v", err)
+
+	_, err = g.OpenFile(".lambdas/nope", os.O_RDWR)
+	Tassert(t, errors.Is(err, fs.ErrNotExist), "err %v", err)
+}
@@ -0,0 +1,165 @@
+// Package stategraph implements the log-based runtime described in
+// draft/pup-4.md: a DAG of states connected by deterministic, pure
+// transition functions.  States are chunks in a pup.Server's cache,
+// transition functions are lambdas registered on the same server,
+// and the graph itself stores nothing but addresses.
+package stategraph
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+// StateGraph records the transitions computed on a server.
+type StateGraph struct {
+	server *pup.Server
+
+	mu    sync.Mutex
+	roots map[string]bool
+	// memo maps an (in, fn) pair to the transition computed for it
+	memo  map[string]*Transition
+	order []*Transition
+}
+
+// New returns an empty state graph whose states live in server's
+// chunk cache.  Root states and recorded transitions are GC roots,
+// so the cache keeps every state the graph knows about.
+func New(server *pup.Server) (g *StateGraph) {
+	g = &StateGraph{
+		server: server,
+		roots:  make(map[string]bool),
+		memo:   make(map[string]*Transition),
+	}
+	server.Cache().AddRoots(g.gcRoots)
+	return
+}
+
+func (g *StateGraph) gcRoots() (addrs []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr := range g.roots {
+		addrs = append(addrs, addr)
+	}
+	for _, t := range g.order {
+		addrs = append(addrs, t.Addr())
+	}
+	sort.Strings(addrs)
+	return
+}
+
+func memoKey(in, fn string) string {
+	return in + " " + fn
+}
+
+// Put stores content as a root state and returns its address.
+func (g *StateGraph) Put(content []byte) (addr string) {
+	addr = g.server.Cache().Put(content)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.roots[addr] = true
+	return
+}
+
+// Lookup returns the transition already computed for running fn on
+// the state at in, or nil.
+func (g *StateGraph) Lookup(in, fn string) *Transition {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.memo[memoKey(in, fn)]
+}
+
+// Step runs the transition function registered on the server as fn
+// on the state at in and records the resulting transition.  The
+// function gets fn as its hash and the input state on its stream,
+// and writes the output state back to the stream.  If the (in, fn)
+// pair has been computed before, Step returns the recorded
+// transition without running anything.
+func (g *StateGraph) Step(in, fn string) (t *Transition, err error) {
+	defer Return(&err)
+	t = g.Lookup(in, fn)
+	if t != nil {
+		return
+	}
+	out, err := g.run(in, fn)
+	Ck(err)
+	t = &Transition{In: in, Fn: fn, Out: out}
+	g.server.Cache().Put(t.Encode(), t.In, t.Out)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := memoKey(in, fn)
+	if prev := g.memo[key]; prev != nil {
+		// computed concurrently; keep the first
+		return prev, nil
+	}
+	g.memo[key] = t
+	g.order = append(g.order, t)
+	return
+}
+
+// run runs fn on the state at in, stores the output state in the
+// cache, and returns its address.
+func (g *StateGraph) run(in, fn string) (out string, err error) {
+	defer Return(&err)
+	cache := g.server.Cache()
+	state, err := cache.Get(in)
+	Ck(err)
+	lambda := g.server.Dereference(fn)
+	ErrnoIf(lambda == nil, syscall.ENOENT, "no transition function registered at %s", fn)
+	stream := &stateStream{Reader: bytes.NewReader(state)}
+	err = lambda([]byte(fn), stream)
+	Ck(err)
+	return cache.Put(stream.out.Bytes()), nil
+}
+
+// Transitions returns every recorded transition in the order it was
+// computed.
+func (g *StateGraph) Transitions() []*Transition {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*Transition{}, g.order...)
+}
+
+// Heads returns the sorted addresses of the states that no recorded
+// transition starts from: root states nothing has been run on yet,
+// and the newest outputs.
+func (g *StateGraph) Heads() (heads []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	states := make(map[string]bool)
+	for addr := range g.roots {
+		states[addr] = true
+	}
+	for _, t := range g.order {
+		states[t.Out] = true
+	}
+	for _, t := range g.order {
+		delete(states, t.In)
+	}
+	for addr := range states {
+		heads = append(heads, addr)
+	}
+	sort.Strings(heads)
+	return
+}
+
+// stateStream is the stream a transition function runs on: it reads
+// the input state and collects the output state.
+type stateStream struct {
+	io.Reader
+	out bytes.Buffer
+}
+
+func (s *stateStream) Write(buf []byte) (int, error) {
+	return s.out.Write(buf)
+}
+
+func (s *stateStream) Close() error {
+	return nil
+}
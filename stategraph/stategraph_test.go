@@ -0,0 +1,70 @@
+package stategraph
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+// incr is a transition function whose state is a decimal counter.
+func incr(calls *int) pup.Lambda {
+	return func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		defer Return(&err)
+		*calls++
+		buf, err := io.ReadAll(stream)
+		Ck(err)
+		n, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		Ck(err)
+		_, err = stream.Write([]byte(strconv.Itoa(n + 1)))
+		Ck(err)
+		return
+	}
+}
+
+func TestStep(t *testing.T) {
+	s := &pup.Server{}
+	var calls int
+	fn := pup.Address([]byte("incr"))
+	s.Register(fn, incr(&calls))
+	g := New(s)
+
+	root := g.Put([]byte("0"))
+	Tassert(t, len(g.Heads()) == 1 && g.Heads()[0] == root, "heads %v", g.Heads())
+
+	t1, err := g.Step(root, fn)
+	Tassert(t, err == nil, "Step: %v", err)
+	Tassert(t, t1.In == root && t1.Fn == fn, "transition %v", t1)
+	buf, err := s.Cache().Get(t1.Out)
+	Tassert(t, err == nil, "Get: %v", err)
+	Tassert(t, string(buf) == "1", "got '%s'", buf)
+
+	t2, err := g.Step(t1.Out, fn)
+	Tassert(t, err == nil, "Step: %v", err)
+	Tassert(t, calls == 2, "calls %d", calls)
+	Tassert(t, len(g.Heads()) == 1 && g.Heads()[0] == t2.Out, "heads %v", g.Heads())
+
+	// memoised: the function doesn't run again
+	again, err := g.Step(root, fn)
+	Tassert(t, err == nil, "Step: %v", err)
+	Tassert(t, again == t1 && calls == 2, "calls %d", calls)
+	Tassert(t, g.Lookup(t1.Out, fn) == t2, "Lookup %v", g.Lookup(t1.Out, fn))
+	Tassert(t, len(g.Transitions()) == 2, "transitions %v", g.Transitions())
+
+	// transitions are stored as chunks that keep their states alive
+	buf, err = s.Cache().Get(t2.Addr())
+	Tassert(t, err == nil, "Get: %v", err)
+	Tassert(t, string(buf) == string(t2.Encode()), "got '%s'", buf)
+	report := s.Cache().GC(false)
+	Tassert(t, len(report.Swept) == 0, "swept %v", report.Swept)
+
+	_, err = g.Step(root, "sha256:nope")
+	Tassert(t, errors.Is(err, syscall.ENOENT), "err %v", err)
+	_, err = g.Step("sha256:nope", fn)
+	Tassert(t, errors.Is(err, syscall.ENOENT), "err %v", err)
+}
@@ -0,0 +1,57 @@
+package stategraph
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+// Transition records that running the function at Fn on the state
+// at In produced the state at Out.  Only the three addresses are
+// recorded; the states themselves live in the chunk cache.
+type Transition struct {
+	In  string
+	Fn  string
+	Out string
+}
+
+// Encode returns the storage form of t: one "key address" line each
+// for in, fn and out.
+func (t *Transition) Encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "in %s\n", t.In)
+	fmt.Fprintf(&buf, "fn %s\n", t.Fn)
+	fmt.Fprintf(&buf, "out %s\n", t.Out)
+	return buf.Bytes()
+}
+
+// Addr returns the content address of t.
+func (t *Transition) Addr() string {
+	return pup.Address(t.Encode())
+}
+
+// ParseTransition decodes a transition previously produced by
+// Encode.
+func ParseTransition(buf []byte) (t *Transition, err error) {
+	defer Return(&err)
+	t = &Transition{}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	ErrnoIf(len(lines) != 3, syscall.EBADMSG, "transition has %d lines", len(lines))
+	for i, key := range []string{"in", "fn", "out"} {
+		parts := strings.SplitN(lines[i], " ", 2)
+		ErrnoIf(len(parts) != 2 || parts[0] != key, syscall.EBADMSG, "expected %s, got %q", key, lines[i])
+		switch key {
+		case "in":
+			t.In = parts[1]
+		case "fn":
+			t.Fn = parts[1]
+		case "out":
+			t.Out = parts[1]
+		}
+	}
+	return
+}
@@ -0,0 +1,19 @@
+package stategraph
+
+import (
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestTransitionEncode(t *testing.T) {
+	tr := &Transition{In: "sha256:aa", Fn: "sha256:bb", Out: "sha256:cc"}
+	got, err := ParseTransition(tr.Encode())
+	Tassert(t, err == nil, "ParseTransition: %v", err)
+	Tassert(t, *got == *tr, "got %v", got)
+
+	_, err = ParseTransition([]byte("in sha256:aa\nout sha256:cc\nfn sha256:bb\n"))
+	Tassert(t, err != nil, "expected error")
+	_, err = ParseTransition([]byte("in sha256:aa\n"))
+	Tassert(t, err != nil, "expected error")
+}
@@ -0,0 +1,82 @@
+package stategraph
+
+import (
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Divergence describes the first transition in a chain whose
+// recorded output could not be reproduced.
+type Divergence struct {
+	// Index is the position of Transition in the chain.
+	Index      int
+	Transition *Transition
+	// Got is the address the transition produced on replay.
+	Got string
+}
+
+func (d *Divergence) Error() string {
+	return Spf("transition %d (%s on %s) produced %s, recorded %s",
+		d.Index, d.Transition.Fn, d.Transition.In, d.Got, d.Transition.Out)
+}
+
+// Chain returns the recorded transitions leading from a root state to
+// the state at head, oldest first.  If more than one recorded
+// transition produced the same state, the first one recorded is used.
+func (g *StateGraph) Chain(head string) (chain []*Transition, err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	byOut := make(map[string]*Transition)
+	for _, t := range g.order {
+		if byOut[t.Out] == nil {
+			byOut[t.Out] = t
+		}
+	}
+	seen := make(map[string]bool)
+	addr := head
+	for !g.roots[addr] {
+		t := byOut[addr]
+		ErrnoIf(t == nil, syscall.ENOENT, "no transition leads to %s", addr)
+		ErrnoIf(seen[addr], syscall.ELOOP, "transition cycle at %s", addr)
+		seen[addr] = true
+		chain = append([]*Transition{t}, chain...)
+		addr = t.In
+	}
+	return
+}
+
+// Verify re-executes chain from the root state at chain[0].In,
+// feeding each transition the state produced by the one before it,
+// and compares every produced address with the recorded one.  It
+// stops at the first mismatch and returns it; a nil Divergence means
+// the whole chain was reproduced.  The chain may come from another
+// node; only the root state and the transition functions need to be
+// available here.  Verify never consults or updates the memo table.
+//
+// err reports a chain that isn't linked, or a transition that could
+// not be run at all.
+func (g *StateGraph) Verify(chain []*Transition) (div *Divergence, err error) {
+	defer Return(&err)
+	for i := 1; i < len(chain); i++ {
+		ErrnoIf(chain[i].In != chain[i-1].Out, syscall.EINVAL,
+			"transition %d starts from %s, not %s", i, chain[i].In, chain[i-1].Out)
+	}
+	for i, t := range chain {
+		got, err := g.run(t.In, t.Fn)
+		Ck(err)
+		if got != t.Out {
+			return &Divergence{Index: i, Transition: t, Got: got}, nil
+		}
+	}
+	return
+}
+
+// VerifyHead verifies the recorded chain leading to head.
+func (g *StateGraph) VerifyHead(head string) (div *Divergence, err error) {
+	defer Return(&err)
+	chain, err := g.Chain(head)
+	Ck(err)
+	return g.Verify(chain)
+}
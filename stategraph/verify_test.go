@@ -0,0 +1,61 @@
+package stategraph
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/pup"
+)
+
+func TestVerify(t *testing.T) {
+	s := &pup.Server{}
+	var calls int
+	fn := pup.Address([]byte("incr"))
+	s.Register(fn, incr(&calls))
+	g := New(s)
+
+	root := g.Put([]byte("0"))
+	var head string
+	in := root
+	for i := 0; i < 3; i++ {
+		tr, err := g.Step(in, fn)
+		Tassert(t, err == nil, "Step: %v", err)
+		in = tr.Out
+		head = tr.Out
+	}
+
+	chain, err := g.Chain(head)
+	Tassert(t, err == nil, "Chain: %v", err)
+	Tassert(t, len(chain) == 3 && chain[0].In == root && chain[2].Out == head, "chain %v", chain)
+
+	// replay re-runs every transition, memo or not
+	div, err := g.VerifyHead(head)
+	Tassert(t, err == nil, "VerifyHead: %v", err)
+	Tassert(t, div == nil, "divergence %v", div)
+	Tassert(t, calls == 6, "calls %d", calls)
+
+	// a peer that recorded a different second state
+	forged := []*Transition{chain[0], {In: chain[1].In, Fn: fn, Out: pup.Address([]byte("5"))}}
+	div, err = g.Verify(forged)
+	Tassert(t, err == nil, "Verify: %v", err)
+	Tassert(t, div != nil && div.Index == 1 && div.Got == chain[1].Out, "divergence %v", div)
+
+	// a non-deterministic implementation of the same function
+	flip := 0
+	s.Register(fn, func(hash []byte, stream io.ReadWriteCloser) error {
+		flip++
+		_, err := stream.Write([]byte{byte('0' + flip%2)})
+		return err
+	})
+	div, err = g.Verify(chain)
+	Tassert(t, err == nil, "Verify: %v", err)
+	Tassert(t, div != nil && div.Index == 1, "divergence %v", div)
+
+	_, err = g.Verify([]*Transition{chain[0], chain[2]})
+	Tassert(t, errors.Is(err, syscall.EINVAL), "err %v", err)
+	_, err = g.Chain("sha256:nope")
+	Tassert(t, errors.Is(err, syscall.ENOENT), "err %v", err)
+}
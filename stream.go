@@ -0,0 +1,192 @@
+package pup
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// ContextOf returns the context of a stream the server handed to a
+// lambda.  It is cancelled when the stream times out, when the server
+// shuts down, and when the lambda returns; see Server.IdleTimeout and
+// Server.Shutdown.  Other streams get context.Background().
+func ContextOf(stream io.ReadWriteCloser) context.Context {
+	if c, ok := stream.(interface{ Context() context.Context }); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// wrapper is the base of the server's stream wrappers.  It passes
+// CloseWrite, SetReadDeadline, RemoteAddr and Context through to the
+// stream it wraps, so lambdas can still half-close a connection, stop
+// a read, see who is on the other end, and notice when to give up.
+type wrapper struct {
+	io.ReadWriteCloser
+}
+
+func (w wrapper) CloseWrite() error {
+	if cw, ok := w.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (w wrapper) SetReadDeadline(t time.Time) error {
+	if d, ok := w.ReadWriteCloser.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (w wrapper) RemoteAddr() net.Addr {
+	if ra, ok := w.ReadWriteCloser.(interface{ RemoteAddr() net.Addr }); ok {
+		return ra.RemoteAddr()
+	}
+	return nil
+}
+
+func (w wrapper) Context() context.Context {
+	return ContextOf(w.ReadWriteCloser)
+}
+
+// serverStream is the server's side of a stream.  It counts the bytes
+// the stream carries and when it last carried any, and cuts it off
+// with EDQUOT if either direction goes over quota.  After a stream is
+// cut off, writes fail too, so that the caller gets an error reply
+// rather than a reply spoiled by the failure.
+type serverStream struct {
+	wrapper
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	quota   int64
+	in, out int64
+	last    time.Time
+	writing bool
+	replied bool
+	err     error
+}
+
+// newServerStream wraps stream, and cuts it off with ESHUTDOWN when
+// server is done.  The stream's own context is only cancelled once
+// the stream has been cut off or has ended, so that a lambda that
+// notices it is done returns after the failure is recorded.
+func newServerStream(server context.Context, stream io.ReadWriteCloser) *serverStream {
+	m := &serverStream{wrapper: wrapper{stream}, last: time.Now()}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-server.Done():
+			m.cut(Error{syscall.ESHUTDOWN, "server shutting down"})
+		case <-m.ctx.Done():
+		}
+	}()
+	return m
+}
+
+func (m *serverStream) Context() context.Context {
+	return m.ctx
+}
+
+func (m *serverStream) Read(p []byte) (n int, err error) {
+	if err = m.failure(); err != nil {
+		return 0, err
+	}
+	n, err = m.ReadWriteCloser.Read(p)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.in += int64(n)
+	if n > 0 {
+		m.last = time.Now()
+	}
+	if m.quota > 0 && m.in > m.quota && m.err == nil {
+		m.err = Error{syscall.EDQUOT, Spf("stream input is over %d bytes", m.quota)}
+	}
+	if m.err != nil {
+		return 0, m.err
+	}
+	return
+}
+
+func (m *serverStream) Write(p []byte) (n int, err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return 0, m.err
+	}
+	if m.quota > 0 && m.out+int64(len(p)) > m.quota {
+		m.err = Error{syscall.EDQUOT, Spf("stream output is over %d bytes", m.quota)}
+		p = p[:m.quota-m.out]
+	}
+	m.writing = true
+	m.mu.Unlock()
+	n, err = m.ReadWriteCloser.Write(p)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writing = false
+	m.out += int64(n)
+	if n > 0 {
+		m.last = time.Now()
+	}
+	if err == nil {
+		err = m.err
+	}
+	return
+}
+
+// limit sets the quota, counting from now, so that the header doesn't
+// count.
+func (m *serverStream) limit(quota int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quota = quota
+	m.in = 0
+}
+
+// failure returns the error that cut the stream off, if any.
+func (m *serverStream) failure() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// idle returns how long it has been since the stream carried anything.
+func (m *serverStream) idle() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Since(m.last)
+}
+
+// reply sends the caller an error reply for err, unless the lambda
+// has started its own reply.
+func (m *serverStream) reply(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.replied || m.writing || m.out > 0 {
+		return
+	}
+	m.replied = true
+	WriteError(m.ReadWriteCloser, err)
+}
+
+// cut ends the stream with err: it replies if it still can, closes
+// the stream so that blocked reads and writes return, and cancels the
+// lambda's context.
+func (m *serverStream) cut(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	err = m.err
+	m.mu.Unlock()
+	m.reply(err)
+	m.ReadWriteCloser.Close()
+	m.cancel()
+}
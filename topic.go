@@ -0,0 +1,355 @@
+package pup
+
+import (
+	"encoding/hex"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Well-known hashes for the pub/sub lambdas registered by
+// RegisterPubSub.  They are the sha256 of "pup publish" and "pup
+// subscribe".
+const (
+	PUBLISH   = "sha256:f4096ed0b474b9fa29758fc6caed8696315c4e874dc8825533c5327faab442a3"
+	SUBSCRIBE = "sha256:164655f74bf54df43e0d4ea9a6082e1a494509b91a2c25926b60ad6fb9b67649"
+)
+
+// topics holds the head of each topic's hash chain and the current
+// subscriptions.
+type topics struct {
+	mu       sync.Mutex
+	heads    map[string]*Message
+	subs     map[*Subscription]bool
+	durables map[string]*durable
+}
+
+func (s *Server) topics() *topics {
+	cache := s.Cache()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.topicmap == nil {
+		t := &topics{
+			heads:    make(map[string]*Message),
+			subs:     make(map[*Subscription]bool),
+			durables: make(map[string]*durable),
+		}
+		s.topicmap = t
+		// topic heads keep the whole topic history alive in the
+		// cache
+		cache.AddRoots(t.headAddrs)
+	}
+	return s.topicmap
+}
+
+func (t *topics) headAddrs() (addrs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range t.heads {
+		addrs = append(addrs, m.Addr())
+	}
+	sort.Strings(addrs)
+	return
+}
+
+// Topics returns the sorted names of all topics that have at least
+// one message.
+func (s *Server) Topics() (names []string) {
+	t := s.topics()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.heads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Head returns the newest message on topic, or nil if nothing has
+// been published there.
+func (s *Server) Head(topic string) *Message {
+	t := s.topics()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.heads[topic]
+}
+
+// ValidTopic returns an error if topic is not a clean, absolute
+// slash-separated path such as "/sensors/kitchen/temp".  Path
+// elements starting with "." are reserved for the filesystem view.
+func ValidTopic(topic string) error {
+	if !strings.HasPrefix(topic, "/") || path.Clean(topic) != topic || topic == "/" {
+		return Error{syscall.EINVAL, Spf("invalid topic: %q", topic)}
+	}
+	if strings.Contains(topic, "/.") {
+		return Error{syscall.EINVAL, Spf("reserved topic name: %q", topic)}
+	}
+	return nil
+}
+
+// Publish appends body to topic's hash chain, stores the resulting
+// message in the chunk cache, and delivers it to every matching
+// subscription.
+func (s *Server) Publish(topic string, body []byte) (msg *Message, err error) {
+	msg = &Message{Topic: topic, Body: body}
+	err = s.publish(msg)
+	return
+}
+
+// PublishSigned is like Publish, but the message carries author's
+// signature sig, see SignedBytes.  It fails with EACCES if the
+// signature doesn't verify.
+func (s *Server) PublishSigned(topic string, body []byte, author string, sig []byte) (msg *Message, err error) {
+	defer Return(&err)
+	msg = &Message{Topic: topic, Author: author, Sig: sig, Body: body}
+	err = msg.Verify()
+	Ck(err)
+	err = s.publish(msg)
+	Ck(err)
+	return
+}
+
+// publish fills in the chain fields of msg and appends it to its
+// topic.
+func (s *Server) publish(msg *Message) (err error) {
+	defer Return(&err)
+	err = ValidTopic(msg.Topic)
+	Ck(err)
+	t := s.topics()
+	t.mu.Lock()
+	topic := msg.Topic
+	msg.Seq = 1
+	msg.Time = time.Now()
+	head := t.heads[topic]
+	if head != nil {
+		msg.Seq = head.Seq + 1
+		msg.Prev = []string{head.Addr()}
+	}
+	s.append(t, msg)
+	t.mu.Unlock()
+	return
+}
+
+// append stores msg in the cache, makes it the head of its topic, and
+// delivers it to the matching subscriptions.  The caller must hold
+// t.mu.
+func (s *Server) append(t *topics, msg *Message) {
+	s.Cache().Put(msg.Encode(), msg.Prev...)
+	t.heads[msg.Topic] = msg
+	for sub := range t.subs {
+		if MatchTopic(sub.Pattern, msg.Topic) {
+			sub.deliver(msg)
+		}
+	}
+}
+
+// Subscribe returns a subscription that receives every message
+// published from now on to a topic matching pattern.  See MatchTopic
+// for the pattern syntax, and SubscribeFrom for replaying history.
+func (s *Server) Subscribe(pattern string) (sub *Subscription, err error) {
+	return s.SubscribeFrom(pattern, Since{})
+}
+
+// MatchTopic reports whether topic matches pattern.  A pattern
+// containing any of the glob metacharacters "*?[" is matched with
+// path.Match, so "/a/*" matches "/a/b" but not "/a/b/c".  Any other
+// pattern is a path prefix: "/a" matches "/a", "/a/b" and "/a/b/c",
+// but not "/ab".
+func MatchTopic(pattern, topic string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, topic)
+		return ok
+	}
+	if pattern == "/" || pattern == topic {
+		return true
+	}
+	return strings.HasPrefix(topic, strings.TrimSuffix(pattern, "/")+"/")
+}
+
+// Subscription delivers messages on C in the order they were
+// published.  Delivery never blocks the publisher; messages queue up
+// until the subscriber reads them.
+type Subscription struct {
+	Pattern string
+	C       <-chan *Message
+	c       chan *Message
+	mu      sync.Mutex
+	queue   []*Message
+	ended   bool
+	wake    chan bool
+	done    chan bool
+	once    sync.Once
+	cancel  func(*Subscription)
+	ack     func(*Message) error
+}
+
+func newSubscription(pattern string, cancel func(*Subscription)) *Subscription {
+	c := make(chan *Message)
+	sub := &Subscription{
+		Pattern: pattern,
+		C:       c,
+		c:       c,
+		wake:    make(chan bool, 1),
+		done:    make(chan bool),
+		cancel:  cancel,
+	}
+	go sub.pump()
+	return sub
+}
+
+func (sub *Subscription) deliver(msg *Message) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, msg)
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- true:
+	default:
+	}
+}
+
+// end tells the subscription that no more messages will arrive; C is
+// closed once the queue drains.
+func (sub *Subscription) end() {
+	sub.mu.Lock()
+	sub.ended = true
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- true:
+	default:
+	}
+}
+
+func (sub *Subscription) pump() {
+	defer close(sub.c)
+	for {
+		sub.mu.Lock()
+		var msg *Message
+		if len(sub.queue) > 0 {
+			msg = sub.queue[0]
+			sub.queue = sub.queue[1:]
+		}
+		ended := sub.ended
+		sub.mu.Unlock()
+		if msg == nil && ended {
+			return
+		}
+		if msg == nil {
+			select {
+			case <-sub.wake:
+				continue
+			case <-sub.done:
+				return
+			}
+		}
+		select {
+		case sub.c <- msg:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// Close cancels the subscription and closes C.
+func (sub *Subscription) Close() error {
+	sub.once.Do(func() {
+		if sub.cancel != nil {
+			sub.cancel(sub)
+		}
+		close(sub.done)
+	})
+	return nil
+}
+
+// RegisterPubSub registers the PUBLISH and SUBSCRIBE lambdas, which
+// expose Publish and Subscribe to PUP streams.
+//
+// A PUBLISH stream carries one line of the form "<topic> <len>",
+// followed by len bytes of message body.  A signed message's line
+// also holds the author and the signature in hex, see PublishSigned.
+// The reply is the address of the new message, followed by a newline.
+//
+// A SUBSCRIBE stream carries one line holding the topic pattern,
+// optionally followed by space-separated "key=value" fields: name
+// selects a durable subscription, and after, seq and time set the
+// fields of Since.  The reply is a sequence of encoded messages that
+// lasts until either side closes the stream.  A durable subscriber
+// acknowledges a message by sending a line of the form "ack <addr>".
+func (s *Server) RegisterPubSub() {
+	s.Register(PUBLISH, s.publishLambda)
+	s.Register(SUBSCRIBE, s.subscribeLambda)
+}
+
+func (s *Server) publishLambda(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	line, err := Readline(stream, 1024)
+	Ck(err)
+	parts := strings.Split(string(line), " ")
+	ErrnoIf(len(parts) != 2 && len(parts) != 4, syscall.EINVAL, "usage: <topic> <len> [<author> <sig>]")
+	err = s.Authorize(stream, "publish", parts[0])
+	Ck(err)
+	n, err := strconv.Atoi(parts[1])
+	Ck(err)
+	ErrnoIf(n < 0, syscall.EINVAL, "negative length %d", n)
+	ErrnoIf(n > MaxBody, syscall.EMSGSIZE, "message body of %d bytes is over %d", n, MaxBody)
+	body := make([]byte, n)
+	_, err = io.ReadFull(stream, body)
+	Ck(err)
+	var msg *Message
+	if len(parts) == 4 {
+		sig, err := hex.DecodeString(parts[3])
+		Ck(err)
+		msg, err = s.PublishSigned(parts[0], body, parts[2], sig)
+		Ck(err)
+	} else {
+		msg, err = s.Publish(parts[0], body)
+		Ck(err)
+	}
+	_, err = stream.Write([]byte(msg.Addr() + "\n"))
+	Ck(err)
+	return
+}
+
+func (s *Server) subscribeLambda(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	line, err := Readline(stream, 1024)
+	Ck(err)
+	name, pattern, since, err := parseSubscribe(string(line))
+	Ck(err)
+	err = s.Authorize(stream, "subscribe", pattern)
+	Ck(err)
+	sub, err := s.subscribe(name, pattern, since)
+	Ck(err)
+	defer sub.Close()
+	// the only thing the subscriber sends after the request line is
+	// acks; the read failing means it went away
+	go func() {
+		defer sub.Close()
+		for {
+			line, err := Readline(stream, 1024)
+			if err != nil {
+				return
+			}
+			parts := strings.Split(string(line), " ")
+			if len(parts) != 2 || parts[0] != "ack" {
+				Pl("subscribe: ignoring unknown request:", string(line))
+				continue
+			}
+			err = s.ack(sub, parts[1])
+			if err != nil {
+				Pl("subscribe: ack:", err.Error())
+			}
+		}
+	}()
+	for msg := range sub.C {
+		_, err = stream.Write(msg.Encode())
+		Ck(err)
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package pup
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b/c", true},
+		{"/a/", "/a/b", true},
+		{"/a", "/ab", false},
+		{"/", "/x", true},
+		{"/a/*", "/a/b", true},
+		{"/a/*", "/a/b/c", false},
+		{"/a/*/c", "/a/b/c", true},
+		{"/a/?", "/a/bb", false},
+	}
+	for _, c := range cases {
+		got := MatchTopic(c.pattern, c.topic)
+		Tassert(t, got == c.want, "MatchTopic(%q, %q) = %v", c.pattern, c.topic, got)
+	}
+}
+
+func recv(t *testing.T, sub *Subscription) *Message {
+	t.Helper()
+	select {
+	case msg := <-sub.C:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for message on %s", sub.Pattern)
+	}
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	s := &Server{}
+
+	prefix, err := s.Subscribe("/a")
+	Tassert(t, err == nil, "Subscribe: %v", err)
+	defer prefix.Close()
+	glob, err := s.Subscribe("/a/*")
+	Tassert(t, err == nil, "Subscribe: %v", err)
+	defer glob.Close()
+
+	m1, err := s.Publish("/a/b", []byte("one"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	m2, err := s.Publish("/a/b", []byte("two"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	m3, err := s.Publish("/a/b/c", []byte("three"))
+	Tassert(t, err == nil, "Publish: %v", err)
+
+	// hash chain
+	Tassert(t, m1.Seq == 1 && len(m1.Prev) == 0, "m1 %v", m1)
+	Tassert(t, m2.Seq == 2 && m2.Prev[0] == m1.Addr(), "m2 %v", m2)
+	Tassert(t, m3.Seq == 1, "m3 %v", m3)
+	Tassert(t, s.Head("/a/b").Addr() == m2.Addr(), "head")
+	buf, err := s.Cache().Get(m2.Addr())
+	Tassert(t, err == nil, "Get: %v", err)
+	Tassert(t, string(buf) == string(m2.Encode()), "cached message")
+
+	// delivery
+	for _, want := range []*Message{m1, m2, m3} {
+		got := recv(t, prefix)
+		Tassert(t, got.Addr() == want.Addr(), "prefix got %v want %v", got, want)
+	}
+	for _, want := range []*Message{m1, m2} {
+		got := recv(t, glob)
+		Tassert(t, got.Addr() == want.Addr(), "glob got %v want %v", got, want)
+	}
+
+	topics := s.Topics()
+	Tassert(t, len(topics) == 2 && topics[0] == "/a/b", "topics %v", topics)
+
+	// topic heads are GC roots
+	report := s.Cache().GC(false)
+	Tassert(t, len(report.Swept) == 0, "swept %v", report.Swept)
+
+	_, err = s.Publish("relative", []byte("x"))
+	Tassert(t, err != nil, "expected error")
+	_, err = s.Subscribe("/[")
+	Tassert(t, err != nil, "expected error")
+
+	// publish streams can't make the server allocate what they like
+	for line, errno := range map[string]syscall.Errno{
+		"/a/b -1\n":                 syscall.EINVAL,
+		Spf("/a/b %d\n", MaxBody+1): syscall.EMSGSIZE,
+	} {
+		err = s.publishLambda([]byte(PUBLISH), &MockReadWriteCloser{readbuf: []byte(line)})
+		Tassert(t, errors.Is(err, errno), "%q: %v", line, err)
+	}
+}
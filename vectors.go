@@ -0,0 +1,192 @@
+package pup
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// VECTOR is the well-known hash of the lambda registered by
+// RegisterVectors.  It is the sha256 of "pup vector".
+const VECTOR = "sha256:dbc844ee8e9afb108d6e9a65a1c0c04f48c8a149f7ad94435e583a62ed9175ee"
+
+// Vector is a test vector for a function hash: the address of an
+// input chunk, and the address of the output every implementation of
+// the function must produce from it.
+type Vector struct {
+	Input  string
+	Output string
+}
+
+// Encode returns v as the body of a message on its VectorTopic.
+func (v Vector) Encode() []byte {
+	return []byte(Spf("input %s\noutput %s\n", v.Input, v.Output))
+}
+
+// ParseVector parses the body of a message on a VectorTopic.
+func ParseVector(buf []byte) (v Vector, err error) {
+	for _, line := range strings.Split(string(buf), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "input":
+			v.Input = value
+		case "output":
+			v.Output = value
+		}
+	}
+	if v.Input == "" || v.Output == "" {
+		return v, Error{syscall.EBADMSG, Spf("bad test vector %q", buf)}
+	}
+	return
+}
+
+// VectorTopic returns the topic that holds the test vectors for
+// hash: "sha256:ab12..." has its vectors on "/vectors/sha256/ab12...".
+func VectorTopic(hash string) string {
+	return "/vectors/" + strings.Replace(hash, ":", "/", 1)
+}
+
+// AddVector stores input and output in the cache and publishes the
+// vector on VectorTopic(hash).  The message refers to both chunks, so
+// they live as long as the topic's history does.
+func (s *Server) AddVector(hash string, input, output []byte) (v Vector, err error) {
+	defer Return(&err)
+	v = Vector{Input: s.Cache().Put(input), Output: s.Cache().Put(output)}
+	msg, err := s.Publish(VectorTopic(hash), v.Encode())
+	Ck(err)
+	s.Cache().Put(msg.Encode(), v.Input, v.Output)
+	return
+}
+
+// Vectors returns the test vectors published for hash, oldest first.
+// Messages that don't parse as vectors, and repeats, are skipped.
+func (s *Server) Vectors(hash string) (vectors []Vector, err error) {
+	defer Return(&err)
+	head := s.Head(VectorTopic(hash))
+	if head == nil {
+		return
+	}
+	msgs, err := s.Log(head.Addr())
+	Ck(err)
+	seen := make(map[Vector]bool)
+	for _, msg := range msgs {
+		v, err := ParseVector(msg.Body)
+		if err != nil || seen[v] {
+			continue
+		}
+		seen[v] = true
+		vectors = append(vectors, v)
+	}
+	return
+}
+
+// VectorFailure describes a lambda that did not reproduce a test
+// vector, either because it returned Err or because its output, at
+// address Got, was wrong.
+type VectorFailure struct {
+	Hash   string
+	Vector Vector
+	Got    string
+	Err    error
+}
+
+func (f *VectorFailure) Error() string {
+	if f.Err != nil {
+		return Spf("%s failed test vector %s: %v", f.Hash, f.Vector.Input, f.Err)
+	}
+	return Spf("%s failed test vector %s: produced %s, want %s",
+		f.Hash, f.Vector.Input, f.Got, f.Vector.Output)
+}
+
+// Unwrap returns the lambda's error, or EBADMSG for a wrong output.
+func (f *VectorFailure) Unwrap() error {
+	if f.Err != nil {
+		return f.Err
+	}
+	return syscall.EBADMSG
+}
+
+// CheckVector runs v's input through lambda as an implementation of
+// hash, and returns a *VectorFailure unless it produces v's output.
+func (s *Server) CheckVector(hash string, lambda Lambda, v Vector) (err error) {
+	defer Return(&err)
+	input, err := s.Cache().Get(v.Input)
+	Ck(err)
+	stream := &bufStream{Reader: bytes.NewReader(input)}
+	err = lambda([]byte(hash), stream)
+	got := Address(stream.out.Bytes())
+	if err != nil || got != v.Output {
+		return &VectorFailure{Hash: hash, Vector: v, Got: got, Err: err}
+	}
+	return
+}
+
+// CheckVectors runs every test vector published for hash through
+// lambda, and returns the first failure.
+func (s *Server) CheckVectors(hash string, lambda Lambda) (err error) {
+	defer Return(&err)
+	vectors, err := s.Vectors(hash)
+	Ck(err)
+	for _, v := range vectors {
+		err = s.CheckVector(hash, lambda, v)
+		Ck(err)
+	}
+	return
+}
+
+// RegisterVectors registers the VECTOR lambda, which exposes
+// AddVector to PUP streams.  A VECTOR stream carries one line of the
+// form "<hash> <inlen> <outlen>", followed by inlen bytes of input and
+// outlen bytes of expected output, each at most MaxBody.  The reply
+// is the input address, a space and the output address, followed by
+// a newline.  If the server requires tokens, the stream's token must
+// also allow publishing to VectorTopic(hash); see Authorize.
+func (s *Server) RegisterVectors() {
+	s.Register(VECTOR, s.vectorLambda)
+}
+
+func (s *Server) vectorLambda(hash []byte, stream io.ReadWriteCloser) (err error) {
+	defer Return(&err)
+	line, err := Readline(stream, 1024)
+	Ck(err)
+	parts := strings.Split(string(line), " ")
+	ErrnoIf(len(parts) != 3, syscall.EINVAL, "want '<hash> <inlen> <outlen>', got %q", line)
+	err = s.Authorize(stream, "publish", VectorTopic(parts[0]))
+	Ck(err)
+	inlen, err := strconv.Atoi(parts[1])
+	Ck(err)
+	outlen, err := strconv.Atoi(parts[2])
+	Ck(err)
+	ErrnoIf(inlen < 0 || outlen < 0, syscall.EINVAL, "negative length in %q", line)
+	ErrnoIf(inlen > MaxBody || outlen > MaxBody, syscall.EMSGSIZE, "vector in %q is over %d bytes", line, MaxBody)
+	buf := make([]byte, inlen+outlen)
+	_, err = io.ReadFull(stream, buf)
+	Ck(err)
+	v, err := s.AddVector(parts[0], buf[:inlen], buf[inlen:])
+	Ck(err)
+	_, err = stream.Write([]byte(v.Input + " " + v.Output + "\n"))
+	Ck(err)
+	return
+}
+
+// AddVector publishes a test vector for hash on the server.
+func (c *Client) AddVector(hash string, input, output []byte) (v Vector, err error) {
+	defer Return(&err)
+	conn, err := c.Open(VECTOR)
+	Ck(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(Spf("%s %d %d\n", hash, len(input), len(output))))
+	Ck(err)
+	_, err = conn.Write(append(append([]byte{}, input...), output...))
+	Ck(err)
+	line, err := Readline(conn, 1024)
+	Ck(err)
+	parts := strings.Fields(string(line))
+	ErrnoIf(len(parts) != 2, syscall.EBADMSG, "bad reply %q", line)
+	v = Vector{Input: parts[0], Output: parts[1]}
+	return
+}
@@ -0,0 +1,86 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func upperLambda(hash []byte, stream io.ReadWriteCloser) error {
+	buf, err := io.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(bytes.ToUpper(buf))
+	return err
+}
+
+func TestVectors(t *testing.T) {
+	s := &Server{}
+	hash := "sha256:0f"
+	vectors, err := s.Vectors(hash)
+	Tassert(t, err == nil && len(vectors) == 0, "no vectors: %v %v", err, vectors)
+
+	v1, err := s.AddVector(hash, []byte("abc"), []byte("ABC"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+	Tassert(t, v1 == Vector{Address([]byte("abc")), Address([]byte("ABC"))}, "vector %v", v1)
+	_, err = s.AddVector(hash, []byte("abc"), []byte("ABC"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+	_, err = s.Publish(VectorTopic(hash), []byte("junk"))
+	Tassert(t, err == nil, "Publish: %v", err)
+	v2, err := s.AddVector(hash, []byte("x y"), []byte("X Y"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+	vectors, err = s.Vectors(hash)
+	Tassert(t, err == nil, "Vectors: %v", err)
+	Tassert(t, len(vectors) == 2 && vectors[0] == v1 && vectors[1] == v2, "vectors %v", vectors)
+
+	v, err := ParseVector(v2.Encode())
+	Tassert(t, err == nil && v == v2, "ParseVector: %v %v", v, err)
+	_, err = ParseVector([]byte("input sha256:00\n"))
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "ParseVector: %v", err)
+
+	// the vector chunks survive GC for as long as the topic does
+	s.Cache().GC(false)
+	Tassert(t, s.Cache().Has(v1.Input) && s.Cache().Has(v1.Output), "vector chunks collected")
+
+	err = s.CheckVectors(hash, upperLambda)
+	Tassert(t, err == nil, "CheckVectors: %v", err)
+	err = s.CheckVectors(hash, constLambda("ABC"))
+	var f *VectorFailure
+	Tassert(t, errors.As(err, &f) && f.Vector == v2 && f.Got == v1.Output, "wrong output: %v", err)
+	Tassert(t, errors.Is(err, syscall.EBADMSG), "wrong output errno: %v", err)
+	err = s.CheckVector(hash, failLambda, v1)
+	Tassert(t, errors.As(err, &f) && errors.Is(err, syscall.EIO), "failing lambda: %v", err)
+
+	// VECTOR streams can't make the server allocate what they like
+	for line, errno := range map[string]syscall.Errno{
+		"sha256:0f -1 2\n":                 syscall.EINVAL,
+		Spf("sha256:0f 1 %d\n", MaxBody+1): syscall.EMSGSIZE,
+	} {
+		err = s.vectorLambda([]byte(VECTOR), &MockReadWriteCloser{readbuf: []byte(line)})
+		Tassert(t, errors.Is(err, errno), "%q: %v", line, err)
+	}
+}
+
+func TestClientVectors(t *testing.T) {
+	port := 10851
+	s := &Server{}
+	s.RegisterVectors()
+	go func() {
+		err := s.Serve("127.0.0.1", port)
+		Tassert(t, err == nil, "Serve: %v", err)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	c := &Client{Addr: Spf("127.0.0.1:%d", port)}
+	v, err := c.AddVector("sha256:0f", []byte("in\n"), []byte("IN\n"))
+	Tassert(t, err == nil, "AddVector: %v", err)
+	vectors, err := s.Vectors("sha256:0f")
+	Tassert(t, err == nil && len(vectors) == 1 && vectors[0] == v, "vectors %v %v", vectors, err)
+	Tassert(t, v.Output == Address([]byte("IN\n")), "vector %v", v)
+}
@@ -0,0 +1,125 @@
+package pup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// WasmLimits bounds what one invocation of a WASM lambda may use.
+//
+// There is no instruction or fuel limit: wazero, the runtime, doesn't
+// meter execution, and metering would mean rewriting every module to
+// count its own instructions.  Timeout bounds the CPU a module can
+// use instead, which, unlike fuel, depends on the machine and its
+// load.
+type WasmLimits struct {
+	// MemoryPages caps the module's linear memory, in 64KiB pages.
+	// Zero means 256 pages (16MiB).
+	MemoryPages uint32
+	// Timeout caps the run time of each invocation.  Zero means 10
+	// seconds.
+	Timeout time.Duration
+}
+
+// RegisterWasm registers the WASI module in module under its content
+// address and returns the address.
+func (s *Server) RegisterWasm(module []byte, limits WasmLimits) (hash string, err error) {
+	defer Return(&err)
+	lambda, err := WasmLambda(module, limits)
+	Ck(err)
+	hash = Address(module)
+	s.Register(hash, lambda)
+	return
+}
+
+// WasmLambda compiles the WASI module in module and returns a lambda
+// that runs a fresh instance of it for each stream.  The module's
+// stdin reads the rest of the stream, its stdout writes to the
+// stream, and its only argument is the lambda's hash.  The module
+// gets no filesystem, no environment, and no network; its clocks and
+// random source are the runtime's deterministic defaults.
+//
+// A non-zero exit status is returned as EIO, with the status in the
+// message, as ExecLambda does, and running past limits.Timeout as
+// ETIMEDOUT.  The instance is
+// also stopped when the stream's context is done; see ContextOf.
+//
+// Each invocation gets a runtime of its own, closed when it returns,
+// so a lambda that is dropped leaves nothing running.  The compiled
+// code is cached with the lambda.
+func WasmLambda(module []byte, limits WasmLimits) (lambda Lambda, err error) {
+	defer Return(&err)
+	if limits.MemoryPages == 0 {
+		limits.MemoryPages = 256
+	}
+	if limits.Timeout == 0 {
+		limits.Timeout = 10 * time.Second
+	}
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(limits.MemoryPages).
+		WithCloseOnContextDone(true).
+		WithCompilationCache(wazero.NewCompilationCache())
+
+	// compile now, so that a bad module fails here rather than on
+	// every call
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+	_, err = r.CompileModule(ctx, module)
+	r.Close(ctx)
+	if err != nil {
+		return nil, Error{syscall.ENOEXEC, err.Error()}
+	}
+
+	lambda = func(hash []byte, stream io.ReadWriteCloser) (err error) {
+		ctx, cancel := context.WithTimeout(ContextOf(stream), limits.Timeout)
+		defer cancel()
+		r := wazero.NewRuntimeWithConfig(ctx, config)
+		defer r.Close(context.Background())
+		_, err = wasi_snapshot_preview1.Instantiate(ctx, r)
+		if err != nil {
+			return wasmError(err)
+		}
+		compiled, err := r.CompileModule(ctx, module)
+		if err != nil {
+			return Error{syscall.ENOEXEC, err.Error()}
+		}
+		config := wazero.NewModuleConfig().
+			WithName("").
+			WithArgs(string(hash)).
+			WithStdin(stream).
+			WithStdout(stream)
+		mod, err := r.InstantiateModule(ctx, compiled, config)
+		if mod != nil {
+			mod.Close(ctx)
+		}
+		return wasmError(err)
+	}
+	return
+}
+
+// wasmError turns the error from running a module into a pup.Error.
+func wasmError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var exit *sys.ExitError
+	if !errors.As(err, &exit) {
+		return Error{syscall.EIO, err.Error()}
+	}
+	switch code := exit.ExitCode(); code {
+	case 0:
+		return nil
+	case sys.ExitCodeDeadlineExceeded, sys.ExitCodeContextCanceled:
+		return Error{syscall.ETIMEDOUT, "wasm lambda timed out"}
+	default:
+		return Error{syscall.EIO, Spf("wasm lambda exited with status %d", code)}
+	}
+}
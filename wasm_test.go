@@ -0,0 +1,129 @@
+package pup
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// wasiModule assembles a minimal WASI module with pages of memory and
+// a _start function whose body is code.  It imports fd_read (func
+// 0), fd_write (func 1) and proc_exit (func 2).
+func wasiModule(pages byte, code ...byte) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	name := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	imp := func(field string, typ byte) (b []byte) {
+		b = append(b, name("wasi_snapshot_preview1")...)
+		b = append(b, name(field)...)
+		return append(b, 0x00, typ)
+	}
+	var m []byte
+	m = append(m, 0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00)
+	m = append(m, section(1, 3,
+		0x60, 4, 0x7f, 0x7f, 0x7f, 0x7f, 1, 0x7f, // (i32 i32 i32 i32) -> i32
+		0x60, 1, 0x7f, 0, // (i32) -> ()
+		0x60, 0, 0, // () -> ()
+	)...)
+	var imports []byte
+	imports = append(imports, 3)
+	imports = append(imports, imp("fd_read", 0)...)
+	imports = append(imports, imp("fd_write", 0)...)
+	imports = append(imports, imp("proc_exit", 1)...)
+	m = append(m, section(2, imports...)...)
+	m = append(m, section(3, 1, 2)...)
+	m = append(m, section(5, 1, 0x00, pages)...)
+	var exports []byte
+	exports = append(exports, 2)
+	exports = append(exports, name("memory")...)
+	exports = append(exports, 0x02, 0)
+	exports = append(exports, name("_start")...)
+	exports = append(exports, 0x00, 3)
+	m = append(m, section(7, exports...)...)
+	body := append([]byte{0}, code...) // no locals
+	body = append(body, 0x0b)
+	fn := append([]byte{byte(len(body))}, body...)
+	m = append(m, section(10, append([]byte{1}, fn...)...)...)
+	return m
+}
+
+// echoWasm copies stdin to stdout through a 1KiB buffer at offset 16.
+var echoWasm = wasiModule(1,
+	0x02, 0x40, // block
+	0x03, 0x40, // loop
+	0x41, 0, 0x41, 16, 0x36, 2, 0, // iov.buf = 16
+	0x41, 4, 0x41, 0x80, 0x08, 0x36, 2, 0, // iov.len = 1024
+	0x41, 0, 0x41, 0, 0x41, 1, 0x41, 8, 0x10, 0, // fd_read(0, iov, 1, &n)
+	0x0d, 1, // br_if errno
+	0x41, 8, 0x28, 2, 0, 0x45, 0x0d, 1, // br_if n == 0
+	0x41, 4, 0x41, 8, 0x28, 2, 0, 0x36, 2, 0, // iov.len = n
+	0x41, 1, 0x41, 0, 0x41, 1, 0x41, 12, 0x10, 1, // fd_write(1, iov, 1, &n)
+	0x0d, 1, // br_if errno
+	0x0c, 0, // br loop
+	0x0b, // end loop
+	0x0b, // end block
+)
+
+// spinWasm never returns.
+var spinWasm = wasiModule(1, 0x03, 0x40, 0x0c, 0, 0x0b)
+
+// exitWasm exits with status 7.
+var exitWasm = wasiModule(1, 0x41, 7, 0x10, 2)
+
+func TestWasmLambda(t *testing.T) {
+	s := &Server{}
+	hash, err := s.RegisterWasm(echoWasm, WasmLimits{})
+	Tassert(t, err == nil, "RegisterWasm: %v", err)
+	Tassert(t, hash == Address(echoWasm), "hash %s", hash)
+
+	// several instances can run at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			in := strings.Repeat(Spf("line %d\n", i), 500)
+			stream := &bufStream{Reader: strings.NewReader(in)}
+			err := s.Dereference(hash)([]byte(hash), stream)
+			Tassert(t, err == nil, "lambda: %v", err)
+			Tassert(t, stream.out.String() == in, "got %d bytes", stream.out.Len())
+		}(i)
+	}
+	wg.Wait()
+
+	// the lambda also runs through the server's stream handler
+	stream := &bufStream{Reader: strings.NewReader(hash + "\nhello")}
+	err = s.handleStream(stream)
+	Tassert(t, err == nil, "handleStream: %v", err)
+	Tassert(t, stream.out.String() == "hello", "got '%s'", stream.out.String())
+}
+
+func TestWasmLimits(t *testing.T) {
+	lambda, err := WasmLambda(spinWasm, WasmLimits{Timeout: 100 * time.Millisecond})
+	Tassert(t, err == nil, "WasmLambda: %v", err)
+	start := time.Now()
+	err = lambda(nil, &bufStream{Reader: &bytes.Buffer{}})
+	Tassert(t, errors.Is(err, syscall.ETIMEDOUT), "err %v", err)
+	Tassert(t, time.Since(start) < 5*time.Second, "took %v", time.Since(start))
+
+	lambda, err = WasmLambda(exitWasm, WasmLimits{})
+	Tassert(t, err == nil, "WasmLambda: %v", err)
+	err = lambda(nil, &bufStream{Reader: &bytes.Buffer{}})
+	Tassert(t, errors.Is(err, syscall.EIO) && strings.Contains(err.Error(), "status 7"), "err %v", err)
+
+	// memory beyond the limit
+	_, err = WasmLambda(wasiModule(4, 0x01), WasmLimits{MemoryPages: 2})
+	Tassert(t, err != nil, "expected error")
+
+	_, err = WasmLambda([]byte("not wasm"), WasmLimits{})
+	Tassert(t, errors.Is(err, syscall.ENOEXEC), "err %v", err)
+}